@@ -0,0 +1,161 @@
+package main
+
+import (
+	"path/filepath"
+
+	"github.com/utilitywarehouse/kube-applier/config"
+	"github.com/utilitywarehouse/kube-applier/git"
+	"github.com/utilitywarehouse/kube-applier/kube"
+	"github.com/utilitywarehouse/kube-applier/log"
+	"github.com/utilitywarehouse/kube-applier/metrics"
+	"github.com/utilitywarehouse/kube-applier/notify"
+	"github.com/utilitywarehouse/kube-applier/run"
+	"github.com/utilitywarehouse/kube-applier/sysutil"
+	"github.com/utilitywarehouse/kube-applier/webserver"
+)
+
+// cluster holds the components that apply the manifests of one cluster. Each cluster has its own queue, runs and
+// history, so that a slow or failing cluster does not hold back the others.
+// The cluster is unnamed when kube-applier applies to a single cluster, without a clusters section in the
+// configuration file.
+type cluster struct {
+	name             string
+	kubeClient       *kube.Client
+	batchApplier     *run.BatchApplier
+	runner           *run.Runner
+	scheduler        *run.Scheduler
+	notifier         *notify.Notifier
+	history          *run.History
+	runQueue         *run.Queue
+	pin              *run.Pin
+	webserverResults chan run.Result
+}
+
+// newCluster creates the components of a cluster, applying the manifests under cc.RepoPath, within cfg.RepoPath, with
+// the credentials of cc.Kubeconfig. An empty cc applies the whole of cfg.RepoPath to the cluster kube-applier runs in,
+// or to cfg.Server, reading it with gitUtil.
+func newCluster(cfg *config.Config, cc config.ClusterConfig, util git.Util, gitUtil git.UtilInterface, m *metrics.Prometheus, clock sysutil.ClockInterface, pruneWhitelist []string, webhooks []notify.Webhook, errors chan<- error) (*cluster, error) {
+	c := &cluster{name: cc.Name}
+	repoPath := cfg.RepoPath
+	historyPath := cfg.History.Path
+	if cc.Name != "" {
+		repoPath = filepath.Join(cfg.RepoPath, cc.RepoPath)
+		// Only the changes to the manifests of the cluster are considered, rather than the whole repository
+		util.RepoPath = repoPath
+		util.Paths = []string{"."}
+		gitUtil = &util
+		if historyPath != "" {
+			historyPath = filepath.Join(historyPath, cc.Name)
+		}
+	}
+	clusterMetrics := m.ForCluster(cc.Name)
+
+	c.kubeClient = &kube.Client{
+		Server:         cfg.Server,
+		Kubeconfig:     cc.Kubeconfig,
+		Context:        cc.Context,
+		Metrics:        clusterMetrics,
+		FieldManager:   cfg.Apply.FieldManager,
+		ForceConflicts: cfg.Apply.ForceConflicts,
+		PruneWhitelist: pruneWhitelist,
+	}
+	if err := c.kubeClient.Configure(); err != nil {
+		log.Logger.Error("kubectl configuration failed", "cluster", cc.Name, "error", err)
+	}
+
+	c.batchApplier = &run.BatchApplier{
+		KubeClient:      c.kubeClient,
+		DryRun:          cfg.Apply.DryRun,
+		ServerSide:      cfg.Apply.ServerSide,
+		Diff:            cfg.Apply.Diff,
+		Metrics:         clusterMetrics,
+		Workers:         cfg.Apply.Workers,
+		Timeout:         seconds(cfg.Apply.TimeoutSeconds),
+		Retries:         cfg.Apply.Retries,
+		RetryBackoff:    seconds(cfg.Apply.RetryBackoffSeconds),
+		ShutdownTimeout: seconds(cfg.ShutdownTimeoutSeconds),
+	}
+
+	c.history = &run.History{
+		Dir:  historyPath,
+		Size: cfg.History.Size,
+	}
+	if err := c.history.Load(); err != nil {
+		return nil, err
+	}
+
+	// Webserver, scheduler and the namespace watcher add run requests to runQueue, runner takes the requests and
+	// initiates runs. Requests are merged with the pending ones, see run.Queue.
+	c.runQueue = run.NewQueue()
+
+	// Runner pins the commits applied by forced runs, webserver shows and removes the pin.
+	c.pin = &run.Pin{}
+
+	// Runner sends run results to runResults channel, notifier receives the results, sends notifications for the
+	// namespaces that started failing or recovered and passes them on to webserverResults, webserver receives the
+	// results and displays them.
+	// Limit of 5 is arbitrary - there is significant delay between sends, and receives are handled near instantaneously.
+	runResults := make(chan run.Result, 5)
+	c.webserverResults = make(chan run.Result, 5)
+
+	c.runner = &run.Runner{
+		RepoPath:         repoPath,
+		RepoPathFilters:  cfg.RepoPathFilters,
+		BatchApplier:     c.batchApplier,
+		GitUtil:          gitUtil,
+		Clock:            clock,
+		Metrics:          clusterMetrics,
+		DiffURLFormat:    cfg.DiffURLFormat,
+		VerifySignatures: cfg.Git.VerifySignatures != "none",
+		VerifyAllCommits: cfg.Git.VerifySignatures == "all",
+		RunQueue:         c.runQueue,
+		Pin:              c.pin,
+		RunResults:       runResults,
+		Errors:           errors,
+	}
+	// The commits applied before a restart were verified already, runs refused by the verification applied nothing
+	for _, r := range c.history.List() {
+		if r.TotalFiles() > 0 {
+			c.runner.VerifiedCommit = r.CommitHash
+			break
+		}
+	}
+
+	c.scheduler = &run.Scheduler{
+		GitUtil:         gitUtil,
+		PollInterval:    seconds(cfg.PollIntervalSeconds),
+		FullRunInterval: seconds(cfg.FullRunIntervalSeconds),
+		RepoPathFilters: cfg.RepoPathFilters,
+		RunQueue:        c.runQueue,
+		Errors:          errors,
+	}
+
+	c.notifier = &notify.Notifier{
+		Webhooks:   webhooks,
+		KubeClient: c.kubeClient,
+		Cluster:    cc.Name,
+		RunResults: runResults,
+		Forward:    c.webserverResults,
+	}
+	return c, nil
+}
+
+// queue adds req to the run queue of the cluster, unless it is covered by a pending request.
+func (c *cluster) queue(req run.Request) {
+	if c.runQueue.Add(req) {
+		log.Logger.Info("Run queued", "cluster", c.name, "type", req.Type, "namespace", req.Namespace)
+	} else {
+		log.Logger.Info("Run already pending", "cluster", c.name, "type", req.Type, "namespace", req.Namespace)
+	}
+}
+
+// webserverCluster returns the runs, queue and pinned commit of the cluster served by the webserver.
+func (c *cluster) webserverCluster() webserver.Cluster {
+	return webserver.Cluster{
+		Name:       c.name,
+		History:    c.history,
+		RunQueue:   c.runQueue,
+		Pin:        c.pin,
+		RunResults: c.webserverResults,
+	}
+}
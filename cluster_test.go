@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/utilitywarehouse/kube-applier/config"
+	"github.com/utilitywarehouse/kube-applier/git"
+	"github.com/utilitywarehouse/kube-applier/log"
+	"github.com/utilitywarehouse/kube-applier/metrics"
+	"github.com/utilitywarehouse/kube-applier/run"
+	"github.com/utilitywarehouse/kube-applier/sysutil"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewCluster(t *testing.T) {
+	log.InitLogger("info")
+	assert := assert.New(t)
+
+	tmp, err := ioutil.TempDir("", "kube-applier-cluster-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// The first commit changes both clusters, the second one only staging
+	repo := filepath.Join(tmp, "repo")
+	if err := exec.Command("git", "init", "-q", repo).Run(); err != nil {
+		t.Fatal(err)
+	}
+	var hashes []string
+	for _, files := range [][]string{{"prod/ns-a/file", "staging/ns-b/file"}, {"staging/ns-b/file"}} {
+		for _, f := range files {
+			path := filepath.Join(repo, f)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, []byte(strings.Join(hashes, ",")), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, args := range [][]string{{"add", "-A"}, {"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "commit"}} {
+			cmd := exec.Command("git", args...)
+			cmd.Dir = repo
+			if out, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("git %v failed: %v: %s", args, err, out)
+			}
+		}
+		cmd := exec.Command("git", "rev-parse", "--short", "HEAD")
+		cmd.Dir = repo
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, strings.TrimSpace(string(out)))
+	}
+
+	cfg := &config.Config{RepoPath: repo}
+	cfg.History.Path = filepath.Join(tmp, "history")
+	m := &metrics.Prometheus{}
+	m.Init()
+	util := git.Util{RepoPath: repo}
+	errors := make(chan error)
+
+	// A single unnamed cluster considers the whole repository
+	c, err := newCluster(cfg, config.ClusterConfig{}, util, &util, m, &sysutil.Clock{}, nil, nil, errors)
+	assert.Nil(err)
+	assert.Equal(repo, c.runner.RepoPath)
+	assert.Equal(cfg.History.Path, c.history.Dir)
+	hash, err := c.runner.GitUtil.HeadHashForPaths()
+	assert.Nil(err)
+	assert.Equal(hashes[1], hash)
+	c.batchApplier.Metrics.UpdateApplyTimeoutCount(filepath.Join(repo, "ns-a"))
+
+	// The commits are verified since the latest run in the history that applied anything
+	history := &run.History{Dir: filepath.Join(cfg.History.Path, "prod")}
+	assert.Nil(history.Load())
+	_, err = history.Add(run.Result{CommitHash: hashes[0], Successes: []run.ApplyAttempt{{FilePath: "ns-a"}}})
+	assert.Nil(err)
+	_, err = history.Add(run.Result{CommitHash: hashes[1], ErrorMessage: "Refusing to apply"})
+	assert.Nil(err)
+	cfg.Git.VerifySignatures = "all"
+
+	// A named cluster only considers its own path, keeps its own history and labels its metrics with its name
+	c, err = newCluster(cfg, config.ClusterConfig{Name: "prod", RepoPath: "prod"}, util, &util, m, &sysutil.Clock{}, nil, nil, errors)
+	assert.Nil(err)
+	assert.Equal("prod", c.name)
+	assert.Equal(filepath.Join(repo, "prod"), c.runner.RepoPath)
+	assert.Equal(filepath.Join(cfg.History.Path, "prod"), c.history.Dir)
+	assert.DirExists(c.history.Dir)
+	assert.Equal(hashes[0], c.runner.VerifiedCommit)
+	hash, err = c.runner.GitUtil.HeadHashForPaths()
+	assert.Nil(err)
+	assert.Equal(hashes[0], hash)
+	hash, err = c.scheduler.GitUtil.HeadHashForPaths()
+	assert.Nil(err)
+	assert.Equal(hashes[0], hash)
+	files, err := c.runner.GitUtil.ChangedFilesForPaths(hashes[0])
+	assert.Nil(err)
+	assert.Empty(files)
+	c.batchApplier.Metrics.UpdateApplyTimeoutCount(filepath.Join(repo, "prod", "ns-a"))
+
+	expected := `
+# HELP kubectl_apply_timeout_count Count of kubectl applies killed for exceeding the apply timeout
+# TYPE kubectl_apply_timeout_count counter
+kubectl_apply_timeout_count{cluster="",namespace="ns-a"} 1
+kubectl_apply_timeout_count{cluster="prod",namespace="ns-a"} 1
+`
+	assert.Nil(testutil.GatherAndCompare(prometheus.DefaultGatherer, strings.NewReader(expected), "kubectl_apply_timeout_count"))
+}
@@ -0,0 +1,512 @@
+// Package config loads the kube-applier configuration from an optional YAML
+// file, environment variables and command line flags, in increasing order of
+// precedence.
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Value shown in place of secrets
+const redacted = "<redacted>"
+
+// clusterNameRegex matches valid cluster names, which are used in URLs and file names.
+var clusterNameRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// Config holds every kube-applier setting. The JSON field names are the keys
+// used in the configuration file.
+type Config struct {
+	RepoPath               string               `json:"repoPath"`
+	RepoPathFilters        []string             `json:"repoPathFilters,omitempty"`
+	ListenPort             int                  `json:"listenPort"`
+	Server                 string               `json:"server,omitempty"`
+	DiffURLFormat          string               `json:"diffURLFormat,omitempty"`
+	LogLevel               string               `json:"logLevel"`
+	PollIntervalSeconds    int                  `json:"pollIntervalSeconds"`
+	FullRunIntervalSeconds int                  `json:"fullRunIntervalSeconds"`
+	ShutdownTimeoutSeconds int                  `json:"shutdownTimeoutSeconds"`
+	Apply                  ApplyConfig          `json:"apply"`
+	History                HistoryConfig        `json:"history"`
+	Git                    GitConfig            `json:"git"`
+	Notify                 NotifyConfig         `json:"notify"`
+	Webhook                WebhookConfig        `json:"webhook"`
+	Health                 HealthConfig         `json:"health"`
+	LeaderElection         LeaderElectionConfig `json:"leaderElection"`
+	Clusters               []ClusterConfig      `json:"clusters,omitempty"`
+	file                   string
+}
+
+// ClusterConfig describes one of the clusters applied to by a single
+// kube-applier, which can only be set in the configuration file. The namespace
+// directories of the cluster are in RepoPath, relative to the repoPath of the
+// Config. The cluster is reached with Context of the Kubeconfig file, or the
+// in-cluster configuration if Kubeconfig is empty.
+type ClusterConfig struct {
+	Name       string `json:"name"`
+	RepoPath   string `json:"repoPath"`
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+	Context    string `json:"context,omitempty"`
+}
+
+// ApplyConfig holds the settings of the kubectl applies.
+type ApplyConfig struct {
+	DryRun              bool   `json:"dryRun"`
+	Diff                bool   `json:"diff"`
+	ServerSide          bool   `json:"serverSide"`
+	FieldManager        string `json:"fieldManager,omitempty"`
+	ForceConflicts      bool   `json:"forceConflicts"`
+	PruneWhitelistFile  string `json:"pruneWhitelistFile,omitempty"`
+	Workers             int    `json:"workers"`
+	TimeoutSeconds      int    `json:"timeoutSeconds"`
+	Retries             int    `json:"retries"`
+	RetryBackoffSeconds int    `json:"retryBackoffSeconds"`
+}
+
+// HistoryConfig holds the settings of the run history.
+type HistoryConfig struct {
+	Path string `json:"path,omitempty"`
+	Size int    `json:"size"`
+}
+
+// GitConfig holds the settings of the built-in Git sync, which is enabled when
+// RepoURL is set, and of commit signature verification.
+type GitConfig struct {
+	RepoURL             string `json:"repoURL,omitempty"`
+	Branch              string `json:"branch,omitempty"`
+	Dir                 string `json:"dir,omitempty"`
+	SyncIntervalSeconds int    `json:"syncIntervalSeconds"`
+	SSHKeyPath          string `json:"sshKeyPath,omitempty"`
+	KnownHostsPath      string `json:"knownHostsPath,omitempty"`
+	HTTPSUsername       string `json:"httpsUsername,omitempty"`
+	HTTPSPassword       string `json:"httpsPassword,omitempty"`
+	VerifySignatures    string `json:"verifySignatures"`
+	GPGHome             string `json:"gpgHome,omitempty"`
+	AllowedSignersPath  string `json:"allowedSignersPath,omitempty"`
+}
+
+// NotifyConfig holds the URLs that notifications are sent to.
+type NotifyConfig struct {
+	SlackWebhookURLs []string `json:"slackWebhookURLs,omitempty"`
+	WebhookURLs      []string `json:"webhookURLs,omitempty"`
+}
+
+// WebhookConfig holds the settings of the push webhooks endpoint.
+type WebhookConfig struct {
+	Secret string `json:"secret,omitempty"`
+}
+
+// HealthConfig holds the settings of the health checks.
+type HealthConfig struct {
+	MaxMissedIntervals int `json:"maxMissedIntervals"`
+}
+
+// LeaderElectionConfig holds the settings of leader election.
+type LeaderElectionConfig struct {
+	Enabled   bool   `json:"enabled"`
+	Namespace string `json:"namespace,omitempty"`
+	LeaseName string `json:"leaseName"`
+}
+
+// ValidationError lists every invalid setting found while loading a Config.
+type ValidationError []string
+
+// Error returns the problems found, one per line.
+func (e ValidationError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e, "\n  ")
+}
+
+// Default returns a Config with the default value of every setting.
+func Default() *Config {
+	return &Config{
+		ListenPort:             8080,
+		LogLevel:               "warn",
+		PollIntervalSeconds:    5,
+		FullRunIntervalSeconds: 3600,
+		ShutdownTimeoutSeconds: 20,
+		Apply: ApplyConfig{
+			Workers:             1,
+			Retries:             3,
+			RetryBackoffSeconds: 5,
+		},
+		History: HistoryConfig{Size: 20},
+		Git: GitConfig{
+			SyncIntervalSeconds: 30,
+			VerifySignatures:    "none",
+		},
+		Health:         HealthConfig{MaxMissedIntervals: 3},
+		LeaderElection: LeaderElectionConfig{LeaseName: "kube-applier"},
+	}
+}
+
+// Load returns the Config built from the defaults, the YAML file set with the
+// -config flag or CONFIG_FILE, the environment variables and the command line
+// flags, each overriding the previous ones. Empty environment variables are
+// ignored. The returned error lists every invalid setting.
+func Load(args []string) (*Config, error) {
+	return load(args, os.LookupEnv)
+}
+
+func load(args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	c := Default()
+	settings := settings(c)
+
+	fs := flag.NewFlagSet("kube-applier", flag.ContinueOnError)
+	configFile := fs.String("config", "", "Path to a YAML configuration file (env CONFIG_FILE)")
+	flags := make([]*flagValue, len(settings))
+	for i, s := range settings {
+		flags[i] = &flagValue{isBool: s.isBool}
+		fs.Var(flags[i], s.flag(), fmt.Sprintf("%s (env %s, config %s)", s.usage, s.env, s.key))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	path := *configFile
+	if path == "" {
+		path, _ = lookupEnv("CONFIG_FILE")
+	}
+	if path != "" {
+		if err := c.loadFile(path); err != nil {
+			return nil, err
+		}
+		c.file = path
+	}
+
+	var errs ValidationError
+	for _, s := range settings {
+		if v, ok := lookupEnv(s.env); ok && v != "" {
+			if err := s.set(v); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", s.env, err))
+			}
+		}
+	}
+	for i, s := range settings {
+		if flags[i].set {
+			if err := s.set(flags[i].value); err != nil {
+				errs = append(errs, fmt.Sprintf("-%s: %v", s.flag(), err))
+			}
+		}
+	}
+
+	c.complete()
+	if err := c.Validate(); err != nil {
+		errs = append(errs, err.(ValidationError)...)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return c, nil
+}
+
+// File returns the path of the configuration file the Config was loaded from,
+// or an empty string if there was none.
+func (c *Config) File() string {
+	return c.file
+}
+
+// loadFile sets the settings found in the YAML file at path. Unknown keys are
+// rejected, so that typos are not silently ignored.
+func (c *Config) loadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file failed: %v", err)
+	}
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return fmt.Errorf("parsing config file %s failed: %v", path, err)
+	}
+	return nil
+}
+
+// complete sets the defaults that depend on other settings.
+func (c *Config) complete() {
+	if c.Git.RepoURL != "" {
+		if c.Git.Branch == "" {
+			c.Git.Branch = "master"
+		}
+		if c.Git.Dir == "" {
+			c.Git.Dir = c.RepoPath
+		}
+	}
+}
+
+// Validate checks every setting and returns a ValidationError listing all the
+// invalid ones, or nil.
+func (c *Config) Validate() error {
+	var errs ValidationError
+	if c.RepoPath == "" {
+		errs = append(errs, "repoPath (REPO_PATH) is required")
+	}
+	if c.ListenPort < 1 || c.ListenPort > 65535 {
+		errs = append(errs, "listenPort (LISTEN_PORT) must be a valid port number")
+	}
+	if c.DiffURLFormat != "" && !strings.Contains(c.DiffURLFormat, "%s") {
+		errs = append(errs, fmt.Sprintf("diffURLFormat (DIFF_URL_FORMAT) must contain %q: %v", "%s", c.DiffURLFormat))
+	}
+	switch strings.ToLower(c.LogLevel) {
+	case "trace", "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, "logLevel (LOG_LEVEL) must be one of trace, debug, info, warn or error")
+	}
+	if c.PollIntervalSeconds < 1 {
+		errs = append(errs, "pollIntervalSeconds (POLL_INTERVAL_SECONDS) must be a positive int")
+	}
+	if c.FullRunIntervalSeconds < 0 {
+		errs = append(errs, "fullRunIntervalSeconds (FULL_RUN_INTERVAL_SECONDS) must be a non-negative int")
+	}
+	if c.ShutdownTimeoutSeconds < 0 {
+		errs = append(errs, "shutdownTimeoutSeconds (SHUTDOWN_TIMEOUT_SECONDS) must be a non-negative int")
+	}
+
+	if c.Apply.Workers < 1 {
+		errs = append(errs, "apply.workers (APPLY_WORKERS) must be a positive int")
+	}
+	if c.Apply.TimeoutSeconds < 0 {
+		errs = append(errs, "apply.timeoutSeconds (APPLY_TIMEOUT_SECONDS) must be a non-negative int")
+	}
+	if c.Apply.Retries < 0 {
+		errs = append(errs, "apply.retries (APPLY_RETRIES) must be a non-negative int")
+	}
+	if c.Apply.RetryBackoffSeconds < 0 {
+		errs = append(errs, "apply.retryBackoffSeconds (APPLY_RETRY_BACKOFF_SECONDS) must be a non-negative int")
+	}
+	if c.History.Size < 1 {
+		errs = append(errs, "history.size (RUN_HISTORY_SIZE) must be a positive int")
+	}
+
+	if c.Git.RepoURL != "" {
+		if rel, err := filepath.Rel(c.Git.Dir, c.RepoPath); err != nil || strings.HasPrefix(rel, "..") {
+			errs = append(errs, "repoPath (REPO_PATH) must be git.dir (GIT_DIR_PATH) or a path within it")
+		}
+		if c.Git.SyncIntervalSeconds < 1 {
+			errs = append(errs, "git.syncIntervalSeconds (GIT_SYNC_INTERVAL_SECONDS) must be a positive int")
+		}
+	}
+	switch c.Git.VerifySignatures {
+	case "none", "head", "all":
+	default:
+		errs = append(errs, "git.verifySignatures (GIT_VERIFY_SIGNATURES) must be one of none, head or all")
+	}
+
+	for _, u := range c.Notify.SlackWebhookURLs {
+		if _, err := url.ParseRequestURI(u); err != nil {
+			errs = append(errs, fmt.Sprintf("notify.slackWebhookURLs (NOTIFY_SLACK_WEBHOOK_URLS) contains an invalid URL: %v", err))
+		}
+	}
+	for _, u := range c.Notify.WebhookURLs {
+		if _, err := url.ParseRequestURI(u); err != nil {
+			errs = append(errs, fmt.Sprintf("notify.webhookURLs (NOTIFY_WEBHOOK_URLS) contains an invalid URL: %v", err))
+		}
+	}
+
+	if c.Health.MaxMissedIntervals < 0 {
+		errs = append(errs, "health.maxMissedIntervals (HEALTH_MAX_MISSED_INTERVALS) must be a non-negative int")
+	}
+	if c.LeaderElection.Enabled && c.LeaderElection.LeaseName == "" {
+		errs = append(errs, "leaderElection.leaseName (LEADER_ELECTION_LEASE_NAME) is required with leader election")
+	}
+
+	if len(c.Clusters) > 0 && c.Server != "" {
+		errs = append(errs, "server (SERVER) cannot be used with clusters, set a kubeconfig for each cluster instead")
+	}
+	names := make(map[string]bool)
+	for i, cluster := range c.Clusters {
+		if len(cluster.Name) > 63 || !clusterNameRegex.MatchString(cluster.Name) {
+			errs = append(errs, fmt.Sprintf("clusters[%d].name must be a lowercase RFC 1123 label: %q", i, cluster.Name))
+		} else if names[cluster.Name] {
+			errs = append(errs, fmt.Sprintf("clusters[%d].name is not unique: %q", i, cluster.Name))
+		}
+		names[cluster.Name] = true
+		if cluster.RepoPath == "" || filepath.IsAbs(cluster.RepoPath) || strings.HasPrefix(filepath.Clean(cluster.RepoPath), "..") {
+			errs = append(errs, fmt.Sprintf("clusters[%d].repoPath must be a path within repoPath: %q", i, cluster.RepoPath))
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Redacted returns a copy of the Config with the secrets replaced, to be shown
+// to users. Webhook URLs only keep their host, as their path usually carries a
+// token.
+func (c *Config) Redacted() *Config {
+	r := *c
+	r.Webhook.Secret = redact(c.Webhook.Secret)
+	r.Git.HTTPSPassword = redact(c.Git.HTTPSPassword)
+	r.Git.RepoURL = redactPassword(c.Git.RepoURL)
+	r.Notify.SlackWebhookURLs = redactWebhookURLs(c.Notify.SlackWebhookURLs)
+	r.Notify.WebhookURLs = redactWebhookURLs(c.Notify.WebhookURLs)
+	return &r
+}
+
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redacted
+}
+
+// redactPassword replaces the password in the user info of a URL.
+func redactPassword(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil || parsed.User == nil {
+		return u
+	}
+	if _, ok := parsed.User.Password(); !ok {
+		return u
+	}
+	parsed.User = url.UserPassword(parsed.User.Username(), redacted)
+	return strings.Replace(parsed.String(), url.QueryEscape(redacted), redacted, 1)
+}
+
+func redactWebhookURLs(urls []string) []string {
+	var r []string
+	for _, u := range urls {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			r = append(r, redacted)
+			continue
+		}
+		r = append(r, fmt.Sprintf("%s://%s/%s", parsed.Scheme, parsed.Host, redacted))
+	}
+	return r
+}
+
+// setting binds a Config field to its environment variable and the key of the
+// configuration file. The flag is named after the environment variable, in
+// lower case with dashes, eg. -apply-workers for APPLY_WORKERS.
+type setting struct {
+	env    string
+	key    string
+	usage  string
+	set    func(string) error
+	isBool bool
+}
+
+func (s setting) flag() string {
+	return strings.Replace(strings.ToLower(s.env), "_", "-", -1)
+}
+
+func settings(c *Config) []setting {
+	return []setting{
+		{"REPO_PATH", "repoPath", "Path to the directory containing the namespace directories", stringVar(&c.RepoPath), false},
+		{"REPO_PATH_FILTERS", "repoPathFilters", "Comma separated list of namespace directories to apply", listVar(&c.RepoPathFilters), false},
+		{"LISTEN_PORT", "listenPort", "Port of the webserver", intVar(&c.ListenPort), false},
+		{"SERVER", "server", "Address of the Kubernetes API server", stringVar(&c.Server), false},
+		{"DIFF_URL_FORMAT", "diffURLFormat", "URL of a commit, with %s in place of the hash", stringVar(&c.DiffURLFormat), false},
+		{"LOG_LEVEL", "logLevel", "One of trace, debug, info, warn or error", stringVar(&c.LogLevel), false},
+		{"POLL_INTERVAL_SECONDS", "pollIntervalSeconds", "Seconds between checks for new commits", intVar(&c.PollIntervalSeconds), false},
+		{"FULL_RUN_INTERVAL_SECONDS", "fullRunIntervalSeconds", "Seconds between full runs, 0 disables them", intVar(&c.FullRunIntervalSeconds), false},
+		{"SHUTDOWN_TIMEOUT_SECONDS", "shutdownTimeoutSeconds", "Seconds allowed for the applies in progress to complete on shutdown", intVar(&c.ShutdownTimeoutSeconds), false},
+		{"DRY_RUN", "apply.dryRun", "Apply with --dry-run", boolVar(&c.Apply.DryRun), true},
+		{"DIFF", "apply.diff", "Run kubectl diff before each apply", boolVar(&c.Apply.Diff), true},
+		{"SERVER_SIDE_APPLY", "apply.serverSide", "Use server-side apply", boolVar(&c.Apply.ServerSide), true},
+		{"FIELD_MANAGER", "apply.fieldManager", "Field manager of server-side applies", stringVar(&c.Apply.FieldManager), false},
+		{"FORCE_CONFLICTS", "apply.forceConflicts", "Take ownership of conflicting fields with server-side apply", boolVar(&c.Apply.ForceConflicts), true},
+		{"PRUNE_WHITELIST_FILE", "apply.pruneWhitelistFile", "Path to a YAML list of the object types that may be pruned", stringVar(&c.Apply.PruneWhitelistFile), false},
+		{"APPLY_WORKERS", "apply.workers", "Number of namespaces applied concurrently", intVar(&c.Apply.Workers), false},
+		{"APPLY_TIMEOUT_SECONDS", "apply.timeoutSeconds", "Seconds after which the apply of a namespace is killed, 0 disables the timeout", intVar(&c.Apply.TimeoutSeconds), false},
+		{"APPLY_RETRIES", "apply.retries", "Number of retries of applies that fail with transient errors", intVar(&c.Apply.Retries), false},
+		{"APPLY_RETRY_BACKOFF_SECONDS", "apply.retryBackoffSeconds", "Seconds before the first retry, doubled for each following retry", intVar(&c.Apply.RetryBackoffSeconds), false},
+		{"RUN_HISTORY_PATH", "history.path", "Directory where the run history is stored", stringVar(&c.History.Path), false},
+		{"RUN_HISTORY_SIZE", "history.size", "Number of runs kept in the run history", intVar(&c.History.Size), false},
+		{"GIT_REPO_URL", "git.repoURL", "URL of the repository, enables the built-in Git sync", stringVar(&c.Git.RepoURL), false},
+		{"GIT_BRANCH", "git.branch", "Branch synced and accepted by push webhooks", stringVar(&c.Git.Branch), false},
+		{"GIT_DIR_PATH", "git.dir", "Directory the repository is cloned into", stringVar(&c.Git.Dir), false},
+		{"GIT_SYNC_INTERVAL_SECONDS", "git.syncIntervalSeconds", "Seconds between Git syncs", intVar(&c.Git.SyncIntervalSeconds), false},
+		{"GIT_SSH_KEY_PATH", "git.sshKeyPath", "Path to the SSH key used by the Git sync", stringVar(&c.Git.SSHKeyPath), false},
+		{"GIT_KNOWN_HOSTS_PATH", "git.knownHostsPath", "Path to the known hosts file used by the Git sync", stringVar(&c.Git.KnownHostsPath), false},
+		{"GIT_HTTPS_USERNAME", "git.httpsUsername", "Username used by the Git sync over HTTPS", stringVar(&c.Git.HTTPSUsername), false},
+		{"GIT_HTTPS_PASSWORD", "git.httpsPassword", "Password or token used by the Git sync over HTTPS", stringVar(&c.Git.HTTPSPassword), false},
+		{"GIT_VERIFY_SIGNATURES", "git.verifySignatures", "Commits whose signature is verified, one of none, head or all", stringVar(&c.Git.VerifySignatures), false},
+		{"GIT_GPG_HOME", "git.gpgHome", "GnuPG home directory used to verify signatures", stringVar(&c.Git.GPGHome), false},
+		{"GIT_ALLOWED_SIGNERS_PATH", "git.allowedSignersPath", "Path to the allowed signers file used to verify SSH signatures", stringVar(&c.Git.AllowedSignersPath), false},
+		{"NOTIFY_SLACK_WEBHOOK_URLS", "notify.slackWebhookURLs", "Comma separated list of Slack webhook URLs", listVar(&c.Notify.SlackWebhookURLs), false},
+		{"NOTIFY_WEBHOOK_URLS", "notify.webhookURLs", "Comma separated list of JSON webhook URLs", listVar(&c.Notify.WebhookURLs), false},
+		{"WEBHOOK_SECRET", "webhook.secret", "Secret used to verify push webhooks", stringVar(&c.Webhook.Secret), false},
+		{"HEALTH_MAX_MISSED_INTERVALS", "health.maxMissedIntervals", "Missed run or sync intervals after which the health checks fail, 0 disables them", intVar(&c.Health.MaxMissedIntervals), false},
+		{"LEADER_ELECTION", "leaderElection.enabled", "Only apply from the leader of the replicas", boolVar(&c.LeaderElection.Enabled), true},
+		{"LEADER_ELECTION_NAMESPACE", "leaderElection.namespace", "Namespace of the leader election Lease", stringVar(&c.LeaderElection.Namespace), false},
+		{"LEADER_ELECTION_LEASE_NAME", "leaderElection.leaseName", "Name of the leader election Lease", stringVar(&c.LeaderElection.LeaseName), false},
+	}
+}
+
+func stringVar(p *string) func(string) error {
+	return func(v string) error {
+		*p = v
+		return nil
+	}
+}
+
+func intVar(p *int) func(string) error {
+	return func(v string) error {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%q is not an int", v)
+		}
+		*p = i
+		return nil
+	}
+}
+
+func boolVar(p *bool) func(string) error {
+	return func(v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%q is not a bool", v)
+		}
+		*p = b
+		return nil
+	}
+}
+
+// listVar splits a comma separated list, ignoring empty items.
+func listVar(p *[]string) func(string) error {
+	return func(v string) error {
+		var items []string
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		*p = items
+		return nil
+	}
+}
+
+// flagValue records the raw value of a flag, so that flags can be applied
+// after the configuration file and the environment.
+type flagValue struct {
+	value  string
+	set    bool
+	isBool bool
+}
+
+func (f *flagValue) String() string {
+	return f.value
+}
+
+func (f *flagValue) Set(v string) error {
+	f.value = v
+	f.set = true
+	return nil
+}
+
+// IsBoolFlag allows boolean flags to be set without a value, eg. -dry-run.
+func (f *flagValue) IsBoolFlag() bool {
+	return f.isBool
+}
@@ -0,0 +1,205 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/utilitywarehouse/kube-applier/log"
+)
+
+// Change describes a setting that differs between two Configs, identified by
+// its configuration file key. Secrets are redacted in Old and New.
+type Change struct {
+	Key string
+	Old interface{}
+	New interface{}
+}
+
+// Watcher holds the current Config. When it was loaded from a file, the file
+// is read every Interval and the Config is reloaded when its content changes,
+// eg. after an update of a mounted ConfigMap. Environment variables and the
+// command line arguments Args keep overriding the file.
+// OnChange is called with the previous and the new Config after each reload.
+// A Config that fails to load is logged and the current one is kept.
+// If Reloadable is set, only the settings it lists, by configuration file key,
+// take effect on reload and the others keep their initial value in the Config
+// returned by Current, until a restart.
+type Watcher struct {
+	Args       []string
+	Interval   time.Duration
+	OnChange   func(old, new *Config)
+	Reloadable map[string]bool
+	mutex      sync.Mutex
+	config     *Config
+	content    []byte
+}
+
+// Load loads the initial Config.
+func (w *Watcher) Load() error {
+	return w.load(os.LookupEnv)
+}
+
+func (w *Watcher) load(lookupEnv func(string) (string, bool)) error {
+	c, err := load(w.Args, lookupEnv)
+	if err != nil {
+		return err
+	}
+	var content []byte
+	if c.File() != "" {
+		content, err = ioutil.ReadFile(c.File())
+		if err != nil {
+			return fmt.Errorf("reading config file failed: %v", err)
+		}
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.config = c
+	w.content = content
+	return nil
+}
+
+// Current returns the Config currently in effect.
+func (w *Watcher) Current() *Config {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.config
+}
+
+// Start runs a continuous loop that checks the configuration file for changes
+// every Interval, until ctx is cancelled. It returns straight away if there is
+// no configuration file.
+func (w *Watcher) Start(ctx context.Context) {
+	if w.Current().File() == "" {
+		return
+	}
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.reload(os.LookupEnv)
+		}
+	}
+}
+
+// reload loads the Config again if the content of the file changed.
+func (w *Watcher) reload(lookupEnv func(string) (string, bool)) {
+	old := w.Current()
+	content, err := ioutil.ReadFile(old.File())
+	if err != nil {
+		log.Logger.Warn("Could not read config file, keeping the current configuration", "file", old.File(), "error", err)
+		return
+	}
+	w.mutex.Lock()
+	changed := !bytes.Equal(content, w.content)
+	w.content = content
+	w.mutex.Unlock()
+	if !changed {
+		return
+	}
+
+	log.Logger.Info("Config file changed, reloading", "file", old.File())
+	c, err := load(w.Args, lookupEnv)
+	if err != nil {
+		log.Logger.Error("Could not reload the configuration, keeping the current one", "error", err)
+		return
+	}
+	w.mutex.Lock()
+	w.config = w.effective(old, c)
+	w.mutex.Unlock()
+	if w.OnChange != nil {
+		w.OnChange(old, c)
+	}
+}
+
+// effective returns new with the settings that are not Reloadable set to their
+// value in old.
+func (w *Watcher) effective(old, new *Config) *Config {
+	if w.Reloadable == nil {
+		return new
+	}
+	o, n := fileSettings(old), fileSettings(new)
+	for key := range w.Reloadable {
+		path := strings.Split(key, ".")
+		src, dst := n, o
+		for _, k := range path[:len(path)-1] {
+			src, _ = src[k].(map[string]interface{})
+			sub, ok := dst[k].(map[string]interface{})
+			if !ok {
+				sub = make(map[string]interface{})
+				dst[k] = sub
+			}
+			dst = sub
+		}
+		k := path[len(path)-1]
+		if v, ok := src[k]; ok {
+			dst[k] = v
+		} else {
+			delete(dst, k)
+		}
+	}
+	data, _ := json.Marshal(o)
+	c := &Config{file: new.file}
+	json.Unmarshal(data, c)
+	return c
+}
+
+// Changes lists the settings that differ between old and new, sorted by key.
+// The settings are compared as is, so that a rotated secret is reported, but
+// the values of the changes are redacted, see Config.Redacted.
+func Changes(old, new *Config) []Change {
+	o, n := flatten(old), flatten(new)
+	ro, rn := flatten(old.Redacted()), flatten(new.Redacted())
+	var changes []Change
+	for k, v := range o {
+		if !reflect.DeepEqual(v, n[k]) {
+			changes = append(changes, Change{k, ro[k], rn[k]})
+		}
+	}
+	for k := range n {
+		if _, ok := o[k]; !ok {
+			changes = append(changes, Change{k, nil, rn[k]})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes
+}
+
+// flatten returns the settings of a Config keyed by their configuration file
+// key, eg. apply.workers.
+func flatten(c *Config) map[string]interface{} {
+	m := fileSettings(c)
+	flat := make(map[string]interface{})
+	var walk func(prefix string, m map[string]interface{})
+	walk = func(prefix string, m map[string]interface{}) {
+		for k, v := range m {
+			if sub, ok := v.(map[string]interface{}); ok {
+				walk(prefix+k+".", sub)
+			} else {
+				flat[prefix+k] = v
+			}
+		}
+	}
+	walk("", m)
+	return flat
+}
+
+// fileSettings returns the settings of a Config as they are set in the
+// configuration file.
+func fileSettings(c *Config) map[string]interface{} {
+	data, _ := json.Marshal(c)
+	var m map[string]interface{}
+	json.Unmarshal(data, &m)
+	return m
+}
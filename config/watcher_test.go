@@ -0,0 +1,82 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/utilitywarehouse/kube-applier/log"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatcherReload(t *testing.T) {
+	log.InitLogger("info")
+	assert := assert.New(t)
+	path := writeConfigFile(t, "repoPath: /src\npollIntervalSeconds: 10\n")
+	defer os.RemoveAll(filepath.Dir(path))
+	lookupEnv := env(map[string]string{"APPLY_WORKERS": "2"})
+
+	var changes []Change
+	w := &Watcher{
+		Args: []string{"-config", path},
+		OnChange: func(old, new *Config) {
+			changes = append(changes, Changes(old, new)...)
+		},
+		Reloadable: map[string]bool{"pollIntervalSeconds": true, "apply.workers": true},
+	}
+	assert.NoError(w.load(lookupEnv))
+	assert.Equal(10, w.Current().PollIntervalSeconds)
+
+	// Unchanged file
+	w.reload(lookupEnv)
+	assert.Empty(changes)
+
+	// The environment still overrides the file
+	assert.NoError(ioutil.WriteFile(path, []byte("repoPath: /src\npollIntervalSeconds: 20\napply:\n  dryRun: true\n  workers: 3\n"), 0644))
+	w.reload(lookupEnv)
+	assert.Equal([]Change{
+		{"apply.dryRun", false, true},
+		{"pollIntervalSeconds", float64(10), float64(20)},
+	}, changes)
+	assert.Equal(20, w.Current().PollIntervalSeconds)
+	assert.Equal(2, w.Current().Apply.Workers)
+	// Settings that are not reloadable keep their initial value until a restart
+	assert.False(w.Current().Apply.DryRun)
+	assert.Equal(path, w.Current().File())
+
+	// and are reported again by the next reload
+	changes = nil
+	assert.NoError(ioutil.WriteFile(path, []byte("repoPath: /src\npollIntervalSeconds: 30\napply:\n  dryRun: true\n"), 0644))
+	w.reload(lookupEnv)
+	assert.Equal([]Change{
+		{"apply.dryRun", false, true},
+		{"pollIntervalSeconds", float64(20), float64(30)},
+	}, changes)
+	assert.Equal(30, w.Current().PollIntervalSeconds)
+	assert.False(w.Current().Apply.DryRun)
+
+	// Invalid configurations are ignored
+	changes = nil
+	assert.NoError(ioutil.WriteFile(path, []byte("repoPath: /src\npollIntervalSeconds: 0\n"), 0644))
+	w.reload(lookupEnv)
+	assert.Empty(changes)
+	assert.Equal(30, w.Current().PollIntervalSeconds)
+}
+
+func TestChanges(t *testing.T) {
+	old := Default()
+	old.Webhook.Secret = "old"
+	new := Default()
+	new.Webhook.Secret = "new"
+	new.RepoPathFilters = []string{"a"}
+	new.Git.RepoURL = "https://github.com/org/manifests.git"
+
+	// Rotated secrets are reported, with their values redacted
+	assert.Equal(t, []Change{
+		{"git.repoURL", nil, "https://github.com/org/manifests.git"},
+		{"repoPathFilters", nil, []interface{}{"a"}},
+		{"webhook.secret", redacted, redacted},
+	}, Changes(old, new))
+}
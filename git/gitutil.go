@@ -2,28 +2,61 @@ package git
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
 	"strings"
+
+	"github.com/utilitywarehouse/kube-applier/log"
 )
 
+// Matches full and abbreviated commit hashes
+var commitRegex = regexp.MustCompile(`^[0-9a-f]{4,40}$`)
+
 // UtilInterface allows for mocking out the functionality of GitUtil when
 // testing the full process of an apply run.
 type UtilInterface interface {
 	HeadCommitLogForPaths(args ...string) (string, error)
 	HeadHashForPaths(args ...string) (string, error)
+	CommitLogForPaths(commit string, args ...string) (string, error)
+	ChangedFilesForPaths(since string, args ...string) ([]string, error)
+	VerifyCommits(since, until string) error
+	AddWorktree(commit string) (Worktree, error)
+	RemoveWorktree(w Worktree) error
+}
+
+// Worktree is a temporary checkout of a single commit of the repository, in
+// Dir. RepoPath is the path matching Util.RepoPath within it, and Commit the
+// full hash of the commit.
+type Worktree struct {
+	Dir      string
+	RepoPath string
+	Commit   string
 }
 
 // Util allows for fetching information about a Git repository using Git CLI
 // commands.
+// GPGHome is the GnuPG home directory holding the keyring used to verify GPG
+// signatures and AllowedSignersPath the allowed signers file used to verify
+// SSH signatures. The defaults of git and gpg are used when they are empty.
+// Paths are the paths, relative to RepoPath, the commands filtered by
+// directories consider when no directories are given, eg. "." for a RepoPath
+// within a repository shared with other clusters. The whole repository is
+// considered when they are empty.
 type Util struct {
-	RepoPath string
+	RepoPath           string
+	GPGHome            string
+	AllowedSignersPath string
+	Paths              []string
 }
 
 // HeadHashForPaths returns the hash of the current HEAD commit for the
 // filtered directories
 func (g *Util) HeadHashForPaths(args ...string) (string, error) {
 	cmd := []string{"log", "--pretty=format:'%h'", "-n", "1", "--"}
-	cmd = append(cmd, args...)
+	cmd = append(cmd, g.pathspec(args)...)
 	hash, err := runGitCmd(g.RepoPath, cmd...)
 	return strings.Trim(hash, "'\n"), err
 }
@@ -31,16 +64,145 @@ func (g *Util) HeadHashForPaths(args ...string) (string, error) {
 // HeadCommitLog returns the log of the current HEAD commit, including a list
 // of the files that were modified for the filtered directories
 func (g *Util) HeadCommitLogForPaths(args ...string) (string, error) {
-	cmd := []string{"log", "-1", "--name-status", "--"}
-	cmd = append(cmd, args...)
+	return g.CommitLogForPaths("HEAD", args...)
+}
+
+// CommitLogForPaths returns the log of the given commit, including a list of
+// the files that were modified for the filtered directories
+func (g *Util) CommitLogForPaths(commit string, args ...string) (string, error) {
+	cmd := []string{"log", "-1", "--name-status", commit, "--"}
+	cmd = append(cmd, g.pathspec(args)...)
 	log, err := runGitCmd(g.RepoPath, cmd...)
 	return log, err
 }
 
+// ChangedFilesForPaths returns the files that changed between the given commit
+// and HEAD for the filtered directories. Paths are relative to RepoPath and
+// renames are reported as a deletion and an addition, so that both the old
+// and the new location are included.
+func (g *Util) ChangedFilesForPaths(since string, args ...string) ([]string, error) {
+	cmd := []string{"diff", "--name-only", "--relative", "--no-renames", since, "HEAD", "--"}
+	cmd = append(cmd, g.pathspec(args)...)
+	out, err := runGitCmd(g.RepoPath, cmd...)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, f := range strings.Split(out, "\n") {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+// VerifyCommits checks that the commits between since and until, or only
+// until if since is empty, all carry a valid GPG or SSH signature from a key
+// in the configured keyring or allowed signers file. Only until is verified if
+// since is not one of its ancestors, eg. after a force push.
+func (g *Util) VerifyCommits(since, until string) error {
+	commits := []string{until}
+	if since != "" {
+		if _, err := runGitCmd(g.RepoPath, "merge-base", "--is-ancestor", since, until); err != nil {
+			log.Logger.Warn("Commit is not an ancestor, only verifying the last commit", "commit", since, "until", until)
+			since = ""
+		}
+	}
+	if since != "" {
+		out, err := runGitCmd(g.RepoPath, "rev-list", since+".."+until)
+		if err != nil {
+			return err
+		}
+		commits = strings.Fields(out)
+	}
+
+	var env []string
+	if g.GPGHome != "" {
+		env = append(env, "GNUPGHOME="+g.GPGHome)
+	}
+	args := []string{}
+	if g.AllowedSignersPath != "" {
+		args = append(args, "-c", "gpg.ssh.allowedSignersFile="+g.AllowedSignersPath)
+	}
+	for _, c := range commits {
+		if _, err := runGitCmdWithEnv(g.RepoPath, env, append(args, "verify-commit", c)...); err != nil {
+			return fmt.Errorf("signature verification failed for commit %s: %v", c, err)
+		}
+	}
+	return nil
+}
+
+// AddWorktree checks out the given commit, which must be a commit hash, in a
+// new worktree in a temporary directory. The worktree must be removed with
+// RemoveWorktree once it is not needed anymore.
+func (g *Util) AddWorktree(commit string) (Worktree, error) {
+	if !commitRegex.MatchString(commit) {
+		return Worktree{}, fmt.Errorf("invalid commit hash %q", commit)
+	}
+	hash, err := runGitCmd(g.RepoPath, "rev-parse", "--verify", "--quiet", commit+"^{commit}")
+	if err != nil {
+		return Worktree{}, fmt.Errorf("commit %s not found", commit)
+	}
+	hash = strings.TrimSpace(hash)
+	prefix, err := runGitCmd(g.RepoPath, "rev-parse", "--show-prefix")
+	if err != nil {
+		return Worktree{}, err
+	}
+
+	dir, err := ioutil.TempDir("", "kube-applier-worktree")
+	if err != nil {
+		return Worktree{}, fmt.Errorf("creating worktree directory failed: %v", err)
+	}
+	if _, err := runGitCmd(g.RepoPath, "worktree", "add", "--detach", dir, hash); err != nil {
+		os.RemoveAll(dir)
+		return Worktree{}, err
+	}
+	return Worktree{
+		Dir:      dir,
+		RepoPath: filepath.Join(dir, strings.TrimSpace(prefix)),
+		Commit:   hash,
+	}, nil
+}
+
+// RemoveWorktree deletes a worktree created by AddWorktree. If git fails to
+// remove it, its directory is deleted anyway and the worktree pruned.
+func (g *Util) RemoveWorktree(w Worktree) error {
+	_, err := runGitCmd(g.RepoPath, "worktree", "remove", "--force", w.Dir)
+	if err != nil {
+		os.RemoveAll(w.Dir)
+		g.PruneWorktrees()
+	}
+	return err
+}
+
+// PruneWorktrees removes the worktrees whose directory no longer exists, eg.
+// the ones left behind by a previous kube-applier process.
+func (g *Util) PruneWorktrees() error {
+	_, err := runGitCmd(g.RepoPath, "worktree", "prune")
+	return err
+}
+
+// pathspec returns the filtered directories or, without filters, Paths.
+func (g *Util) pathspec(args []string) []string {
+	if len(args) == 0 {
+		return g.Paths
+	}
+	return args
+}
+
 func runGitCmd(dir string, args ...string) (string, error) {
+	return runGitCmdWithEnv(dir, nil, args...)
+}
+
+// runGitCmdWithEnv runs a git command with the given variables added to the
+// environment.
+func runGitCmdWithEnv(dir string, env []string, args ...string) (string, error) {
 	var cmd *exec.Cmd
 	cmd = exec.Command("git", args...)
 	cmd.Dir = dir
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return "", fmt.Errorf("Error running command %v: %v: %s", strings.Join(cmd.Args, " "), err, output)
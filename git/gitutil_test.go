@@ -0,0 +1,220 @@
+package git
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/utilitywarehouse/kube-applier/log"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUtilVerifyCommits(t *testing.T) {
+	if _, err := exec.LookPath("ssh-keygen"); err != nil {
+		t.Skip("ssh-keygen is not available")
+	}
+	log.InitLogger("info")
+	assert := assert.New(t)
+
+	tmp, err := ioutil.TempDir("", "kube-applier-verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	key := filepath.Join(tmp, "key")
+	if out, err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-C", "test", "-f", key).CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	pub, err := ioutil.ReadFile(key + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowedSigners := filepath.Join(tmp, "allowed_signers")
+	if err := ioutil.WriteFile(allowedSigners, append([]byte("test@example.com "), pub...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := filepath.Join(tmp, "repo")
+	commit := func(file string, sign bool) string {
+		if err := ioutil.WriteFile(filepath.Join(repo, file), []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+		args := []string{"-c", "user.name=test", "-c", "user.email=test@example.com", "-c", "gpg.format=ssh", "-c", "user.signingkey=" + key, "commit", "-q", "-m", file}
+		if sign {
+			args = append(args, "-S")
+		}
+		for _, a := range [][]string{{"add", "-A"}, args} {
+			if _, err := runGitCmd(repo, a...); err != nil {
+				t.Fatal(err)
+			}
+		}
+		hash, err := runGitCmd(repo, "rev-parse", "HEAD")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash[:len(hash)-1]
+	}
+	if err := exec.Command("git", "init", "-q", repo).Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	g := &Util{RepoPath: repo, AllowedSignersPath: allowedSigners}
+
+	first := commit("a", true)
+	assert.Nil(g.VerifyCommits("", "HEAD"))
+
+	second := commit("b", false)
+	commit("c", true)
+	// HEAD is signed, but one of the commits since the first one is not
+	assert.Nil(g.VerifyCommits("", "HEAD"))
+	err = g.VerifyCommits(first, "HEAD")
+	assert.NotNil(err)
+	assert.Contains(err.Error(), second)
+	assert.Nil(g.VerifyCommits(second, "HEAD"))
+	assert.NotNil(g.VerifyCommits("", second))
+
+	// Only HEAD is verified when the commit since is not one of its ancestors,
+	// eg. after a force push removed it
+	_, err = runGitCmd(repo, "reset", "-q", "--hard", first)
+	assert.Nil(err)
+	commit("d", true)
+	assert.Nil(g.VerifyCommits(second, "HEAD"))
+	assert.Nil(g.VerifyCommits("0000000000000000000000000000000000000000", "HEAD"))
+	commit("e", false)
+	assert.NotNil(g.VerifyCommits(second, "HEAD"))
+}
+
+func TestUtilWorktree(t *testing.T) {
+	assert := assert.New(t)
+
+	tmp, err := ioutil.TempDir("", "kube-applier-worktree-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	repo := filepath.Join(tmp, "repo")
+	if err := os.MkdirAll(filepath.Join(repo, "manifests"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Command("git", "init", "-q", repo).Run(); err != nil {
+		t.Fatal(err)
+	}
+	var hashes []string
+	for _, content := range []string{"first", "second"} {
+		if err := ioutil.WriteFile(filepath.Join(repo, "manifests", "file"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		for _, a := range [][]string{{"add", "-A"}, {"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", content}} {
+			if _, err := runGitCmd(repo, a...); err != nil {
+				t.Fatal(err)
+			}
+		}
+		hash, _ := runGitCmd(repo, "rev-parse", "HEAD")
+		hashes = append(hashes, hash[:len(hash)-1])
+	}
+
+	g := &Util{RepoPath: filepath.Join(repo, "manifests")}
+
+	wt, err := g.AddWorktree(hashes[0][:7])
+	assert.Nil(err)
+	assert.Equal(hashes[0], wt.Commit)
+	assert.Equal(filepath.Join(wt.Dir, "manifests"), wt.RepoPath)
+	content, _ := ioutil.ReadFile(filepath.Join(wt.RepoPath, "file"))
+	assert.Equal("first", string(content))
+
+	assert.Nil(g.RemoveWorktree(wt))
+	_, err = os.Stat(wt.Dir)
+	assert.True(os.IsNotExist(err))
+
+	// Worktrees whose directory was deleted without git are pruned
+	wt, err = g.AddWorktree(hashes[1])
+	assert.Nil(err)
+	assert.Nil(os.RemoveAll(wt.Dir))
+	assert.Nil(g.PruneWorktrees())
+	worktrees, _ := runGitCmd(repo, "worktree", "list")
+	assert.NotContains(worktrees, wt.Dir)
+
+	_, err = g.AddWorktree("--help")
+	assert.NotNil(err)
+	_, err = g.AddWorktree("0000000")
+	assert.NotNil(err)
+}
+
+func TestUtilChangedFilesForPaths(t *testing.T) {
+	assert := assert.New(t)
+
+	tmp, err := ioutil.TempDir("", "kube-applier-changed-files-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	repo := filepath.Join(tmp, "repo")
+	if err := exec.Command("git", "init", "-q", repo).Run(); err != nil {
+		t.Fatal(err)
+	}
+	commit := func(files map[string]string, removed ...string) string {
+		for name, content := range files {
+			path := filepath.Join(repo, name)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, name := range removed {
+			if err := os.Remove(filepath.Join(repo, name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, a := range [][]string{{"add", "-A"}, {"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "commit"}} {
+			if _, err := runGitCmd(repo, a...); err != nil {
+				t.Fatal(err)
+			}
+		}
+		hash, _ := runGitCmd(repo, "rev-parse", "HEAD")
+		return hash[:len(hash)-1]
+	}
+
+	first := commit(map[string]string{
+		"manifests/ns-a/deployment.yaml": "a",
+		"manifests/ns-b/service.yaml":    "b",
+		"other/file":                     "other",
+	})
+	commit(map[string]string{
+		"manifests/ns-a/deployment.yaml": "changed",
+		"manifests/ns-c/new.yaml":        "renamed",
+		"other/file":                     "changed",
+	}, "manifests/ns-b/service.yaml")
+
+	g := &Util{RepoPath: filepath.Join(repo, "manifests")}
+
+	// Only the changes within RepoPath are reported, relative to it, and
+	// renames are reported as a deletion and an addition
+	files, err := g.ChangedFilesForPaths(first)
+	assert.Nil(err)
+	assert.Equal([]string{"ns-a/deployment.yaml", "ns-b/service.yaml", "ns-c/new.yaml"}, files)
+
+	files, err = g.ChangedFilesForPaths(first, "ns-a")
+	assert.Nil(err)
+	assert.Equal([]string{"ns-a/deployment.yaml"}, files)
+
+	// The same changes are reported with Paths set to RepoPath itself
+	g.Paths = []string{"."}
+	files, err = g.ChangedFilesForPaths(first)
+	assert.Nil(err)
+	assert.Equal([]string{"ns-a/deployment.yaml", "ns-b/service.yaml", "ns-c/new.yaml"}, files)
+
+	files, err = g.ChangedFilesForPaths("HEAD")
+	assert.Nil(err)
+	assert.Empty(files)
+
+	_, err = g.ChangedFilesForPaths("0000000000000000000000000000000000000000")
+	assert.NotNil(err)
+}
@@ -65,3 +65,76 @@ func (m *MockUtilInterface) HeadHashForPaths(args ...string) (string, error) {
 func (mr *MockUtilInterfaceMockRecorder) HeadHashForPaths(args ...interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "HeadHashForPaths", reflect.TypeOf((*MockUtilInterface)(nil).HeadHashForPaths), args...)
 }
+
+// ChangedFilesForPaths mocks base method
+func (m *MockUtilInterface) ChangedFilesForPaths(since string, args ...string) ([]string, error) {
+	varargs := []interface{}{since}
+	for _, a := range args {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "ChangedFilesForPaths", varargs...)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ChangedFilesForPaths indicates an expected call of ChangedFilesForPaths
+func (mr *MockUtilInterfaceMockRecorder) ChangedFilesForPaths(since interface{}, args ...interface{}) *gomock.Call {
+	varargs := append([]interface{}{since}, args...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ChangedFilesForPaths", reflect.TypeOf((*MockUtilInterface)(nil).ChangedFilesForPaths), varargs...)
+}
+
+// CommitLogForPaths mocks base method
+func (m *MockUtilInterface) CommitLogForPaths(commit string, args ...string) (string, error) {
+	varargs := []interface{}{commit}
+	for _, a := range args {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "CommitLogForPaths", varargs...)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CommitLogForPaths indicates an expected call of CommitLogForPaths
+func (mr *MockUtilInterfaceMockRecorder) CommitLogForPaths(commit interface{}, args ...interface{}) *gomock.Call {
+	varargs := append([]interface{}{commit}, args...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CommitLogForPaths", reflect.TypeOf((*MockUtilInterface)(nil).CommitLogForPaths), varargs...)
+}
+
+// VerifyCommits mocks base method
+func (m *MockUtilInterface) VerifyCommits(since, until string) error {
+	ret := m.ctrl.Call(m, "VerifyCommits", since, until)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// VerifyCommits indicates an expected call of VerifyCommits
+func (mr *MockUtilInterfaceMockRecorder) VerifyCommits(since, until interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "VerifyCommits", reflect.TypeOf((*MockUtilInterface)(nil).VerifyCommits), since, until)
+}
+
+// AddWorktree mocks base method
+func (m *MockUtilInterface) AddWorktree(commit string) (Worktree, error) {
+	ret := m.ctrl.Call(m, "AddWorktree", commit)
+	ret0, _ := ret[0].(Worktree)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// AddWorktree indicates an expected call of AddWorktree
+func (mr *MockUtilInterfaceMockRecorder) AddWorktree(commit interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AddWorktree", reflect.TypeOf((*MockUtilInterface)(nil).AddWorktree), commit)
+}
+
+// RemoveWorktree mocks base method
+func (m *MockUtilInterface) RemoveWorktree(w Worktree) error {
+	ret := m.ctrl.Call(m, "RemoveWorktree", w)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RemoveWorktree indicates an expected call of RemoveWorktree
+func (mr *MockUtilInterfaceMockRecorder) RemoveWorktree(w interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RemoveWorktree", reflect.TypeOf((*MockUtilInterface)(nil).RemoveWorktree), w)
+}
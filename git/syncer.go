@@ -0,0 +1,233 @@
+package git
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/utilitywarehouse/kube-applier/log"
+)
+
+// Script used as GIT_ASKPASS for HTTPS authentication, so that credentials are
+// passed to git through the environment rather than in the remote URL.
+const askPassScript = `#!/bin/sh
+case "$1" in
+Username*) echo "$KUBE_APPLIER_GIT_USERNAME" ;;
+*) echo "$KUBE_APPLIER_GIT_PASSWORD" ;;
+esac
+`
+
+// SyncStatus describes the outcome of the most recent syncs of a Syncer.
+type SyncStatus struct {
+	LastAttempt time.Time `json:"lastAttempt"`
+	LastSuccess time.Time `json:"lastSuccess"`
+	Commit      string    `json:"commit"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// Syncer keeps a clone of a remote repository in Dir up to date with Branch,
+// fetching it every Interval with the git CLI, as an alternative to a git-sync
+// sidecar. Util is embedded so that a Syncer can be used as a UtilInterface,
+// its RepoPath must be Dir or a path within it.
+//
+// SSHKeyPath and KnownHostsPath are used for SSH remotes, Username and
+// Password for HTTPS remotes.
+//
+// The working tree is only updated while no lock from ReadLocker is held, so
+// that a run holding one reads the files of a single commit.
+type Syncer struct {
+	Util
+	RepoURL        string
+	Branch         string
+	Dir            string
+	Interval       time.Duration
+	SSHKeyPath     string
+	KnownHostsPath string
+	Username       string
+	Password       string
+	syncMutex      sync.Mutex
+	treeMutex      sync.RWMutex
+	statusMutex    sync.Mutex
+	status         SyncStatus
+	askPassPath    string
+	triggerOnce    sync.Once
+	trigger        chan struct{}
+}
+
+// Start runs a continuous loop that syncs the repository every Interval, and
+// straight away after a call to Trigger, until ctx is cancelled. Failed syncs
+// are logged and reported by Status, the next sync is attempted on schedule
+// regardless.
+func (s *Syncer) Start(ctx context.Context) {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.triggerChan():
+		}
+		if err := s.Sync(); err != nil {
+			log.Logger.Warn("Git sync failed", "error", err)
+		}
+	}
+}
+
+// Trigger requests a sync from Start without waiting for it, eg. after a push
+// webhook. Triggers received while a sync is pending are merged.
+func (s *Syncer) Trigger() {
+	select {
+	case s.triggerChan() <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Syncer) triggerChan() chan struct{} {
+	s.triggerOnce.Do(func() {
+		s.trigger = make(chan struct{}, 1)
+	})
+	return s.trigger
+}
+
+// Sync clones the repository into Dir if it is not there yet, otherwise it
+// fetches Branch and resets Dir to it, discarding any local changes.
+func (s *Syncer) Sync() error {
+	s.syncMutex.Lock()
+	defer s.syncMutex.Unlock()
+
+	attempt := time.Now()
+	commit, err := s.sync()
+
+	s.statusMutex.Lock()
+	defer s.statusMutex.Unlock()
+	s.status.LastAttempt = attempt
+	if err != nil {
+		s.status.Error = err.Error()
+		return err
+	}
+	s.status.LastSuccess = attempt
+	s.status.Commit = commit
+	s.status.Error = ""
+	return nil
+}
+
+// ReadLocker returns a Locker that prevents the working tree from being
+// updated while it is held. New commits are still fetched in the meantime.
+func (s *Syncer) ReadLocker() sync.Locker {
+	return s.treeMutex.RLocker()
+}
+
+// Status returns the outcome of the most recent syncs.
+func (s *Syncer) Status() SyncStatus {
+	s.statusMutex.Lock()
+	defer s.statusMutex.Unlock()
+	return s.status
+}
+
+func (s *Syncer) sync() (string, error) {
+	if _, err := os.Stat(filepath.Join(s.Dir, ".git")); os.IsNotExist(err) {
+		log.Logger.Info("Cloning repository", "branch", s.Branch, "dir", s.Dir)
+		if _, err := s.git("", "clone", "--single-branch", "--branch", s.Branch, "--", s.RepoURL, s.Dir); err != nil {
+			return "", err
+		}
+	} else {
+		if _, err := s.git(s.Dir, "fetch", "--prune", "origin", s.Branch); err != nil {
+			return "", err
+		}
+		s.treeMutex.Lock()
+		defer s.treeMutex.Unlock()
+		if _, err := s.git(s.Dir, "reset", "--hard", "FETCH_HEAD"); err != nil {
+			return "", err
+		}
+		if _, err := s.git(s.Dir, "clean", "-ffdx"); err != nil {
+			return "", err
+		}
+	}
+	commit, err := s.git(s.Dir, "rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(commit), nil
+}
+
+// git runs a git command in dir, with the environment needed to authenticate
+// with the remote. Credentials in RepoURL are removed from the error returned.
+func (s *Syncer) git(dir string, args ...string) (string, error) {
+	env, err := s.env()
+	if err != nil {
+		return "", err
+	}
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = env
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		command, out := strings.Join(cmd.Args, " "), string(output)
+		if s.RepoURL != "" {
+			repoURL := redactURL(s.RepoURL)
+			command = strings.ReplaceAll(command, s.RepoURL, repoURL)
+			out = strings.ReplaceAll(out, s.RepoURL, repoURL)
+		}
+		return "", fmt.Errorf("Error running command %v: %v: %s", command, err, out)
+	}
+	return string(output), nil
+}
+
+// redactURL returns rawURL without the user info, which may hold credentials,
+// or rawURL if it has none or is not a URL, eg. an scp-like SSH address.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	u.User = nil
+	return u.String()
+}
+
+func (s *Syncer) env() ([]string, error) {
+	env := append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if s.SSHKeyPath != "" || s.KnownHostsPath != "" {
+		sshCmd := "ssh"
+		if s.SSHKeyPath != "" {
+			sshCmd += fmt.Sprintf(" -i %s -o IdentitiesOnly=yes", s.SSHKeyPath)
+		}
+		if s.KnownHostsPath != "" {
+			sshCmd += fmt.Sprintf(" -o UserKnownHostsFile=%s", s.KnownHostsPath)
+		}
+		env = append(env, "GIT_SSH_COMMAND="+sshCmd)
+	}
+	if s.Username != "" || s.Password != "" {
+		if s.askPassPath == "" {
+			f, err := ioutil.TempFile("", "kube-applier-askpass")
+			if err != nil {
+				return nil, fmt.Errorf("creating askpass script failed: %v", err)
+			}
+			_, err = f.WriteString(askPassScript)
+			if err == nil {
+				err = f.Chmod(0700)
+			}
+			// The script cannot be executed while it is open for writing
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return nil, fmt.Errorf("writing askpass script failed: %v", err)
+			}
+			s.askPassPath = f.Name()
+		}
+		env = append(env,
+			"GIT_ASKPASS="+s.askPassPath,
+			"KUBE_APPLIER_GIT_USERNAME="+s.Username,
+			"KUBE_APPLIER_GIT_PASSWORD="+s.Password,
+		)
+	}
+	return env, nil
+}
@@ -1,80 +1,162 @@
 package kube
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/utilitywarehouse/kube-applier/log"
 	"github.com/utilitywarehouse/kube-applier/metrics"
 	"github.com/utilitywarehouse/kube-applier/sysutil"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 const (
 	// Default location of the service-account token on the cluster
 	tokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
 
+	// Namespace of the pod, mounted along with the service-account token
+	namespacePath = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
 	// Location of the kubeconfig template file within the container - see ADD command in Dockerfile
 	kubeconfigTemplatePath = "/templates/kubeconfig"
 
 	// Location of the written kubeconfig file within the container
 	kubeconfigFilePath = "/etc/kubeconfig"
 
-	enabledAnnotation = "kube-applier.io/enabled"
-	dryRunAnnotation  = "kube-applier.io/dry-run"
-	pruneAnnotation   = "kube-applier.io/prune"
+	// Prefix shared by all the annotations that control kube-applier
+	annotationPrefix = "kube-applier.io/"
+
+	enabledAnnotation        = annotationPrefix + "enabled"
+	dryRunAnnotation         = annotationPrefix + "dry-run"
+	pruneAnnotation          = annotationPrefix + "prune"
+	serverSideAnnotation     = annotationPrefix + "server-side"
+	pruneWhitelistAnnotation = annotationPrefix + "prune-whitelist"
+	notifyAnnotation         = annotationPrefix + "notify"
+	applyTimeoutAnnotation   = annotationPrefix + "apply-timeout"
+
+	// Default field manager used for server-side applies
+	defaultFieldManager = "kube-applier"
+
+	// Interval at which the namespace informer re-lists all namespaces
+	namespaceResyncPeriod = 10 * time.Minute
 )
 
-// To make testing possible
-var execCommand = exec.Command
-
-//todo(catalin-ilea) Add core/v1/Secret when we plug in strongbox
-var pruneWhitelist = []string{
-	"apps/v1/DaemonSet",
-	"apps/v1/Deployment",
-	"apps/v1/StatefulSet",
-	"autoscaling/v1/HorizontalPodAutoscaler",
-	"batch/v1/Job",
-	"core/v1/ConfigMap",
-	"core/v1/Pod",
-	"core/v1/Service",
-	"core/v1/ServiceAccount",
-	"networking.k8s.io/v1beta1/Ingress",
-	"networking.k8s.io/v1/NetworkPolicy",
-}
+// Time allowed for the namespace informer to receive every namespace
+var namespaceSyncTimeout = time.Minute
 
 // KAAnnotations contains the standard set of annotations on the Namespace
 // resource defining behaviour for that Namespace
 type KAAnnotations struct {
-	Enabled string
-	DryRun  string
-	Prune   string
+	Enabled        string
+	DryRun         string
+	Prune          string
+	ServerSide     string
+	PruneWhitelist string
+	Notify         string
+	ApplyTimeout   string
+}
+
+// ApplyOptions controls how the files of a namespace are applied.
+// PruneWhitelist overrides the prune whitelist of the Client when it is not empty.
+type ApplyOptions struct {
+	DryRun         bool
+	Prune          bool
+	Kustomize      bool
+	ServerSide     bool
+	PruneWhitelist []string
 }
 
 // ClientInterface allows for mocking out the functionality of Client when testing the full process of an apply run.
 type ClientInterface interface {
-	Apply(path, namespace string, dryRun, prune, kustomize bool) (string, string, error)
+	Apply(ctx context.Context, path, namespace string, options ApplyOptions) (string, string, error)
+	Diff(ctx context.Context, path, namespace string, options ApplyOptions) (string, []ObjectDiff, error)
 	NamespaceAnnotations(namespace string) (KAAnnotations, error)
 }
 
 // Client enables communication with the Kubernetes API Server through kubectl commands.
+// Namespace annotations are read from a local cache of Namespace objects, kept up to date by an informer.
 // The Server field enables discovery of the API server when kube-proxy is not configured (see README.md for more information).
+// Kubeconfig and Context select another cluster than the one kube-applier runs in, they take precedence over Server.
+// FieldManager and ForceConflicts only apply to server-side applies.
+// PruneWhitelist lists the group/version/Kind of the objects that may be pruned, the built-in list is used if it is empty.
 type Client struct {
-	Server  string
-	Label   string
-	Metrics metrics.PrometheusInterface
+	Server             string
+	Kubeconfig         string
+	Context            string
+	Label              string
+	Metrics            metrics.PrometheusInterface
+	FieldManager       string
+	ForceConflicts     bool
+	PruneWhitelist     []string
+	clientset          kubernetes.Interface
+	namespaceLister    corelisters.NamespaceLister
+	discovery          discovery.CachedDiscoveryInterface
+	discoveryMutex     sync.Mutex
+	discoveryRefreshed time.Time
 }
 
-// Configure writes the kubeconfig file to be used for authenticating kubectl commands.
+// Configure writes the kubeconfig file to be used for authenticating kubectl commands
+// and creates the clientset used for talking to the API Server directly.
 func (c *Client) Configure() error {
+	if c.Kubeconfig != "" {
+		config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+			&clientcmd.ClientConfigLoadingRules{ExplicitPath: c.Kubeconfig},
+			&clientcmd.ConfigOverrides{CurrentContext: c.Context},
+		).ClientConfig()
+		if err != nil {
+			return errors.Wrapf(err, "loading kubeconfig file %s failed", c.Kubeconfig)
+		}
+		return c.createClientset(config)
+	}
+
 	// No need to write a kubeconfig file if Server is not specified (API server will be discovered via kube-proxy).
 	if c.Server == "" {
-		return nil
+		config, err := rest.InClusterConfig()
+		if err != nil {
+			return errors.Wrap(err, "loading in-cluster configuration failed")
+		}
+		return c.createClientset(config)
+	}
+
+	if err := c.writeKubeconfig(); err != nil {
+		return err
+	}
+
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfigFilePath)
+	if err != nil {
+		return errors.Wrap(err, "loading kubeconfig file failed")
 	}
+	return c.createClientset(config)
+}
+
+func (c *Client) createClientset(config *rest.Config) error {
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return errors.Wrap(err, "creating kubernetes clientset failed")
+	}
+	c.clientset = clientset
+	c.discovery = memory.NewMemCacheClient(clientset.Discovery())
+	return nil
+}
 
+func (c *Client) writeKubeconfig() error {
 	f, err := os.Create(kubeconfigFilePath)
 	if err != nil {
 		return errors.Wrap(err, "creating kubeconfig file failed")
@@ -107,30 +189,45 @@ func (c *Client) Configure() error {
 // Apply attempts to "kubectl apply" the files located at path. It returns the
 // full apply command and its output.
 //
-// kustomize - Do a `kubectl apply -k` on the path, set to if there is a
-//             `kustomization.yaml` found in the path
-func (c *Client) Apply(path, namespace string, dryRun, prune, kustomize bool) (string, string, error) {
-	var args []string
+// With options.Kustomize it does a `kubectl apply -k` on the path, set to if
+// there is a `kustomization.yaml` found in the path.
+// With options.ServerSide it does a server-side apply, conflicts with other
+// field managers are returned as a *ConflictError. Server-side applies do not
+// set the last-applied-configuration annotation kubectl prunes objects by, so
+// options.Prune should not be combined with it.
+// kubectl is killed if ctx is cancelled before it completes.
+func (c *Client) Apply(ctx context.Context, path, namespace string, options ApplyOptions) (string, string, error) {
+	args := []string{"kubectl", "apply"}
 
-	if kustomize {
-		args = []string{"kubectl", "apply", fmt.Sprintf("--server-dry-run=%t", dryRun), "-k", path, "-n", namespace}
+	if options.ServerSide {
+		fieldManager := c.FieldManager
+		if fieldManager == "" {
+			fieldManager = defaultFieldManager
+		}
+		args = append(args, "--server-side", "--field-manager="+fieldManager)
+		if c.ForceConflicts {
+			args = append(args, "--force-conflicts")
+		}
+		if options.DryRun {
+			args = append(args, "--dry-run=server")
+		}
 	} else {
-		args = []string{"kubectl", "apply", fmt.Sprintf("--server-dry-run=%t", dryRun), "-R", "-f", path, "-n", namespace}
+		args = append(args, fmt.Sprintf("--server-dry-run=%t", options.DryRun))
 	}
 
-	if prune {
-		args = append(args, "--prune")
-		args = append(args, "--all")
-		for _, w := range pruneWhitelist {
-			args = append(args, "--prune-whitelist="+w)
-		}
+	if options.Kustomize {
+		args = append(args, "-k", path, "-n", namespace)
+	} else {
+		args = append(args, "-R", "-f", path, "-n", namespace)
 	}
 
-	if c.Server != "" {
-		args = append(args, fmt.Sprintf("--kubeconfig=%s", kubeconfigFilePath))
+	if options.Prune {
+		args = append(args, c.pruneArgs(namespace, options.PruneWhitelist)...)
 	}
 
-	kubectlCmd := exec.Command(args[0], args[1:]...)
+	args = append(args, c.kubeconfigArgs()...)
+
+	kubectlCmd := command(ctx, args)
 
 	cmdStr := strings.Join(args, " ")
 
@@ -139,41 +236,143 @@ func (c *Client) Apply(path, namespace string, dryRun, prune, kustomize bool) (s
 		if e, ok := err.(*exec.ExitError); ok {
 			c.Metrics.UpdateKubectlExitCodeCount(namespace, e.ExitCode())
 		}
+		if options.ServerSide {
+			if conflicts := parseConflicts(string(out)); len(conflicts) > 0 {
+				err = &ConflictError{conflicts, err}
+			}
+		}
 		return cmdStr, string(out), err
 	}
-	c.Metrics.UpdateKubectlExitCodeCount(path, 0)
+	c.Metrics.UpdateKubectlExitCodeCount(namespace, 0)
 
 	return cmdStr, string(out), err
 }
 
-// NamespaceAnnotations returns string values of kube-applier annotaions
-func (c *Client) NamespaceAnnotations(namespace string) (KAAnnotations, error) {
-	kaa := KAAnnotations{}
-	args := []string{"kubectl", "get", "namespace", namespace, "-o", "json"}
-	if c.Server != "" {
-		args = append(args, fmt.Sprintf("--kubeconfig=%s", kubeconfigFilePath))
+// kubeconfigArgs returns the kubectl flags that select the cluster of the
+// Client, none for the cluster kube-applier runs in.
+func (c *Client) kubeconfigArgs() []string {
+	switch {
+	case c.Kubeconfig != "":
+		args := []string{fmt.Sprintf("--kubeconfig=%s", c.Kubeconfig)}
+		if c.Context != "" {
+			args = append(args, fmt.Sprintf("--context=%s", c.Context))
+		}
+		return args
+	case c.Server != "":
+		return []string{fmt.Sprintf("--kubeconfig=%s", kubeconfigFilePath)}
 	}
-	stdout, err := execCommand(args[0], args[1:]...).CombinedOutput()
-	if err != nil {
-		if e, ok := err.(*exec.ExitError); ok {
-			c.Metrics.UpdateKubectlExitCodeCount(namespace, e.ExitCode())
+	return nil
+}
+
+// WatchNamespaces starts an informer that keeps the local cache of Namespace
+// objects up to date and blocks until the cache is populated, for up to
+// namespaceSyncTimeout. It returns an error straight away if the namespaces
+// cannot be listed, eg. without the RBAC permission to. onChange, if not
+// nil, is called with the name of a namespace whenever its kube-applier
+// annotations change after that, or when a namespace is created with some.
+func (c *Client) WatchNamespaces(stop <-chan struct{}, onChange func(namespace string)) error {
+	if c.clientset == nil {
+		return fmt.Errorf("kubernetes clientset is not configured")
+	}
+
+	if _, err := c.clientset.CoreV1().Namespaces().List(context.TODO(), metav1.ListOptions{Limit: 1}); err != nil {
+		if apierrors.IsForbidden(err) {
+			return errors.Wrap(err, "kube-applier needs the get, list and watch permissions on namespaces cluster-wide")
 		}
-		return kaa, err
+		return errors.Wrap(err, "listing namespaces failed")
 	}
-	c.Metrics.UpdateKubectlExitCodeCount(namespace, 0)
 
-	var nr struct {
-		Metadata struct {
-			Annotations map[string]string
+	factory := informers.NewSharedInformerFactory(c.clientset, namespaceResyncPeriod)
+	informer := factory.Core().V1().Namespaces()
+	if onChange != nil {
+		informer.Informer().AddEventHandler(cache.ResourceEventHandlerDetailedFuncs{
+			AddFunc: func(obj interface{}, isInInitialList bool) {
+				// The namespaces listed when the informer starts are
+				// applied by the first run
+				ns, ok := obj.(*corev1.Namespace)
+				if !ok || isInInitialList {
+					return
+				}
+				if len(kaAnnotations(ns.Annotations)) > 0 {
+					onChange(ns.Name)
+				}
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				oldNs, ok := oldObj.(*corev1.Namespace)
+				if !ok {
+					return
+				}
+				newNs, ok := newObj.(*corev1.Namespace)
+				if !ok {
+					return
+				}
+				if !annotationsEqual(kaAnnotations(oldNs.Annotations), kaAnnotations(newNs.Annotations)) {
+					log.Logger.Info("Namespace annotations changed", "namespace", newNs.Name)
+					onChange(newNs.Name)
+				}
+			},
+		})
+	}
+	c.namespaceLister = informer.Lister()
+
+	factory.Start(stop)
+	ctx, cancel := context.WithTimeout(context.Background(), namespaceSyncTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
 		}
+	}()
+	if !cache.WaitForCacheSync(ctx.Done(), informer.Informer().HasSynced) {
+		return fmt.Errorf("namespaces were not received within %v, check that kube-applier can watch namespaces cluster-wide", namespaceSyncTimeout)
 	}
-	if err := json.Unmarshal(stdout, &nr); err != nil {
-		return kaa, err
+	return nil
+}
+
+// NamespaceAnnotations returns string values of kube-applier annotaions
+func (c *Client) NamespaceAnnotations(namespace string) (KAAnnotations, error) {
+	kaa := KAAnnotations{}
+	if c.namespaceLister == nil {
+		return kaa, fmt.Errorf("namespace cache is not started")
+	}
+
+	ns, err := c.namespaceLister.Get(namespace)
+	if err != nil {
+		return kaa, errors.Wrapf(err, "getting namespace %s from cache failed", namespace)
 	}
 
-	kaa.Enabled = nr.Metadata.Annotations[enabledAnnotation]
-	kaa.DryRun = nr.Metadata.Annotations[dryRunAnnotation]
-	kaa.Prune = nr.Metadata.Annotations[pruneAnnotation]
+	kaa.Enabled = ns.Annotations[enabledAnnotation]
+	kaa.DryRun = ns.Annotations[dryRunAnnotation]
+	kaa.Prune = ns.Annotations[pruneAnnotation]
+	kaa.ServerSide = ns.Annotations[serverSideAnnotation]
+	kaa.PruneWhitelist = ns.Annotations[pruneWhitelistAnnotation]
+	kaa.Notify = ns.Annotations[notifyAnnotation]
+	kaa.ApplyTimeout = ns.Annotations[applyTimeoutAnnotation]
 
 	return kaa, nil
 }
+
+// kaAnnotations returns the subset of annotations that control kube-applier.
+func kaAnnotations(annotations map[string]string) map[string]string {
+	kaa := make(map[string]string)
+	for k, v := range annotations {
+		if strings.HasPrefix(k, annotationPrefix) {
+			kaa[k] = v
+		}
+	}
+	return kaa
+}
+
+func annotationsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,151 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/utilitywarehouse/kube-applier/log"
+
+	"github.com/go-test/deep"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+func TestClientKubeconfigArgs(t *testing.T) {
+	for _, test := range []struct {
+		client   *Client
+		expected []string
+	}{
+		{&Client{}, nil},
+		{&Client{Server: "https://kubernetes.example.com"}, []string{"--kubeconfig=/etc/kubeconfig"}},
+		{&Client{Kubeconfig: "/etc/staging.yaml"}, []string{"--kubeconfig=/etc/staging.yaml"}},
+		{&Client{Kubeconfig: "/etc/staging.yaml", Context: "admin"}, []string{"--kubeconfig=/etc/staging.yaml", "--context=admin"}},
+	} {
+		if diff := deep.Equal(test.client.kubeconfigArgs(), test.expected); diff != nil {
+			t.Errorf("%v: %v", test.expected, diff)
+		}
+	}
+}
+
+func namespace(name string, labels, annotations map[string]string) *corev1.Namespace {
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels, Annotations: annotations}}
+}
+
+func TestClientWatchNamespaces(t *testing.T) {
+	log.InitLogger("info")
+
+	clientset := fake.NewSimpleClientset(
+		namespace("initial", nil, map[string]string{enabledAnnotation: "true"}),
+	)
+	// Namespaces must not be changed before the informer watches them, or
+	// the changes are missed
+	watching := make(chan struct{})
+	clientset.PrependWatchReactor("*", func(action clienttesting.Action) (bool, watch.Interface, error) {
+		w, err := clientset.Tracker().Watch(action.GetResource(), action.GetNamespace())
+		if err != nil {
+			return false, nil, err
+		}
+		close(watching)
+		return true, w, nil
+	})
+
+	changes := make(chan string, 10)
+	stop := make(chan struct{})
+	defer close(stop)
+	c := &Client{clientset: clientset}
+	if err := c.WatchNamespaces(stop, func(ns string) { changes <- ns }); err != nil {
+		t.Fatal(err)
+	}
+	<-watching
+
+	if kaa, err := c.NamespaceAnnotations("initial"); err != nil || kaa.Enabled != "true" {
+		t.Errorf("initial: unexpected annotations %v: %v", kaa, err)
+	}
+
+	// The events are received in order, so an event that does not call
+	// onChange is followed by one that does
+	namespaces := clientset.CoreV1().Namespaces()
+	for _, test := range []struct {
+		update   bool
+		ns       *corev1.Namespace
+		expected string
+	}{
+		// Namespaces in the initial list are not reported
+		{false, namespace("added", nil, map[string]string{dryRunAnnotation: "true"}), "added"},
+		{false, namespace("plain", nil, map[string]string{"other": "true"}), ""},
+		{true, namespace("initial", nil, map[string]string{enabledAnnotation: "false"}), "initial"},
+		{true, namespace("initial", map[string]string{"team": "a"}, map[string]string{enabledAnnotation: "false", "other": "true"}), ""},
+		{true, namespace("plain", nil, map[string]string{"other": "true", pruneAnnotation: "false"}), "plain"},
+	} {
+		var err error
+		if test.update {
+			_, err = namespaces.Update(context.TODO(), test.ns, metav1.UpdateOptions{})
+		} else {
+			_, err = namespaces.Create(context.TODO(), test.ns, metav1.CreateOptions{})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.expected == "" {
+			continue
+		}
+		select {
+		case ns := <-changes:
+			if ns != test.expected {
+				t.Errorf("%s: expected a change to %s, got %s", test.ns.Name, test.expected, ns)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: timed out waiting for a change", test.ns.Name)
+		}
+	}
+	select {
+	case ns := <-changes:
+		t.Errorf("unexpected change to %s", ns)
+	default:
+	}
+}
+
+func TestClientWatchNamespacesForbidden(t *testing.T) {
+	log.InitLogger("info")
+	stop := make(chan struct{})
+	defer close(stop)
+
+	// Listing namespaces is not allowed
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("list", "namespaces", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "namespaces"}, "", fmt.Errorf("no RBAC"))
+	})
+	c := &Client{clientset: clientset}
+	err := c.WatchNamespaces(stop, nil)
+	if err == nil || !strings.Contains(err.Error(), "permissions on namespaces") {
+		t.Errorf("expected a permission error, got %v", err)
+	}
+
+	// The namespaces cannot be listed after the first attempt, the cache never
+	// syncs
+	defer func(timeout time.Duration) { namespaceSyncTimeout = timeout }(namespaceSyncTimeout)
+	namespaceSyncTimeout = 100 * time.Millisecond
+	clientset = fake.NewSimpleClientset()
+	var lists int32
+	clientset.PrependReactor("list", "namespaces", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		if atomic.AddInt32(&lists, 1) == 1 {
+			return false, nil, nil
+		}
+		return true, nil, fmt.Errorf("connection refused")
+	})
+	c = &Client{clientset: clientset}
+	err = c.WatchNamespaces(stop, nil)
+	if err == nil || !strings.Contains(err.Error(), "were not received") {
+		t.Errorf("expected a timeout error, got %v", err)
+	}
+}
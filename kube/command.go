@@ -0,0 +1,26 @@
+package kube
+
+import (
+	"context"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// Time allowed for the output of a killed command to be closed, by the
+// processes it started, before Wait returns anyway
+const commandWaitDelay = 5 * time.Second
+
+// command returns a Cmd running args in its own process group, so that the
+// whole group is killed if ctx is cancelled before it completes. Otherwise the
+// processes started by the command, eg. the git clones of kustomize remote
+// bases, would keep running and hold its output open.
+func command(ctx context.Context, args []string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = commandWaitDelay
+	return cmd
+}
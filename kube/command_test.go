@@ -0,0 +1,23 @@
+package kube
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCommandKilledWithChildren(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// The sleep started in the background keeps the output open unless it is
+	// killed along with the shell
+	start := time.Now()
+	_, err := command(ctx, []string{"sh", "-c", "sleep 30 & sleep 30"}).CombinedOutput()
+	if err == nil {
+		t.Fatal("expected the command to be killed")
+	}
+	if elapsed := time.Since(start); elapsed > commandWaitDelay {
+		t.Errorf("expected the command to be killed straight away, took %v", elapsed)
+	}
+}
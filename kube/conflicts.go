@@ -0,0 +1,63 @@
+package kube
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	// Matches a single conflict, eg:
+	// conflict with "kubectl-client-side-apply" using apps/v1: .spec.replicas
+	conflictRegex = regexp.MustCompile(`conflict with "([^"]+)"(?: using ([^:\s]+))?: (\S.*)$`)
+	// Matches the header of a list of conflicts for the same manager, eg:
+	// conflicts with "kubectl-client-side-apply" using apps/v1:
+	conflictsHeaderRegex = regexp.MustCompile(`conflicts with "([^"]+)"(?: using ([^:\s]+))?:$`)
+	// Matches a field in a list of conflicts, eg:
+	// - .spec.replicas
+	conflictFieldRegex = regexp.MustCompile(`^- (\S.*)$`)
+)
+
+// ApplyConflict describes a field that could not be set by a server-side
+// apply because it is owned by another field manager.
+type ApplyConflict struct {
+	Manager    string `json:"manager"`
+	APIVersion string `json:"apiVersion"`
+	Field      string `json:"field"`
+}
+
+// ConflictError is returned by Apply when a server-side apply fails because
+// of conflicts with other field managers.
+type ConflictError struct {
+	Conflicts []ApplyConflict
+	Err       error
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%v: server-side apply failed with %d conflict(s)", e.Err, len(e.Conflicts))
+}
+
+// parseConflicts extracts the field manager conflicts reported by kubectl in
+// the output of a server-side apply.
+func parseConflicts(output string) []ApplyConflict {
+	var conflicts []ApplyConflict
+	var manager, apiVersion string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if m := conflictsHeaderRegex.FindStringSubmatch(line); m != nil {
+			manager, apiVersion = m[1], m[2]
+			continue
+		}
+		if m := conflictRegex.FindStringSubmatch(line); m != nil {
+			conflicts = append(conflicts, ApplyConflict{m[1], m[2], m[3]})
+			manager = ""
+			continue
+		}
+		if m := conflictFieldRegex.FindStringSubmatch(line); m != nil && manager != "" {
+			conflicts = append(conflicts, ApplyConflict{manager, apiVersion, m[1]})
+			continue
+		}
+		manager = ""
+	}
+	return conflicts
+}
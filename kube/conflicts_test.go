@@ -0,0 +1,53 @@
+package kube
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestParseConflictsSingle(t *testing.T) {
+	output := `service/serviceName serverside-applied
+error: Apply failed with 1 conflict: conflict with "kubectl-client-side-apply" using apps/v1: .spec.replicas
+Please review the fields above--they currently have other managers. Here
+are the ways you can resolve this warning:
+* If you intend to manage all of these fields, please re-run the apply
+  command with the ` + "`--force-conflicts`" + ` flag.`
+
+	want := []ApplyConflict{
+		{"kubectl-client-side-apply", "apps/v1", ".spec.replicas"},
+	}
+
+	if diff := deep.Equal(parseConflicts(output), want); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestParseConflictsMultiple(t *testing.T) {
+	output := `error: Apply failed with 3 conflicts: conflicts with "helm" using apps/v1:
+- .spec.replicas
+- .spec.template.spec.containers[name="app"].image
+conflicts with "kubectl-edit":
+- .metadata.labels.team
+Please review the fields above--they currently have other managers.`
+
+	want := []ApplyConflict{
+		{"helm", "apps/v1", ".spec.replicas"},
+		{"helm", "apps/v1", `.spec.template.spec.containers[name="app"].image`},
+		{"kubectl-edit", "", ".metadata.labels.team"},
+	}
+
+	if diff := deep.Equal(parseConflicts(output), want); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestParseConflictsNone(t *testing.T) {
+	output := `deployment.apps/deploymentName serverside-applied
+error: error validating "deployment.yaml": error validating data: kind not set
+- not a conflict`
+
+	if got := parseConflicts(output); len(got) != 0 {
+		t.Errorf("expected no conflicts, got %v", got)
+	}
+}
@@ -0,0 +1,93 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// External diff program used by kubectl diff, set explicitly so that the
+// output format can be split per object. The image ships GNU diff, rather than
+// the busybox one, which is also supported by parseDiff.
+const externalDiff = "diff -u -N"
+
+// ObjectDiff is the unified diff between the live and the desired state of a
+// single object. Object is named after the files written by kubectl diff, eg.
+// apps.v1.Deployment.namespace.name
+type ObjectDiff struct {
+	Object string `json:"object"`
+	Diff   string `json:"diff"`
+}
+
+// Diff runs "kubectl diff" on the files located at path and returns the full
+// command and the diff of each object that would be changed by an apply with
+// the same options. Prune and DryRun are ignored. kubectl is killed if ctx is
+// cancelled before it completes.
+func (c *Client) Diff(ctx context.Context, path, namespace string, options ApplyOptions) (string, []ObjectDiff, error) {
+	args := []string{"kubectl", "diff"}
+
+	if options.ServerSide {
+		fieldManager := c.FieldManager
+		if fieldManager == "" {
+			fieldManager = defaultFieldManager
+		}
+		args = append(args, "--server-side", "--field-manager="+fieldManager)
+		if c.ForceConflicts {
+			args = append(args, "--force-conflicts")
+		}
+	}
+
+	if options.Kustomize {
+		args = append(args, "-k", path, "-n", namespace)
+	} else {
+		args = append(args, "-R", "-f", path, "-n", namespace)
+	}
+
+	args = append(args, c.kubeconfigArgs()...)
+
+	kubectlCmd := command(ctx, args)
+	kubectlCmd.Env = append(os.Environ(), "KUBECTL_EXTERNAL_DIFF="+externalDiff)
+
+	cmdStr := strings.Join(args, " ")
+
+	out, err := kubectlCmd.Output()
+	if err != nil {
+		// kubectl diff exits with 1 when differences are found
+		e, ok := err.(*exec.ExitError)
+		if !ok || e.ExitCode() != 1 {
+			if ok && len(e.Stderr) > 0 {
+				return cmdStr, nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(string(e.Stderr)))
+			}
+			return cmdStr, nil, err
+		}
+	}
+
+	return cmdStr, parseDiff(string(out)), nil
+}
+
+// parseDiff splits the output of kubectl diff into one diff per object. Each
+// diff starts with the ---/+++ header naming the files of the object, the
+// "diff" lines printed before it by GNU diff, but not busybox, are dropped.
+func parseDiff(output string) []ObjectDiff {
+	var diffs []ObjectDiff
+	var current *ObjectDiff
+	lines := strings.SplitAfter(output, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "diff ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "--- ") {
+			continue
+		}
+		if strings.HasPrefix(line, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ ") {
+			// The file name is followed by a tab and the modification time
+			name := strings.SplitN(strings.TrimPrefix(lines[i+1], "+++ "), "\t", 2)[0]
+			diffs = append(diffs, ObjectDiff{Object: filepath.Base(strings.TrimSpace(name))})
+			current = &diffs[len(diffs)-1]
+		}
+		if current != nil {
+			current.Diff += line
+		}
+	}
+	return diffs
+}
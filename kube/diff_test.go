@@ -0,0 +1,86 @@
+package kube
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestParseDiff(t *testing.T) {
+	output := `diff -u -N /tmp/LIVE-123/apps.v1.Deployment.foo.bar /tmp/MERGED-456/apps.v1.Deployment.foo.bar
+--- /tmp/LIVE-123/apps.v1.Deployment.foo.bar	2020-05-01 10:00:00.000000000 +0000
++++ /tmp/MERGED-456/apps.v1.Deployment.foo.bar	2020-05-01 10:00:00.000000000 +0000
+@@ -1,3 +1,3 @@
+ spec:
+-  replicas: 1
++  replicas: 2
+diff -u -N /tmp/LIVE-123/v1.ConfigMap.foo.baz /tmp/MERGED-456/v1.ConfigMap.foo.baz
+--- /tmp/LIVE-123/v1.ConfigMap.foo.baz	1970-01-01 00:00:00.000000000 +0000
++++ /tmp/MERGED-456/v1.ConfigMap.foo.baz	2020-05-01 10:00:00.000000000 +0000
+@@ -0,0 +1 @@
++data: {}
+`
+	expected := []ObjectDiff{
+		{
+			Object: "apps.v1.Deployment.foo.bar",
+			Diff: `--- /tmp/LIVE-123/apps.v1.Deployment.foo.bar	2020-05-01 10:00:00.000000000 +0000
++++ /tmp/MERGED-456/apps.v1.Deployment.foo.bar	2020-05-01 10:00:00.000000000 +0000
+@@ -1,3 +1,3 @@
+ spec:
+-  replicas: 1
++  replicas: 2
+`,
+		},
+		{
+			Object: "v1.ConfigMap.foo.baz",
+			Diff: `--- /tmp/LIVE-123/v1.ConfigMap.foo.baz	1970-01-01 00:00:00.000000000 +0000
++++ /tmp/MERGED-456/v1.ConfigMap.foo.baz	2020-05-01 10:00:00.000000000 +0000
+@@ -0,0 +1 @@
++data: {}
+`,
+		},
+	}
+	if diff := deep.Equal(parseDiff(output), expected); diff != nil {
+		t.Error(diff)
+	}
+
+	// busybox diff does not print the diff lines
+	busybox := `--- /tmp/LIVE-123/apps.v1.Deployment.foo.bar
++++ /tmp/MERGED-456/apps.v1.Deployment.foo.bar
+@@ -1,3 +1,3 @@
+ spec:
+-  replicas: 1
++  replicas: 2
+--- /tmp/LIVE-123/v1.ConfigMap.foo.baz
++++ /tmp/MERGED-456/v1.ConfigMap.foo.baz
+@@ -0,0 +1 @@
++data: {}
+`
+	expected = []ObjectDiff{
+		{
+			Object: "apps.v1.Deployment.foo.bar",
+			Diff: `--- /tmp/LIVE-123/apps.v1.Deployment.foo.bar
++++ /tmp/MERGED-456/apps.v1.Deployment.foo.bar
+@@ -1,3 +1,3 @@
+ spec:
+-  replicas: 1
++  replicas: 2
+`,
+		},
+		{
+			Object: "v1.ConfigMap.foo.baz",
+			Diff: `--- /tmp/LIVE-123/v1.ConfigMap.foo.baz
++++ /tmp/MERGED-456/v1.ConfigMap.foo.baz
+@@ -0,0 +1 @@
++data: {}
+`,
+		},
+	}
+	if diff := deep.Equal(parseDiff(busybox), expected); diff != nil {
+		t.Error(diff)
+	}
+
+	if diffs := parseDiff(""); diffs != nil {
+		t.Errorf("expected no diffs, got %v", diffs)
+	}
+}
@@ -0,0 +1,114 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// HelmChartFile is the file that marks a namespace directory to be rendered with helm template, see HelmChart
+	HelmChartFile = "helm.yaml"
+
+	// Values file used when a HelmChart does not list any
+	defaultHelmValuesFile = "values.yaml"
+
+	// Name of the file the rendered manifests are written to
+	helmManifestsFile = "manifests.yaml"
+)
+
+// HelmChart describes how the manifests of a namespace are rendered from a
+// chart kept in the repository, eg:
+//
+// chart: ../../charts/app
+// releaseName: app
+// valuesFiles:
+// - values.yaml
+// - values-prod.yaml
+//
+// Chart and ValuesFiles are relative to the namespace directory, so that a
+// commit applied from a worktree is rendered with the chart of that commit.
+// ReleaseName defaults to the name of the namespace and ValuesFiles to
+// values.yaml, if it exists.
+type HelmChart struct {
+	Chart       string   `json:"chart"`
+	ReleaseName string   `json:"releaseName,omitempty"`
+	ValuesFiles []string `json:"valuesFiles,omitempty"`
+}
+
+// LoadHelmChart reads the HelmChartFile of the namespace directory at path.
+// It returns nil if the directory does not have one.
+func LoadHelmChart(path string) (*HelmChart, error) {
+	data, err := ioutil.ReadFile(filepath.Join(path, HelmChartFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s failed", HelmChartFile)
+	}
+	var chart HelmChart
+	if err := yaml.UnmarshalStrict(data, &chart); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s failed", HelmChartFile)
+	}
+	if chart.Chart == "" {
+		return nil, fmt.Errorf("%s: chart is required", HelmChartFile)
+	}
+	for _, p := range append([]string{chart.Chart}, chart.ValuesFiles...) {
+		if filepath.IsAbs(p) {
+			return nil, fmt.Errorf("%s: %s must be relative to the namespace directory", HelmChartFile, p)
+		}
+	}
+	return &chart, nil
+}
+
+// templateArgs returns the helm template command rendering the chart for the
+// namespace directory at path.
+func (h *HelmChart) templateArgs(path, namespace string) []string {
+	releaseName := h.ReleaseName
+	if releaseName == "" {
+		releaseName = namespace
+	}
+	args := []string{"helm", "template", releaseName, filepath.Join(path, h.Chart), "--namespace", namespace}
+	valuesFiles := h.ValuesFiles
+	if len(valuesFiles) == 0 {
+		if _, err := os.Stat(filepath.Join(path, defaultHelmValuesFile)); err == nil {
+			valuesFiles = []string{defaultHelmValuesFile}
+		}
+	}
+	for _, v := range valuesFiles {
+		args = append(args, "--values", filepath.Join(path, v))
+	}
+	return args
+}
+
+// Render runs "helm template" for the namespace directory at path and writes
+// the manifests to the directory out, which is created and can be applied
+// like a namespace directory. It returns the full command and the messages
+// written by helm, the manifests are not included. helm is killed if ctx is
+// cancelled before it completes.
+func (h *HelmChart) Render(ctx context.Context, path, namespace, out string) (string, string, error) {
+	args := h.templateArgs(path, namespace)
+	cmdStr := strings.Join(args, " ")
+
+	helmCmd := command(ctx, args)
+	var stderr strings.Builder
+	helmCmd.Stderr = &stderr
+	manifests, err := helmCmd.Output()
+	if err != nil {
+		return cmdStr, stderr.String(), errors.Wrap(err, "helm template failed")
+	}
+
+	if err := os.MkdirAll(out, 0755); err != nil {
+		return cmdStr, stderr.String(), errors.Wrap(err, "creating the rendered manifests directory failed")
+	}
+	if err := ioutil.WriteFile(filepath.Join(out, helmManifestsFile), manifests, 0644); err != nil {
+		return cmdStr, stderr.String(), errors.Wrap(err, "writing the rendered manifests failed")
+	}
+	return cmdStr, stderr.String(), nil
+}
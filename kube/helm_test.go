@@ -0,0 +1,80 @@
+package kube
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestLoadHelmChart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube-applier-helm-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, test := range []struct {
+		content  string
+		expected *HelmChart
+		err      bool
+	}{
+		{"", nil, false},
+		{"chart: ../charts/app\nvaluesFiles:\n- values-prod.yaml\n", &HelmChart{Chart: "../charts/app", ValuesFiles: []string{"values-prod.yaml"}}, false},
+		{"releaseName: app\n", nil, true},
+		{"chart: /charts/app\n", nil, true},
+		{"chart: ../charts/app\nvaluesFiles:\n- /values.yaml\n", nil, true},
+		{"chart: ../charts/app\nvalues: values.yaml\n", nil, true},
+	} {
+		path := filepath.Join(dir, HelmChartFile)
+		os.Remove(path)
+		if test.content != "" {
+			if err := ioutil.WriteFile(path, []byte(test.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		chart, err := LoadHelmChart(dir)
+		if (err != nil) != test.err {
+			t.Errorf("%q: unexpected error: %v", test.content, err)
+		}
+		if diff := deep.Equal(chart, test.expected); diff != nil {
+			t.Errorf("%q: %v", test.content, diff)
+		}
+	}
+}
+
+func TestHelmChartTemplateArgs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube-applier-helm-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ns")
+
+	chart := &HelmChart{Chart: "../charts/app"}
+	expected := []string{"helm", "template", "ns", filepath.Join(dir, "charts/app"), "--namespace", "ns"}
+	if diff := deep.Equal(chart.templateArgs(path, "ns"), expected); diff != nil {
+		t.Error(diff)
+	}
+
+	// values.yaml is used by default if it exists
+	if err := os.MkdirAll(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(path, "values.yaml"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	expected = append(expected, "--values", filepath.Join(path, "values.yaml"))
+	if diff := deep.Equal(chart.templateArgs(path, "ns"), expected); diff != nil {
+		t.Error(diff)
+	}
+
+	chart = &HelmChart{Chart: "../charts/app", ReleaseName: "app", ValuesFiles: []string{"a.yaml", "b.yaml"}}
+	expected = []string{"helm", "template", "app", filepath.Join(dir, "charts/app"), "--namespace", "ns",
+		"--values", filepath.Join(path, "a.yaml"), "--values", filepath.Join(path, "b.yaml")}
+	if diff := deep.Equal(chart.templateArgs(path, "ns"), expected); diff != nil {
+		t.Error(diff)
+	}
+}
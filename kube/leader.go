@@ -0,0 +1,140 @@
+package kube
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/utilitywarehouse/kube-applier/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	// Timings of the leader election, the same as the ones used by the
+	// Kubernetes controllers. A new leader is elected within leaseDuration of
+	// the leader stopping without releasing the Lease.
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+)
+
+// LeaderElectorInterface allows for mocking out the functionality of LeaderElector.
+type LeaderElectorInterface interface {
+	IsLeader() bool
+	LeaderIP() (string, error)
+}
+
+// LeaderElector elects a leader among the kube-applier replicas that share the
+// Lease LeaseName in Namespace. Replicas are identified by the name of their
+// Pod, Identity, so that followers can look up the address of the leader.
+// OnStartedLeading, if not nil, is called whenever this replica becomes the
+// leader.
+type LeaderElector struct {
+	Client           *Client
+	Namespace        string
+	LeaseName        string
+	Identity         string
+	OnStartedLeading func()
+	mutex            sync.Mutex
+	elector          *leaderelection.LeaderElector
+	leader           string
+	leaderIP         string
+}
+
+// Run takes part in the leader election until ctx is cancelled, releasing the
+// Lease if this replica is the leader. It returns an error if the leadership is
+// lost before that, as another replica may already be applying.
+func (l *LeaderElector) Run(ctx context.Context) error {
+	if l.Client.clientset == nil {
+		return fmt.Errorf("kubernetes clientset is not configured")
+	}
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Name: l.LeaseName, Namespace: l.Namespace},
+			Client:     l.Client.clientset.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: l.Identity},
+		},
+		LeaseDuration:   leaseDuration,
+		RenewDeadline:   renewDeadline,
+		RetryPeriod:     retryPeriod,
+		ReleaseOnCancel: true,
+		Name:            l.LeaseName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(context.Context) {
+				log.Logger.Info("Started leading", "lease", l.LeaseName, "identity", l.Identity)
+				if l.OnStartedLeading != nil {
+					l.OnStartedLeading()
+				}
+			},
+			OnStoppedLeading: func() {
+				log.Logger.Info("Stopped leading", "lease", l.LeaseName, "identity", l.Identity)
+			},
+			OnNewLeader: func(identity string) {
+				log.Logger.Info("New leader elected", "lease", l.LeaseName, "leader", identity)
+			},
+		},
+	})
+	if err != nil {
+		return errors.Wrap(err, "creating leader elector failed")
+	}
+	l.mutex.Lock()
+	l.elector = elector
+	l.mutex.Unlock()
+
+	elector.Run(ctx)
+	if ctx.Err() == nil {
+		return fmt.Errorf("lost leadership of lease %s/%s", l.Namespace, l.LeaseName)
+	}
+	return nil
+}
+
+// IsLeader returns true if this replica is the leader.
+func (l *LeaderElector) IsLeader() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.elector != nil && l.elector.IsLeader()
+}
+
+// LeaderIP returns the IP address of the Pod of the leader. The Pod is only
+// looked up when the leader changes.
+func (l *LeaderElector) LeaderIP() (string, error) {
+	l.mutex.Lock()
+	var leader string
+	if l.elector != nil {
+		leader = l.elector.GetLeader()
+	}
+	cachedLeader, cachedIP := l.leader, l.leaderIP
+	l.mutex.Unlock()
+	if leader == "" {
+		return "", fmt.Errorf("no leader elected")
+	}
+	if leader == cachedLeader {
+		return cachedIP, nil
+	}
+	pod, err := l.Client.clientset.CoreV1().Pods(l.Namespace).Get(context.TODO(), leader, metav1.GetOptions{})
+	if err != nil {
+		return "", errors.Wrapf(err, "getting leader pod %s failed", leader)
+	}
+	if pod.Status.PodIP == "" {
+		return "", fmt.Errorf("leader pod %s has no IP address", leader)
+	}
+	l.mutex.Lock()
+	l.leader, l.leaderIP = leader, pod.Status.PodIP
+	l.mutex.Unlock()
+	return pod.Status.PodIP, nil
+}
+
+// PodNamespace returns the namespace kube-applier is running in.
+func PodNamespace() (string, error) {
+	namespace, err := ioutil.ReadFile(namespacePath)
+	if err != nil {
+		return "", errors.Wrap(err, "reading pod namespace failed")
+	}
+	return strings.TrimSpace(string(namespace)), nil
+}
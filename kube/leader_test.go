@@ -0,0 +1,83 @@
+package kube
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/utilitywarehouse/kube-applier/log"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestLeaderElector(t *testing.T) {
+	log.InitLogger("info")
+
+	clientset := fake.NewSimpleClientset(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "kube-applier-a", Namespace: "sys-kube-applier"},
+		Status:     corev1.PodStatus{PodIP: "10.0.0.1"},
+	})
+	client := &Client{clientset: clientset}
+
+	started := make(chan struct{})
+	leader := &LeaderElector{
+		Client:           client,
+		Namespace:        "sys-kube-applier",
+		LeaseName:        "kube-applier",
+		Identity:         "kube-applier-a",
+		OnStartedLeading: func() { close(started) },
+	}
+	follower := &LeaderElector{
+		Client:    client,
+		Namespace: "sys-kube-applier",
+		LeaseName: "kube-applier",
+		Identity:  "kube-applier-b",
+	}
+	if _, err := follower.LeaderIP(); err == nil {
+		t.Error("expected an error before a leader is elected")
+	}
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leaderDone := make(chan error)
+	go func() { leaderDone <- leader.Run(leaderCtx) }()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the first replica to become the leader")
+	}
+
+	followerCtx, cancelFollower := context.WithCancel(context.Background())
+	followerDone := make(chan error)
+	go func() { followerDone <- follower.Run(followerCtx) }()
+	var ip string
+	var err error
+	for i := 0; i < 50; i++ {
+		if ip, err = follower.LeaderIP(); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("expected the follower to find the leader, got %v", err)
+	}
+	if ip != "10.0.0.1" {
+		t.Errorf("expected leader IP 10.0.0.1, got %s", ip)
+	}
+	if !leader.IsLeader() {
+		t.Error("expected the first replica to be the leader")
+	}
+	if follower.IsLeader() {
+		t.Error("expected the second replica not to be the leader")
+	}
+
+	cancelLeader()
+	if err := <-leaderDone; err != nil {
+		t.Errorf("expected no error on cancellation, got %v", err)
+	}
+	cancelFollower()
+	if err := <-followerDone; err != nil {
+		t.Errorf("expected no error on cancellation, got %v", err)
+	}
+}
@@ -5,6 +5,7 @@
 package kube
 
 import (
+	context "context"
 	gomock "github.com/golang/mock/gomock"
 	reflect "reflect"
 )
@@ -33,8 +34,8 @@ func (m *MockClientInterface) EXPECT() *MockClientInterfaceMockRecorder {
 }
 
 // Apply mocks base method
-func (m *MockClientInterface) Apply(path, namespace string, dryRun, prune, kustomize bool) (string, string, error) {
-	ret := m.ctrl.Call(m, "Apply", path, namespace, dryRun, prune, kustomize)
+func (m *MockClientInterface) Apply(ctx context.Context, path, namespace string, options ApplyOptions) (string, string, error) {
+	ret := m.ctrl.Call(m, "Apply", ctx, path, namespace, options)
 	ret0, _ := ret[0].(string)
 	ret1, _ := ret[1].(string)
 	ret2, _ := ret[2].(error)
@@ -42,8 +43,22 @@ func (m *MockClientInterface) Apply(path, namespace string, dryRun, prune, kusto
 }
 
 // Apply indicates an expected call of Apply
-func (mr *MockClientInterfaceMockRecorder) Apply(path, namespace, dryRun, prune, kustomize interface{}) *gomock.Call {
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Apply", reflect.TypeOf((*MockClientInterface)(nil).Apply), path, namespace, dryRun, prune, kustomize)
+func (mr *MockClientInterfaceMockRecorder) Apply(ctx, path, namespace, options interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Apply", reflect.TypeOf((*MockClientInterface)(nil).Apply), ctx, path, namespace, options)
+}
+
+// Diff mocks base method
+func (m *MockClientInterface) Diff(ctx context.Context, path, namespace string, options ApplyOptions) (string, []ObjectDiff, error) {
+	ret := m.ctrl.Call(m, "Diff", ctx, path, namespace, options)
+	ret0, _ := ret[0].(string)
+	ret1, _ := ret[1].([]ObjectDiff)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// Diff indicates an expected call of Diff
+func (mr *MockClientInterfaceMockRecorder) Diff(ctx, path, namespace, options interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Diff", reflect.TypeOf((*MockClientInterface)(nil).Diff), ctx, path, namespace, options)
 }
 
 // NamespaceAnnotations mocks base method
@@ -0,0 +1,153 @@
+package kube
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/utilitywarehouse/kube-applier/log"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/discovery/cached/memory"
+	"sigs.k8s.io/yaml"
+)
+
+// How long API discovery results are cached for when validating the prune whitelist
+const discoveryCacheTTL = 5 * time.Minute
+
+// defaultPruneWhitelist is used when no whitelist is configured. Entries that
+// are not served by the API Server are skipped, see filterPruneWhitelist.
+var defaultPruneWhitelist = []string{
+	"apps/v1/DaemonSet",
+	"apps/v1/Deployment",
+	"apps/v1/StatefulSet",
+	"autoscaling/v1/HorizontalPodAutoscaler",
+	"batch/v1/Job",
+	"core/v1/ConfigMap",
+	"core/v1/Pod",
+	"core/v1/Service",
+	"core/v1/ServiceAccount",
+	"networking.k8s.io/v1/Ingress",
+	"networking.k8s.io/v1/NetworkPolicy",
+}
+
+// LoadPruneWhitelist reads a prune whitelist from a YAML file containing a
+// list of group/version/Kind entries, eg:
+//
+// - apps/v1/Deployment
+// - core/v1/Secret
+func LoadPruneWhitelist(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading prune whitelist file failed")
+	}
+	var whitelist []string
+	if err := yaml.Unmarshal(data, &whitelist); err != nil {
+		return nil, errors.Wrap(err, "parsing prune whitelist file failed")
+	}
+	if len(whitelist) == 0 {
+		return nil, fmt.Errorf("prune whitelist file %s is empty", path)
+	}
+	for _, w := range whitelist {
+		if _, _, err := splitPruneWhitelistEntry(w); err != nil {
+			return nil, err
+		}
+	}
+	return whitelist, nil
+}
+
+// ParsePruneWhitelist splits the comma separated value of the
+// kube-applier.io/prune-whitelist annotation into whitelist entries.
+func ParsePruneWhitelist(value string) []string {
+	var whitelist []string
+	for _, w := range strings.Split(value, ",") {
+		if w = strings.TrimSpace(w); w != "" {
+			whitelist = append(whitelist, w)
+		}
+	}
+	return whitelist
+}
+
+// splitPruneWhitelistEntry returns the group/version, as used by API
+// discovery, and the Kind of a whitelist entry.
+func splitPruneWhitelistEntry(entry string) (string, string, error) {
+	parts := strings.Split(entry, "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", "", fmt.Errorf("invalid prune whitelist entry %q, must be in the group/version/Kind format", entry)
+	}
+	if parts[0] == "core" {
+		return parts[1], parts[2], nil
+	}
+	return parts[0] + "/" + parts[1], parts[2], nil
+}
+
+// pruneArgs returns the kubectl flags that prune the objects of the kinds in
+// whitelist, or the built-in whitelists of the Client. Pruning is skipped if
+// none of the kinds is served by the API Server, as kubectl would otherwise
+// fall back to its own default set of kinds.
+func (c *Client) pruneArgs(namespace string, whitelist []string) []string {
+	if len(whitelist) == 0 {
+		whitelist = c.PruneWhitelist
+	}
+	if len(whitelist) == 0 {
+		whitelist = defaultPruneWhitelist
+	}
+	filtered := c.filterPruneWhitelist(whitelist)
+	if len(filtered) == 0 {
+		log.Logger.Warn("Skipping prune, no prune whitelist entry is served by the API Server", "namespace", namespace, "whitelist", whitelist)
+		return nil
+	}
+	args := []string{"--prune", "--all"}
+	for _, w := range filtered {
+		args = append(args, "--prune-whitelist="+w)
+	}
+	return args
+}
+
+// filterPruneWhitelist drops the whitelist entries that are malformed or not
+// served by the API Server, so that removed API versions do not make kubectl
+// fail. Entries that cannot be checked are kept.
+func (c *Client) filterPruneWhitelist(whitelist []string) []string {
+	if c.discovery == nil {
+		return whitelist
+	}
+
+	c.discoveryMutex.Lock()
+	if time.Since(c.discoveryRefreshed) > discoveryCacheTTL {
+		c.discovery.Invalidate()
+		c.discoveryRefreshed = time.Now()
+	}
+	c.discoveryMutex.Unlock()
+
+	var filtered []string
+	for _, w := range whitelist {
+		groupVersion, kind, err := splitPruneWhitelistEntry(w)
+		if err != nil {
+			log.Logger.Warn("Skipping prune whitelist entry", "error", err)
+			continue
+		}
+		resources, err := c.discovery.ServerResourcesForGroupVersion(groupVersion)
+		if err == memory.ErrCacheNotFound || apierrors.IsNotFound(err) {
+			log.Logger.Warn("Skipping prune whitelist entry, API version is not served", "entry", w)
+			continue
+		} else if err != nil {
+			log.Logger.Warn("Could not validate prune whitelist entry", "entry", w, "error", err)
+			filtered = append(filtered, w)
+			continue
+		}
+		served := false
+		for _, r := range resources.APIResources {
+			if r.Kind == kind && !strings.Contains(r.Name, "/") {
+				served = true
+				break
+			}
+		}
+		if !served {
+			log.Logger.Warn("Skipping prune whitelist entry, kind is not served", "entry", w)
+			continue
+		}
+		filtered = append(filtered, w)
+	}
+	return filtered
+}
@@ -0,0 +1,101 @@
+package kube
+
+import (
+	"testing"
+
+	"github.com/utilitywarehouse/kube-applier/log"
+
+	"github.com/go-test/deep"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/discovery/cached/memory"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParsePruneWhitelist(t *testing.T) {
+	got := ParsePruneWhitelist(" apps/v1/Deployment,core/v1/Secret ,, ")
+	want := []string{"apps/v1/Deployment", "core/v1/Secret"}
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Error(diff)
+	}
+	if got := ParsePruneWhitelist(""); len(got) != 0 {
+		t.Errorf("expected empty whitelist, got %v", got)
+	}
+}
+
+func TestFilterPruneWhitelist(t *testing.T) {
+	log.InitLogger("info")
+
+	clientset := fake.NewSimpleClientset()
+	clientset.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: "v1",
+			APIResources: []metav1.APIResource{
+				{Name: "configmaps", Kind: "ConfigMap"},
+				{Name: "secrets", Kind: "Secret"},
+				{Name: "pods/log", Kind: "Pod"},
+			},
+		},
+		{
+			GroupVersion: "apps/v1",
+			APIResources: []metav1.APIResource{
+				{Name: "deployments", Kind: "Deployment"},
+			},
+		},
+		{
+			GroupVersion: "networking.k8s.io/v1",
+			APIResources: []metav1.APIResource{
+				{Name: "ingresses", Kind: "Ingress"},
+			},
+		},
+	}
+	c := &Client{discovery: memory.NewMemCacheClient(clientset.Discovery())}
+
+	got := c.filterPruneWhitelist([]string{
+		"apps/v1/Deployment",
+		"apps/v1/StatefulSet",
+		"core/v1/ConfigMap",
+		"core/v1/Pod",
+		"core/v1/Secret",
+		"networking.k8s.io/v1beta1/Ingress",
+		"networking.k8s.io/v1/Ingress",
+		"Ingress",
+	})
+	want := []string{
+		"apps/v1/Deployment",
+		"core/v1/ConfigMap",
+		"core/v1/Secret",
+		"networking.k8s.io/v1/Ingress",
+	}
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestPruneArgs(t *testing.T) {
+	log.InitLogger("info")
+
+	clientset := fake.NewSimpleClientset()
+	clientset.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{
+		{
+			GroupVersion: "apps/v1",
+			APIResources: []metav1.APIResource{
+				{Name: "deployments", Kind: "Deployment"},
+			},
+		},
+	}
+	c := &Client{
+		PruneWhitelist: []string{"apps/v1/Deployment", "apps/v1/StatefulSet"},
+		discovery:      memory.NewMemCacheClient(clientset.Discovery()),
+	}
+
+	want := []string{"--prune", "--all", "--prune-whitelist=apps/v1/Deployment"}
+	if diff := deep.Equal(c.pruneArgs("foo", nil), want); diff != nil {
+		t.Error(diff)
+	}
+
+	// Without any served kind, nothing is pruned rather than the kubectl defaults
+	if got := c.pruneArgs("foo", []string{"apps/v1/StatefulSet", "batch/v1/Job"}); got != nil {
+		t.Errorf("expected no prune flags, got %v", got)
+	}
+}
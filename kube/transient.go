@@ -0,0 +1,70 @@
+package kube
+
+import (
+	"strings"
+
+	"github.com/utilitywarehouse/kube-applier/kubectl"
+)
+
+// Prefixes of the lines kubectl starts its errors with. The rest of the error
+// may span the following lines, eg. the patch of a conflicting update.
+var errorPrefixes = []string{
+	"error:",
+	"Error from server",
+	"Unable to connect to the server",
+	"The connection to the server",
+}
+
+// Messages in the output of kubectl that indicate a failure caused by the API
+// server being temporarily unavailable or overloaded, or by a concurrent
+// update of an object, rather than by the applied files.
+var transientErrors = []string{
+	// The connection to the server 10.0.0.1:443 was refused - did you specify the right host or port?
+	"was refused - did you specify the right host or port",
+	"connect: connection refused",
+	"connection reset by peer",
+	"i/o timeout",
+	"TLS handshake timeout",
+	"http2: client connection lost",
+	"http2: server sent GOAWAY",
+	"unexpected EOF",
+	"etcdserver: request timed out",
+	"etcdserver: leader changed",
+	"Timeout: request did not complete within requested timeout",
+	"the server is currently unable to handle the request",
+	"the server has received too many requests",
+	// Operation cannot be fulfilled on deployments.apps "foo": the object has been modified; please apply your changes to the latest version and try again
+	"the object has been modified",
+}
+
+// IsTransient returns true if the output of a failed kubectl command reports
+// an error that is expected to go away on its own, so that the command can be
+// retried. Only the errors printed by kubectl are considered, from the first
+// one onwards, and only if no object was applied successfully.
+func IsTransient(output string) bool {
+	for _, r := range kubectl.ParseApplyOutput(output, "") {
+		if r.Action != kubectl.ActionError {
+			return false
+		}
+	}
+	errors := errorOutput(output)
+	for _, e := range transientErrors {
+		if strings.Contains(errors, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// errorOutput returns the output of kubectl from the first error line.
+func errorOutput(output string) string {
+	lines := strings.Split(output, "\n")
+	for i, line := range lines {
+		for _, p := range errorPrefixes {
+			if strings.HasPrefix(strings.TrimSpace(line), p) {
+				return strings.Join(lines[i:], "\n")
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,29 @@
+package kube
+
+import (
+	"testing"
+)
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		output    string
+		transient bool
+	}{
+		{"The connection to the server 10.0.0.1:443 was refused - did you specify the right host or port?", true},
+		{"Unable to connect to the server: dial tcp 10.0.0.1:443: i/o timeout", true},
+		{"Error from server: error when creating \"ns/deployment.yaml\": etcdserver: request timed out", true},
+		{"Error from server (Conflict): error when applying patch:\nOperation cannot be fulfilled on deployments.apps \"foo\": the object has been modified; please apply your changes to the latest version and try again", true},
+		{"deployment.apps/foo configured\nerror: error validating \"ns/service.yaml\": error validating data: ValidationError(Service.spec): unknown field \"foo\"", false},
+		{"error: Apply failed with 1 conflict: conflict with \"helm\" using apps/v1: .spec.replicas", false},
+		// Errors that are not printed by kubectl, or after a successful apply of some of the objects
+		{"Warning: the server is currently unable to handle the request\nerror: error validating \"ns/service.yaml\": unknown field \"foo\"", false},
+		{"deployment.apps/foo configured\nError from server: error when creating \"ns/service.yaml\": etcdserver: request timed out", false},
+		{"Error from server (Conflict): error when applying patch:\n{\"spec\":{\"replicas\":2}}\nto:\nResource: \"apps/v1, Resource=deployments\"\nfor: \"ns/deployment.yaml\": Operation cannot be fulfilled on deployments.apps \"foo\": the object has been modified; please apply your changes to the latest version and try again", true},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := IsTransient(test.output); got != test.transient {
+			t.Errorf("IsTransient(%q) = %t, expected %t", test.output, got, test.transient)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Package kubectl parses the output of kubectl commands.
+package kubectl
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Actions reported for the objects in the output of kubectl apply. Other
+// actions printed by kubectl, eg. serverside-applied, are kept as they are.
+const (
+	ActionCreated    = "created"
+	ActionConfigured = "configured"
+	ActionUnchanged  = "unchanged"
+	ActionPruned     = "pruned"
+	ActionError      = "error"
+)
+
+var (
+	// Matches the line printed for each object, eg:
+	// deployment.apps/name configured (server dry run)
+	objectRegex = regexp.MustCompile(`^([^/\s]+)/(\S+) (\S+)(?: \((?:server )?dry run\))?$`)
+	// Matches the errors printed by kubectl, eg:
+	// Error from server (NotFound): error when creating "foo.yaml": ...
+	errorRegex = regexp.MustCompile(`^(?:error|Error from server)`)
+)
+
+// ObjectResult is the outcome of an apply for a single object. Kind is the
+// lowercase resource name printed by kubectl and Group is empty for the core
+// API group. Namespace is the namespace that was applied. Results with the
+// error action only have a Message.
+type ObjectResult struct {
+	Group     string `json:"group"`
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Action    string `json:"action"`
+	Message   string `json:"message,omitempty"`
+}
+
+// Type returns the object type as printed by kubectl, eg. deployment.apps
+func (r ObjectResult) Type() string {
+	if r.Group == "" {
+		return r.Kind
+	}
+	return r.Kind + "." + r.Group
+}
+
+// ParseApplyOutput returns a result for each object and each error reported
+// in the output of kubectl apply for namespace. Lines that are neither, eg.
+// warnings, are ignored.
+func ParseApplyOutput(output, namespace string) []ObjectResult {
+	var results []ObjectResult
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if errorRegex.MatchString(line) {
+			results = append(results, ObjectResult{
+				Namespace: namespace,
+				Action:    ActionError,
+				Message:   line,
+			})
+			continue
+		}
+		m := objectRegex.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		r := ObjectResult{
+			Kind:      m[1],
+			Name:      m[2],
+			Namespace: namespace,
+			Action:    m[3],
+		}
+		if i := strings.Index(m[1], "."); i != -1 {
+			r.Kind, r.Group = m[1][:i], m[1][i+1:]
+		}
+		results = append(results, r)
+	}
+	return results
+}
@@ -0,0 +1,76 @@
+package kubectl
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestParseApplyOutput(t *testing.T) {
+	output := `namespace/namespaceName configured
+limitrange/limit-range created
+role.rbac.authorization.k8s.io/auth unchanged
+rolebinding.rbac.authorization.k8s.io/rolebinding unchanged
+serviceaccount/account unchanged
+networkpolicy.networking.k8s.io/default unchanged
+service/serviceName serverside-applied
+deployment.apps/deploymentName unchanged
+configmap/old pruned`
+
+	want := []ObjectResult{
+		{"", "namespace", "namespaceName", "ns", "configured", ""},
+		{"", "limitrange", "limit-range", "ns", "created", ""},
+		{"rbac.authorization.k8s.io", "role", "auth", "ns", "unchanged", ""},
+		{"rbac.authorization.k8s.io", "rolebinding", "rolebinding", "ns", "unchanged", ""},
+		{"", "serviceaccount", "account", "ns", "unchanged", ""},
+		{"networking.k8s.io", "networkpolicy", "default", "ns", "unchanged", ""},
+		{"", "service", "serviceName", "ns", "serverside-applied", ""},
+		{"apps", "deployment", "deploymentName", "ns", "unchanged", ""},
+		{"", "configmap", "old", "ns", "pruned", ""},
+	}
+
+	got := ParseApplyOutput(output, "ns")
+
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestParseApplyOutputServerDryRun(t *testing.T) {
+	output := `namespace/namespaceName configured (server dry run)
+service/serviceName configured (server dry run)
+deployment.apps/deploymentName configured (dry run)
+configmap/old pruned (server dry run)`
+
+	want := []ObjectResult{
+		{"", "namespace", "namespaceName", "ns", "configured", ""},
+		{"", "service", "serviceName", "ns", "configured", ""},
+		{"apps", "deployment", "deploymentName", "ns", "configured", ""},
+		{"", "configmap", "old", "ns", "pruned", ""},
+	}
+
+	got := ParseApplyOutput(output, "ns")
+
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestParseApplyOutputErrors(t *testing.T) {
+	output := `service/serviceName unchanged
+Warning: kubectl apply should be used on resource created by either kubectl create --save-config or kubectl apply
+Error from server (NotFound): error when creating "ns/cm.yaml": namespaces "other" not found
+error: unable to recognize "ns/crd.yaml": no matches for kind "Foo" in version "example.com/v1"`
+
+	want := []ObjectResult{
+		{"", "service", "serviceName", "ns", "unchanged", ""},
+		{"", "", "", "ns", "error", `Error from server (NotFound): error when creating "ns/cm.yaml": namespaces "other" not found`},
+		{"", "", "", "ns", "error", `error: unable to recognize "ns/crd.yaml": no matches for kind "Foo" in version "example.com/v1"`},
+	}
+
+	got := ParseApplyOutput(output, "ns")
+
+	if diff := deep.Equal(got, want); diff != nil {
+		t.Error(diff)
+	}
+}
@@ -1,190 +1,357 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"os"
-	"strconv"
-	"strings"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/utilitywarehouse/kube-applier/config"
 	"github.com/utilitywarehouse/kube-applier/git"
 	"github.com/utilitywarehouse/kube-applier/kube"
 	"github.com/utilitywarehouse/kube-applier/log"
 	"github.com/utilitywarehouse/kube-applier/metrics"
+	"github.com/utilitywarehouse/kube-applier/notify"
 	"github.com/utilitywarehouse/kube-applier/run"
 	"github.com/utilitywarehouse/kube-applier/sysutil"
 	"github.com/utilitywarehouse/kube-applier/webserver"
+
+	hclog "github.com/hashicorp/go-hclog"
 )
 
 const (
 	// Number of seconds to wait in between attempts to locate the repo at the specified path.
 	// Git-sync atomically places the repo at the specified path once it is finished pulling, so it will not be present immediately.
 	waitForRepoInterval = 1 * time.Second
+	// Interval between checks for changes to the configuration file.
+	configReloadInterval = 10 * time.Second
+	// Maximum time to wait on shutdown for the leader election Lease to be released.
+	leaderReleaseTimeout = 10 * time.Second
 )
 
-var (
-	repoPath        = os.Getenv("REPO_PATH")
-	repoPathFilters = os.Getenv("REPO_PATH_FILTERS")
-	listenPort      = os.Getenv("LISTEN_PORT")
-	pollInterval    = os.Getenv("POLL_INTERVAL_SECONDS")
-	fullRunInterval = os.Getenv("FULL_RUN_INTERVAL_SECONDS")
-	dryRun          = os.Getenv("DRY_RUN")
-	logLevel        = os.Getenv("LOG_LEVEL")
+func main() {
+	configWatcher := &config.Watcher{
+		Args:       os.Args[1:],
+		Interval:   configReloadInterval,
+		Reloadable: reloadableSettings,
+	}
+	err := configWatcher.Load()
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	cfg := configWatcher.Current()
 
-	// kube server. Mainly for local testing.
-	server = os.Getenv("SERVER")
+	log.InitLogger(cfg.LogLevel)
 
-	// Github commit diff url
-	diffURLFormat = os.Getenv("DIFF_URL_FORMAT")
-)
+	metrics := &metrics.Prometheus{}
+	metrics.Init()
 
-func validate() {
-	if repoPath == "" {
-		fmt.Println("Need to export REPO_PATH")
-		os.Exit(1)
+	clock := &sysutil.Clock{}
+
+	util := git.Util{
+		RepoPath:           cfg.RepoPath,
+		GPGHome:            cfg.Git.GPGHome,
+		AllowedSignersPath: cfg.Git.AllowedSignersPath,
 	}
+	var gitUtil git.UtilInterface = &util
 
-	if listenPort == "" {
-		listenPort = "8080"
-	} else {
-		_, err := strconv.Atoi(listenPort)
-		if err != nil {
-			fmt.Println("LISTEN_PORT must be an int")
+	var gitSyncer *git.Syncer
+	if cfg.Git.RepoURL != "" {
+		gitSyncer = &git.Syncer{
+			Util:           util,
+			RepoURL:        cfg.Git.RepoURL,
+			Branch:         cfg.Git.Branch,
+			Dir:            cfg.Git.Dir,
+			Interval:       seconds(cfg.Git.SyncIntervalSeconds),
+			SSHKeyPath:     cfg.Git.SSHKeyPath,
+			KnownHostsPath: cfg.Git.KnownHostsPath,
+			Username:       cfg.Git.HTTPSUsername,
+			Password:       cfg.Git.HTTPSPassword,
+		}
+		if err := gitSyncer.Sync(); err != nil {
+			log.Logger.Error("Initial git sync failed", "error", err)
 			os.Exit(1)
 		}
+		gitUtil = gitSyncer
 	}
 
-	if diffURLFormat != "" && !strings.Contains(diffURLFormat, "%s") {
-		fmt.Printf("Invalid DIFF_URL_FORMAT, must contain %q: %v\n", "%s", diffURLFormat)
+	if err := sysutil.WaitForDir(cfg.RepoPath, clock, waitForRepoInterval); err != nil {
+		log.Logger.Error("error", err)
 		os.Exit(1)
 	}
+	// The worktrees of rollbacks that were in progress when kube-applier stopped are left behind
+	if err := util.PruneWorktrees(); err != nil {
+		log.Logger.Warn("Could not prune stale worktrees", "error", err)
+	}
 
-	if pollInterval == "" {
-		pollInterval = "5"
-	} else {
-		_, err := strconv.Atoi(pollInterval)
+	var pw []string
+	if cfg.Apply.PruneWhitelistFile != "" {
+		pw, err = kube.LoadPruneWhitelist(cfg.Apply.PruneWhitelistFile)
 		if err != nil {
-			fmt.Println("POLL_INTERVAL_SECONDS must be an int")
+			log.Logger.Error("Could not load prune whitelist", "error", err)
 			os.Exit(1)
 		}
 	}
 
-	if fullRunInterval == "" {
-		fullRunInterval = "3600"
-	} else {
-		_, err := strconv.Atoi(fullRunInterval)
+	var webhooks []notify.Webhook
+	for _, u := range cfg.Notify.SlackWebhookURLs {
+		webhooks = append(webhooks, &notify.SlackWebhook{URL: u})
+	}
+	for _, u := range cfg.Notify.WebhookURLs {
+		webhooks = append(webhooks, &notify.JSONWebhook{URL: u})
+	}
+
+	// Runner, webserver, and scheduler all send fatal errors to errors channel, and main() shuts down upon receiving an
+	// error. No limit needed, as a single fatal error will exit the program anyway.
+	errors := make(chan error)
+
+	// Without a clusters section, kube-applier applies the whole repository to a single, unnamed, cluster.
+	clusterConfigs := cfg.Clusters
+	if len(clusterConfigs) == 0 {
+		clusterConfigs = []config.ClusterConfig{{}}
+	}
+	var clusters []*cluster
+	for _, cc := range clusterConfigs {
+		c, err := newCluster(cfg, cc, util, gitUtil, metrics, clock, pw, webhooks, errors)
 		if err != nil {
-			fmt.Println("FULL_RUN_INTERVAL_SECONDS must be an int")
+			log.Logger.Error("Could not load run history", "cluster", cc.Name, "error", err)
 			os.Exit(1)
 		}
+		clusters = append(clusters, c)
 	}
 
-	if dryRun == "" {
-		dryRun = "false"
-	} else {
-		_, err := strconv.ParseBool(dryRun)
-		if err != nil {
-			fmt.Println("DRY_RUN must be a boolean")
+	// Cancelled on SIGTERM or a fatal error, to stop every component. The run in progress stops after the namespaces
+	// being applied and its results are stored before the webserver shuts down.
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	// Changes to the kube-applier annotations of a namespace queue a run for that namespace straight away,
+	// rather than waiting for the next commit or full run.
+	for _, c := range clusters {
+		c := c
+		log.Logger.Info("Waiting for the namespace cache to sync", "cluster", c.name)
+		if err := c.kubeClient.WatchNamespaces(ctx.Done(), func(namespace string) {
+			c.queue(run.Request{Type: run.NamespaceRun, Namespace: namespace})
+		}); err != nil {
+			log.Logger.Error("Could not watch namespaces", "cluster", c.name, "error", err)
 			os.Exit(1)
 		}
 	}
 
-	// log level [trace|debug|info|warn|error] case insensitive
-	if logLevel == "" {
-		logLevel = "warn"
+	// With leader election, only the leader applies and followers forward requests to it. A new leader queues a
+	// full run, as it does not know what its predecessor applied. With several clusters, the Lease is kept in the
+	// cluster kube-applier runs in. The elector has its own context, cancelled once the runners have stopped on
+	// shutdown, so that the Lease is not released while a run is still applying.
+	var leader kube.LeaderElectorInterface
+	leaderCtx, releaseLeader := context.WithCancel(context.Background())
+	leaderDone := make(chan struct{})
+	if cfg.LeaderElection.Enabled {
+		leaderClient := clusters[0].kubeClient
+		if len(cfg.Clusters) > 0 {
+			leaderClient = &kube.Client{Metrics: metrics}
+			if err := leaderClient.Configure(); err != nil {
+				log.Logger.Error("Could not configure the client for leader election", "error", err)
+				os.Exit(1)
+			}
+		}
+		namespace := cfg.LeaderElection.Namespace
+		if namespace == "" {
+			namespace, err = kube.PodNamespace()
+			if err != nil {
+				log.Logger.Error("Could not get the namespace for leader election, set LEADER_ELECTION_NAMESPACE", "error", err)
+				os.Exit(1)
+			}
+		}
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Logger.Error("Could not get the hostname for leader election", "error", err)
+			os.Exit(1)
+		}
+		elector := &kube.LeaderElector{
+			Client:    leaderClient,
+			Namespace: namespace,
+			LeaseName: cfg.LeaderElection.LeaseName,
+			Identity:  hostname,
+			OnStartedLeading: func() {
+				for _, c := range clusters {
+					c.queue(run.Request{Type: run.FullRun})
+				}
+			},
+		}
+		go func() {
+			defer close(leaderDone)
+			if err := elector.Run(leaderCtx); err != nil {
+				errors <- err
+			}
+		}()
+		leader = elector
+	} else {
+		close(leaderDone)
 	}
-}
-
-func main() {
-	validate()
-
-	log.InitLogger(logLevel)
-
-	metrics := &metrics.Prometheus{}
-	metrics.Init()
-
-	clock := &sysutil.Clock{}
 
-	if err := sysutil.WaitForDir(repoPath, clock, waitForRepoInterval); err != nil {
-		log.Logger.Error("error", err)
-		os.Exit(1)
+	var webserverClusters []webserver.Cluster
+	for _, c := range clusters {
+		c.runner.Leader = leader
+		if gitSyncer != nil {
+			c.runner.RepoLock = gitSyncer.ReadLocker()
+		}
+		webserverClusters = append(webserverClusters, c.webserverCluster())
 	}
 
-	kubeClient := &kube.Client{
-		Server:  server,
-		Metrics: metrics,
+	webserver := &webserver.WebServer{
+		ListenPort:         cfg.ListenPort,
+		Clock:              clock,
+		Clusters:           webserverClusters,
+		GitUtil:            gitUtil,
+		GitSyncer:          gitSyncer,
+		WebhookSecret:      cfg.Webhook.Secret,
+		WebhookBranch:      cfg.Git.Branch,
+		RunInterval:        seconds(cfg.FullRunIntervalSeconds),
+		MaxMissedIntervals: cfg.Health.MaxMissedIntervals,
+		Config:             configWatcher.Current,
+		Leader:             leader,
+		Errors:             errors,
 	}
 
-	if err := kubeClient.Configure(); err != nil {
-		log.Logger.Error("kubectl configuration failed", "error", err)
+	// Changes to the configuration file are applied to the components that support it, see reconfigure.
+	configWatcher.OnChange = func(old, new *config.Config) {
+		reconfigure(old, new, clusters, webserver)
 	}
 
-	dr, _ := strconv.ParseBool(dryRun)
-	batchApplier := &run.BatchApplier{
-		KubeClient: kubeClient,
-		DryRun:     dr,
-		Metrics:    metrics,
+	go configWatcher.Start(ctx)
+	if gitSyncer != nil {
+		go gitSyncer.Start(ctx)
 	}
-
-	gitUtil := &git.Util{
-		RepoPath: repoPath,
+	var runners sync.WaitGroup
+	for _, c := range clusters {
+		c := c
+		go c.scheduler.Start(ctx)
+		go c.notifier.Start()
+		runners.Add(1)
+		go func() {
+			defer runners.Done()
+			c.runner.Start(ctx)
+		}()
 	}
+	go func() {
+		runners.Wait()
+		releaseLeader()
+	}()
+	done := make(chan struct{})
+	go func() {
+		webserver.Start(ctx)
+		close(done)
+	}()
 
-	// Webserver and scheduler send run requests to runQueue channel, runner receives the requests and initiates runs.
-	// Only 1 pending request may sit in the queue at a time.
-	runQueue := make(chan bool, 1)
-
-	// Runner sends run results to runResults channel, webserver receives the results and displays them.
-	// Limit of 5 is arbitrary - there is significant delay between sends, and receives are handled near instantaneously.
-	runResults := make(chan run.Result, 5)
+	exitCode := 0
+	select {
+	case err := <-errors:
+		log.Logger.Error("Fatal error, shutting down", "error", err)
+		exitCode = 1
+	case sig := <-signals:
+		log.Logger.Info("Received signal, shutting down", "signal", sig)
+	}
+	cancel()
+	// The Lease is released once the runners have stopped, which is waited for after the webserver shut down, for
+	// at most leaderReleaseTimeout.
+	var leaderTimeout <-chan time.Time
+	for done != nil || leaderDone != nil {
+		select {
+		case err := <-errors:
+			log.Logger.Error("Error while shutting down", "error", err)
+			exitCode = 1
+		case <-done:
+			done = nil
+			leaderTimeout = time.After(leaderReleaseTimeout)
+		case <-leaderDone:
+			leaderDone = nil
+		case <-leaderTimeout:
+			log.Logger.Warn("Timed out waiting for the leader election to stop")
+			leaderDone = nil
+		}
+	}
+	log.Logger.Info("Shutdown complete")
+	os.Exit(exitCode)
+}
 
-	// Runner, webserver, and scheduler all send fatal errors to errors channel, and main() exits upon receiving an error.
-	// No limit needed, as a single fatal error will exit the program anyway.
-	errors := make(chan error)
+// Settings applied by reconfigure, changes to the others require a restart.
+var reloadableSettings = map[string]bool{
+	"logLevel":                  true,
+	"repoPathFilters":           true,
+	"pollIntervalSeconds":       true,
+	"fullRunIntervalSeconds":    true,
+	"shutdownTimeoutSeconds":    true,
+	"apply.dryRun":              true,
+	"apply.diff":                true,
+	"apply.serverSide":          true,
+	"apply.workers":             true,
+	"apply.timeoutSeconds":      true,
+	"apply.retries":             true,
+	"apply.retryBackoffSeconds": true,
+}
 
-	var repoPathFiltersSlice []string
-	if repoPathFilters != "" {
-		repoPathFiltersSlice = strings.Split(repoPathFilters, ",")
+// reconfigure logs the settings changed by a configuration reload and applies
+// them to the running components of every cluster. A full run is queued when
+// the filters change, to apply the namespaces that they added.
+func reconfigure(old, new *config.Config, clusters []*cluster, ws *webserver.WebServer) {
+	changes := config.Changes(old, new)
+	if len(changes) == 0 {
+		log.Logger.Info("Configuration reloaded, no changes")
+		return
 	}
-
-	runner := &run.Runner{
-		RepoPath:        repoPath,
-		RepoPathFilters: repoPathFiltersSlice,
-		BatchApplier:    batchApplier,
-		GitUtil:         gitUtil,
-		Clock:           clock,
-		Metrics:         metrics,
-		DiffURLFormat:   diffURLFormat,
-		RunQueue:        runQueue,
-		RunResults:      runResults,
-		Errors:          errors,
+	changed := make(map[string]bool)
+	for _, c := range changes {
+		changed[c.Key] = true
+		if reloadableSettings[c.Key] {
+			log.Logger.Info("Configuration changed", "setting", c.Key, "old", c.Old, "new", c.New)
+		} else {
+			log.Logger.Warn("Configuration changed, restart to apply it", "setting", c.Key, "old", c.Old, "new", c.New)
+		}
 	}
 
-	pi, _ := strconv.Atoi(pollInterval)
-	fi, _ := strconv.Atoi(fullRunInterval)
-	scheduler := &run.Scheduler{
-		GitUtil:         gitUtil,
-		PollInterval:    time.Duration(pi) * time.Second,
-		FullRunInterval: time.Duration(fi) * time.Second,
-		RepoPathFilters: repoPathFiltersSlice,
-		RunQueue:        runQueue,
-		Errors:          errors,
+	if changed["logLevel"] {
+		log.Logger.SetLevel(hclog.LevelFromString(new.LogLevel))
 	}
-
-	lp, _ := strconv.Atoi(listenPort)
-	webserver := &webserver.WebServer{
-		ListenPort: lp,
-		Clock:      clock,
-		RunQueue:   runQueue,
-		RunResults: runResults,
-		Errors:     errors,
+	if changed["fullRunIntervalSeconds"] {
+		ws.UpdateRunInterval(seconds(new.FullRunIntervalSeconds))
 	}
+	for _, c := range clusters {
+		if changed["repoPathFilters"] || changed["pollIntervalSeconds"] || changed["fullRunIntervalSeconds"] {
+			c.scheduler.Update(func(s *run.Scheduler) {
+				s.PollInterval = seconds(new.PollIntervalSeconds)
+				s.FullRunInterval = seconds(new.FullRunIntervalSeconds)
+				s.RepoPathFilters = new.RepoPathFilters
+			})
+		}
+		c.runner.Update(func(r *run.Runner) {
+			r.RepoPathFilters = new.RepoPathFilters
+		})
+		c.batchApplier.Update(func(a *run.BatchApplier) {
+			a.DryRun = new.Apply.DryRun
+			a.Diff = new.Apply.Diff
+			a.ServerSide = new.Apply.ServerSide
+			a.Workers = new.Apply.Workers
+			a.Timeout = seconds(new.Apply.TimeoutSeconds)
+			a.Retries = new.Apply.Retries
+			a.RetryBackoff = seconds(new.Apply.RetryBackoffSeconds)
+			a.ShutdownTimeout = seconds(new.ShutdownTimeoutSeconds)
+		})
+		if changed["repoPathFilters"] {
+			c.queue(run.Request{Type: run.FullRun})
+		}
+	}
+}
 
-	go scheduler.Start()
-	go runner.Start()
-	go webserver.Start()
-
-	err := <-errors
-	log.Logger.Error("Fatal error, exiting", "error", err)
-	os.Exit(1)
+// seconds converts a number of seconds from the configuration to a Duration.
+func seconds(s int) time.Duration {
+	return time.Duration(s) * time.Second
 }
@@ -6,6 +6,7 @@ package metrics
 
 import (
 	gomock "github.com/golang/mock/gomock"
+	kubectl "github.com/utilitywarehouse/kube-applier/kubectl"
 	reflect "reflect"
 )
 
@@ -62,8 +63,28 @@ func (mr *MockPrometheusInterfaceMockRecorder) UpdateRunLatency(arg0, arg1 inter
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateRunLatency", reflect.TypeOf((*MockPrometheusInterface)(nil).UpdateRunLatency), arg0, arg1)
 }
 
+// UpdateApplyTimeoutCount mocks base method
+func (m *MockPrometheusInterface) UpdateApplyTimeoutCount(arg0 string) {
+	m.ctrl.Call(m, "UpdateApplyTimeoutCount", arg0)
+}
+
+// UpdateApplyTimeoutCount indicates an expected call of UpdateApplyTimeoutCount
+func (mr *MockPrometheusInterfaceMockRecorder) UpdateApplyTimeoutCount(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateApplyTimeoutCount", reflect.TypeOf((*MockPrometheusInterface)(nil).UpdateApplyTimeoutCount), arg0)
+}
+
+// UpdateApplyRetryCount mocks base method
+func (m *MockPrometheusInterface) UpdateApplyRetryCount(arg0 string) {
+	m.ctrl.Call(m, "UpdateApplyRetryCount", arg0)
+}
+
+// UpdateApplyRetryCount indicates an expected call of UpdateApplyRetryCount
+func (mr *MockPrometheusInterfaceMockRecorder) UpdateApplyRetryCount(arg0 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateApplyRetryCount", reflect.TypeOf((*MockPrometheusInterface)(nil).UpdateApplyRetryCount), arg0)
+}
+
 // UpdateResultSummary mocks base method
-func (m *MockPrometheusInterface) UpdateResultSummary(arg0 map[string]string) {
+func (m *MockPrometheusInterface) UpdateResultSummary(arg0 map[string][]kubectl.ObjectResult) {
 	m.ctrl.Call(m, "UpdateResultSummary", arg0)
 }
 
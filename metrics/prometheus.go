@@ -3,28 +3,46 @@ package metrics
 import (
 	"path/filepath"
 	"strconv"
-	"strings"
+	"sync"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/utilitywarehouse/kube-applier/kubectl"
 )
 
 // PrometheusInterface allows for mocking out the functionality of Prometheus when testing the full process of an apply run.
 type PrometheusInterface interface {
 	UpdateKubectlExitCodeCount(string, int)
+	UpdateApplyTimeoutCount(string)
+	UpdateApplyRetryCount(string)
 	UpdateNamespaceSuccess(string, bool)
 	UpdateRunLatency(float64, bool)
-	UpdateResultSummary(map[string]string)
+	UpdateResultSummary(map[string][]kubectl.ObjectResult)
 }
 
 // Prometheus implements instrumentation of metrics for kube-applier.
 // kubectlExitCodeCount is a Counter vector to increment the number of exit codes for each kubectl execution
+// applyTimeoutCount is a Counter vector to increment the number of applies that were killed for exceeding their timeout
+// applyRetryCount is a Counter vector to increment the number of applies that were retried after a transient failure
 // fileApplyCount is a Counter vector to increment the number of successful and failed apply attempts for each file in the repo.
 // runLatency is a Summary vector that keeps track of the duration for apply runs.
+// Every metric has a cluster label, set by the Prometheus returned by ForCluster and empty otherwise.
 type Prometheus struct {
+	cluster              string
 	kubectlExitCodeCount *prometheus.CounterVec
+	applyTimeoutCount    *prometheus.CounterVec
+	applyRetryCount      *prometheus.CounterVec
 	namespaceApplyCount  *prometheus.CounterVec
 	runLatency           *prometheus.HistogramVec
 	resultSummary        *prometheus.GaugeVec
+	resultSummarySeries  *clusterSeries
+}
+
+// clusterSeries keeps the label sets of the series set for each namespace of
+// each cluster, so that the series of a namespace can be replaced without
+// affecting the others.
+type clusterSeries struct {
+	mutex  sync.Mutex
+	labels map[string]map[string][]prometheus.Labels
 }
 
 // Init creates and registers the custom metrics for kube-applier.
@@ -38,6 +56,30 @@ func (p *Prometheus) Init() {
 			"namespace",
 			// Exit code
 			"exit_code",
+			// Name of the cluster
+			"cluster",
+		},
+	)
+	p.applyTimeoutCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kubectl_apply_timeout_count",
+		Help: "Count of kubectl applies killed for exceeding the apply timeout",
+	},
+		[]string{
+			// Path of the file that was applied
+			"namespace",
+			// Name of the cluster
+			"cluster",
+		},
+	)
+	p.applyRetryCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kubectl_apply_retry_count",
+		Help: "Count of kubectl applies retried after a transient failure",
+	},
+		[]string{
+			// Path of the file that was applied
+			"namespace",
+			// Name of the cluster
+			"cluster",
 		},
 	)
 	p.namespaceApplyCount = prometheus.NewCounterVec(prometheus.CounterOpts{
@@ -49,6 +91,8 @@ func (p *Prometheus) Init() {
 			"namespace",
 			// Result: true if the apply was successful, false otherwise
 			"success",
+			// Name of the cluster
+			"cluster",
 		},
 	)
 	p.runLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
@@ -58,6 +102,8 @@ func (p *Prometheus) Init() {
 		[]string{
 			// Result: true if the run was successful, false otherwise
 			"success",
+			// Name of the cluster
+			"cluster",
 		},
 	)
 	p.resultSummary = prometheus.NewGaugeVec(prometheus.GaugeOpts{
@@ -73,26 +119,56 @@ func (p *Prometheus) Init() {
 			"name",
 			// The applied action
 			"action",
+			// Name of the cluster
+			"cluster",
 		},
 	)
+	p.resultSummarySeries = &clusterSeries{labels: make(map[string]map[string][]prometheus.Labels)}
 	prometheus.MustRegister(p.kubectlExitCodeCount)
+	prometheus.MustRegister(p.applyTimeoutCount)
+	prometheus.MustRegister(p.applyRetryCount)
 	prometheus.MustRegister(p.resultSummary)
 	prometheus.MustRegister(p.namespaceApplyCount)
 	prometheus.MustRegister(p.runLatency)
 }
 
+// ForCluster returns a Prometheus sharing the metrics of p, which sets their
+// cluster label to name.
+func (p *Prometheus) ForCluster(name string) *Prometheus {
+	c := *p
+	c.cluster = name
+	return &c
+}
+
 // UpdateKubectlExitCodeCount increments for each exit code returned by kubectl
 func (p *Prometheus) UpdateKubectlExitCodeCount(file string, code int) {
 	p.kubectlExitCodeCount.With(prometheus.Labels{
 		"namespace": filepath.Base(file),
 		"exit_code": strconv.Itoa(code),
+		"cluster":   p.cluster,
+	}).Inc()
+}
+
+// UpdateApplyTimeoutCount increments for each apply that timed out
+func (p *Prometheus) UpdateApplyTimeoutCount(file string) {
+	p.applyTimeoutCount.With(prometheus.Labels{
+		"namespace": filepath.Base(file),
+		"cluster":   p.cluster,
+	}).Inc()
+}
+
+// UpdateApplyRetryCount increments for each retry of an apply after a transient failure
+func (p *Prometheus) UpdateApplyRetryCount(file string) {
+	p.applyRetryCount.With(prometheus.Labels{
+		"namespace": filepath.Base(file),
+		"cluster":   p.cluster,
 	}).Inc()
 }
 
 // UpdateNamespaceSuccess increments the given namespace's Counter for either successful apply attempts or failed apply attempts.
 func (p *Prometheus) UpdateNamespaceSuccess(file string, success bool) {
 	p.namespaceApplyCount.With(prometheus.Labels{
-		"namespace": filepath.Base(file), "success": strconv.FormatBool(success),
+		"namespace": filepath.Base(file), "success": strconv.FormatBool(success), "cluster": p.cluster,
 	}).Inc()
 }
 
@@ -100,48 +176,42 @@ func (p *Prometheus) UpdateNamespaceSuccess(file string, success bool) {
 func (p *Prometheus) UpdateRunLatency(runLatency float64, success bool) {
 	p.runLatency.With(prometheus.Labels{
 		"success": strconv.FormatBool(success),
+		"cluster": p.cluster,
 	}).Observe(runLatency)
 }
 
-// UpdateResultSummary sets gauges for each deployment
-func (p *Prometheus) UpdateResultSummary(failures map[string]string) {
-	p.resultSummary.Reset()
+// UpdateResultSummary sets gauges for each object applied, from the results of each file path, replacing the ones set
+// previously for the same namespaces of the cluster. The namespaces left out of a partial run keep their series.
+// Errors are not tied to an object and are left out.
+func (p *Prometheus) UpdateResultSummary(results map[string][]kubectl.ObjectResult) {
+	p.resultSummarySeries.mutex.Lock()
+	defer p.resultSummarySeries.mutex.Unlock()
+	namespaces, ok := p.resultSummarySeries.labels[p.cluster]
+	if !ok {
+		namespaces = make(map[string][]prometheus.Labels)
+		p.resultSummarySeries.labels[p.cluster] = namespaces
+	}
 
-	for filePath, output := range failures {
-		res := parseKubectlOutput(output)
+	for filePath, res := range results {
+		namespace := filepath.Base(filePath)
+		for _, labels := range namespaces[namespace] {
+			p.resultSummary.Delete(labels)
+		}
+		var series []prometheus.Labels
 		for _, r := range res {
-			p.resultSummary.With(prometheus.Labels{
-				"namespace": filepath.Base(filePath),
-				"type":      r.Type,
+			if r.Action == kubectl.ActionError {
+				continue
+			}
+			labels := prometheus.Labels{
+				"namespace": namespace,
+				"type":      r.Type(),
 				"name":      r.Name,
 				"action":    r.Action,
-			}).Set(1)
+				"cluster":   p.cluster,
+			}
+			p.resultSummary.With(labels).Set(1)
+			series = append(series, labels)
 		}
+		namespaces[namespace] = series
 	}
 }
-
-// Result struct containing Type, Name and Action
-type Result struct {
-	Type, Name, Action string
-}
-
-func parseKubectlOutput(output string) []Result {
-	lines := strings.Split(output, "\n")
-
-	var results []Result
-	for _, line := range lines {
-		o := strings.Split(line, " ")
-		if len(o) < 2 {
-			continue
-		}
-
-		os := strings.Split(o[0], "/")
-		results = append(results, Result{
-			Type:   os[0],
-			Name:   os[1],
-			Action: o[1],
-		})
-	}
-
-	return results
-}
@@ -3,61 +3,57 @@ package metrics
 import (
 	"testing"
 
-	"github.com/go-test/deep"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/utilitywarehouse/kube-applier/kubectl"
 )
 
-func TestParseKubectlOutput(t *testing.T) {
-	output := `namespace/namespaceName configured
-limitrange/limit-range configured
-role.rbac.authorization.k8s.io/auth unchanged
-rolebinding.rbac.authorization.k8s.io/rolebinding unchanged
-serviceaccount/account unchanged
-networkpolicy.networking.k8s.io/default unchanged
-service/serviceName unchanged
-deployment.apps/deploymentName unchanged`
+func TestUpdateResultSummary(t *testing.T) {
+	p := &Prometheus{}
+	p.Init()
 
-	want := []Result{
-		{"namespace", "namespaceName", "configured"},
-		{"limitrange", "limit-range", "configured"},
-		{"role.rbac.authorization.k8s.io", "auth", "unchanged"},
-		{"rolebinding.rbac.authorization.k8s.io", "rolebinding", "unchanged"},
-		{"serviceaccount", "account", "unchanged"},
-		{"networkpolicy.networking.k8s.io", "default", "unchanged"},
-		{"service", "serviceName", "unchanged"},
-		{"deployment.apps", "deploymentName", "unchanged"},
-	}
-
-	got := parseKubectlOutput(output)
+	p.UpdateResultSummary(map[string][]kubectl.ObjectResult{
+		"repo/ns": {
+			{Group: "apps", Kind: "deployment", Name: "foo", Namespace: "ns", Action: "configured"},
+			{Kind: "service", Name: "foo", Namespace: "ns", Action: "unchanged"},
+			{Namespace: "ns", Action: "error", Message: "error: something went wrong"},
+		},
+	})
 
-	if diff := deep.Equal(got, want); diff != nil {
-		t.Error(diff)
+	if n := testutil.CollectAndCount(p.resultSummary); n != 2 {
+		t.Errorf("expected 2 result_summary series, got %d", n)
 	}
-}
-
-func TestParseKubectlServerDryRunOutput(t *testing.T) {
-	output := `namespace/namespaceName configured (server dry run)
-limitrange/limit-range configured (server dry run)
-role.rbac.authorization.k8s.io/auth configured (server dry run)
-rolebinding.rbac.authorization.k8s.io/rolebinding configured (server dry run)
-serviceaccount/account configured (server dry run)
-networkpolicy.networking.k8s.io/default configured (server dry run)
-service/serviceName configured (server dry run)
-deployment.apps/deploymentName configured (server dry run)`
-
-	want := []Result{
-		{"namespace", "namespaceName", "configured"},
-		{"limitrange", "limit-range", "configured"},
-		{"role.rbac.authorization.k8s.io", "auth", "configured"},
-		{"rolebinding.rbac.authorization.k8s.io", "rolebinding", "configured"},
-		{"serviceaccount", "account", "configured"},
-		{"networkpolicy.networking.k8s.io", "default", "configured"},
-		{"service", "serviceName", "configured"},
-		{"deployment.apps", "deploymentName", "configured"},
+	if v := testutil.ToFloat64(p.resultSummary.WithLabelValues("ns", "deployment.apps", "foo", "configured", "")); v != 1 {
+		t.Errorf("expected deployment.apps/foo configured to be 1, got %v", v)
 	}
 
-	got := parseKubectlOutput(output)
-
-	if diff := deep.Equal(got, want); diff != nil {
-		t.Error(diff)
+	// Each cluster only replaces its own series
+	staging := p.ForCluster("staging")
+	staging.UpdateResultSummary(map[string][]kubectl.ObjectResult{
+		"repo/staging/ns": {{Kind: "service", Name: "bar", Namespace: "ns", Action: "created"}},
+	})
+	staging.UpdateResultSummary(map[string][]kubectl.ObjectResult{
+		"repo/staging/ns": {{Kind: "service", Name: "baz", Namespace: "ns", Action: "created"}},
+	})
+	if n := testutil.CollectAndCount(p.resultSummary); n != 3 {
+		t.Errorf("expected 3 result_summary series, got %d", n)
+	}
+	if v := testutil.ToFloat64(p.resultSummary.WithLabelValues("ns", "service", "baz", "created", "staging")); v != 1 {
+		t.Errorf("expected service/baz created in staging to be 1, got %v", v)
+	}
+	// A partial run only replaces the series of the namespaces it applied
+	p.UpdateResultSummary(map[string][]kubectl.ObjectResult{
+		"repo/other": {{Kind: "configmap", Name: "qux", Namespace: "other", Action: "created"}},
+	})
+	if n := testutil.CollectAndCount(p.resultSummary); n != 4 {
+		t.Errorf("expected 4 result_summary series, got %d", n)
+	}
+	p.UpdateResultSummary(map[string][]kubectl.ObjectResult{
+		"repo/ns": {{Namespace: "ns", Action: "error", Message: "error: something went wrong"}},
+	})
+	if n := testutil.CollectAndCount(p.resultSummary); n != 2 {
+		t.Errorf("expected 2 result_summary series, got %d", n)
+	}
+	if v := testutil.ToFloat64(p.resultSummary.WithLabelValues("other", "configmap", "qux", "created", "")); v != 1 {
+		t.Errorf("expected configmap/qux created to be 1, got %v", v)
 	}
 }
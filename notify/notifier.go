@@ -0,0 +1,165 @@
+// Package notify sends notifications when the apply status of a namespace changes.
+package notify
+
+import (
+	"strings"
+
+	"github.com/utilitywarehouse/kube-applier/kube"
+	"github.com/utilitywarehouse/kube-applier/log"
+	"github.com/utilitywarehouse/kube-applier/run"
+)
+
+// Maximum number of characters of kubectl output included in an Event. The
+// end of the output is kept, as that is where kubectl reports errors.
+const maxOutputLength = 1000
+
+// Event describes a namespace that started failing, or recovered, in a run.
+// Cluster is only set when kube-applier applies to several clusters.
+type Event struct {
+	Cluster      string `json:"cluster,omitempty"`
+	Namespace    string `json:"namespace"`
+	Success      bool   `json:"success"`
+	CommitHash   string `json:"commitHash"`
+	CommitLink   string `json:"commitLink,omitempty"`
+	Command      string `json:"command"`
+	Output       string `json:"output"`
+	ErrorMessage string `json:"errorMessage,omitempty"`
+}
+
+// Notifier receives run results, sends an Event to every Webhook for each
+// namespace whose apply status changed since the previous run that included
+// it, and then passes the results on to Forward, if set. Namespaces that were
+// not seen before are treated as successful, so that failures are reported
+// after a restart but successes are not.
+//
+// If KubeClient is set, the kube-applier.io/notify annotation of a namespace
+// selects the Slack channels its events are sent to, see webhooks.
+// The events are tagged with Cluster, the name of the cluster the results belong to.
+type Notifier struct {
+	Cluster    string
+	Webhooks   []Webhook
+	KubeClient kube.ClientInterface
+	RunResults <-chan run.Result
+	Forward    chan<- run.Result
+	status     map[string]bool
+}
+
+// Start runs a continuous loop that processes run results as they arrive,
+// until RunResults is closed. Forward is closed when it returns.
+func (n *Notifier) Start() {
+	for result := range n.RunResults {
+		if n.Forward != nil {
+			n.Forward <- result
+		}
+		n.Notify(result)
+	}
+	if n.Forward != nil {
+		close(n.Forward)
+	}
+}
+
+// Notify sends the events for the namespace status changes in result.
+func (n *Notifier) Notify(result run.Result) {
+	for _, e := range n.events(result) {
+		for _, w := range n.webhooks(e.Namespace) {
+			if err := w.Send(e); err != nil {
+				log.Logger.Warn("Could not send notification", "namespace", e.Namespace, "error", err)
+			}
+		}
+	}
+}
+
+// webhooks returns the webhooks the events of namespace are sent to. The
+// kube-applier.io/notify annotation is a comma separated list of Slack
+// channels, eg. #team, which are posted to through the Slack webhooks of the
+// Notifier. When it is set, it replaces the default channels of the Slack
+// webhooks for the namespace, other webhooks are always used. Webhook URLs are
+// rejected, as anyone allowed to annotate namespaces could otherwise have the
+// kubectl output posted to any address.
+func (n *Notifier) webhooks(namespace string) []Webhook {
+	if n.KubeClient == nil {
+		return n.Webhooks
+	}
+	kaa, err := n.KubeClient.NamespaceAnnotations(namespace)
+	if err != nil {
+		log.Logger.Warn("Could not get namespace annotations, using the default notification targets", "namespace", namespace, "error", err)
+		return n.Webhooks
+	}
+	var channels []string
+	for _, t := range strings.Split(kaa.Notify, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		if !strings.HasPrefix(t, "#") && !strings.HasPrefix(t, "@") {
+			log.Logger.Warn("Ignoring invalid kube-applier.io/notify target, only Slack channels are allowed", "namespace", namespace)
+			continue
+		}
+		channels = append(channels, t)
+	}
+	if len(channels) == 0 {
+		return n.Webhooks
+	}
+
+	var webhooks, slack []Webhook
+	for _, w := range n.Webhooks {
+		if _, ok := w.(*SlackWebhook); ok {
+			slack = append(slack, w)
+		} else {
+			webhooks = append(webhooks, w)
+		}
+	}
+	for _, c := range channels {
+		for _, w := range slack {
+			sw := *w.(*SlackWebhook)
+			sw.Channel = c
+			webhooks = append(webhooks, &sw)
+		}
+	}
+	return webhooks
+}
+
+// events returns the Events for the namespaces whose status changed and
+// records the status of every namespace in result.
+func (n *Notifier) events(result run.Result) []Event {
+	if n.status == nil {
+		n.status = make(map[string]bool)
+	}
+	var events []Event
+	check := func(attempts []run.ApplyAttempt, success bool) {
+		for _, a := range attempts {
+			ns := a.Namespace()
+			previous, ok := n.status[ns]
+			if !ok {
+				previous = true
+			}
+			n.status[ns] = success
+			if previous == success {
+				continue
+			}
+			events = append(events, Event{
+				Cluster:      n.Cluster,
+				Namespace:    ns,
+				Success:      success,
+				CommitHash:   result.CommitHash,
+				CommitLink:   result.LastCommitLink(),
+				Command:      a.Command,
+				Output:       truncate(a.Output, maxOutputLength),
+				ErrorMessage: a.ErrorMessage,
+			})
+		}
+	}
+	check(result.Failures, false)
+	check(result.Successes, true)
+	return events
+}
+
+// truncate returns the last max characters of s, prefixed with "..." if any
+// were removed.
+func truncate(s string, max int) string {
+	r := []rune(s)
+	if len(r) <= max {
+		return s
+	}
+	return "..." + string(r[len(r)-max:])
+}
@@ -0,0 +1,137 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/utilitywarehouse/kube-applier/kube"
+	"github.com/utilitywarehouse/kube-applier/log"
+	"github.com/utilitywarehouse/kube-applier/run"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingWebhook struct {
+	events []Event
+}
+
+func (w *recordingWebhook) Send(e Event) error {
+	w.events = append(w.events, e)
+	return nil
+}
+
+func TestNotifierNotify(t *testing.T) {
+	log.InitLogger("info")
+	assert := assert.New(t)
+
+	webhook := &recordingWebhook{}
+	n := &Notifier{Webhooks: []Webhook{webhook}}
+
+	// Successes of unknown namespaces are not reported, failures are
+	n.Notify(run.Result{
+		CommitHash: "aaa",
+		Successes:  []run.ApplyAttempt{{FilePath: "repo/ns1", Command: "cmd ns1", Output: "output ns1"}},
+		Failures:   []run.ApplyAttempt{{FilePath: "repo/ns2", Command: "cmd ns2", Output: "output ns2", ErrorMessage: "exit status 1"}},
+	})
+	assert.Equal([]Event{
+		{Namespace: "ns2", Success: false, CommitHash: "aaa", Command: "cmd ns2", Output: "output ns2", ErrorMessage: "exit status 1"},
+	}, webhook.events)
+
+	// Unchanged status is not reported
+	webhook.events = nil
+	n.Notify(run.Result{
+		CommitHash: "bbb",
+		Failures:   []run.ApplyAttempt{{FilePath: "repo/ns2", Command: "cmd ns2", Output: "output ns2", ErrorMessage: "exit status 1"}},
+	})
+	assert.Nil(webhook.events)
+
+	// Failure and recovery are both reported
+	webhook.events = nil
+	n.Notify(run.Result{
+		CommitHash:    "ccc",
+		DiffURLFormat: "https://github.com/org/repo/commit/%s",
+		Successes:     []run.ApplyAttempt{{FilePath: "repo/ns2", Command: "cmd ns2", Output: "output ns2"}},
+		Failures:      []run.ApplyAttempt{{FilePath: "repo/ns1", Command: "cmd ns1", Output: "output ns1", ErrorMessage: "exit status 1"}},
+	})
+	assert.Equal([]Event{
+		{Namespace: "ns1", Success: false, CommitHash: "ccc", CommitLink: "https://github.com/org/repo/commit/ccc", Command: "cmd ns1", Output: "output ns1", ErrorMessage: "exit status 1"},
+		{Namespace: "ns2", Success: true, CommitHash: "ccc", CommitLink: "https://github.com/org/repo/commit/ccc", Command: "cmd ns2", Output: "output ns2"},
+	}, webhook.events)
+}
+
+func TestTruncate(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("abc", truncate("abc", 3))
+	assert.Equal("...cde", truncate("abcde", 3))
+}
+
+func TestWebhookSend(t *testing.T) {
+	assert := assert.New(t)
+
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body = nil
+		json.NewDecoder(r.Body).Decode(&body)
+		if strings.HasSuffix(r.URL.Path, "/fail") {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	e := Event{Namespace: "ns1", CommitHash: "aaa", CommitLink: "https://example.com/aaa", Command: "cmd", Output: "output\n", ErrorMessage: "exit status 1"}
+
+	assert.Nil((&JSONWebhook{URL: server.URL}).Send(e))
+	assert.Equal("ns1", body["namespace"])
+	assert.Equal(false, body["success"])
+	assert.Equal("https://example.com/aaa", body["commitLink"])
+
+	assert.Nil((&SlackWebhook{URL: server.URL}).Send(e))
+	assert.Equal(":x: Namespace *ns1* failed to apply at commit <https://example.com/aaa|aaa>\n```$ cmd\noutput\nexit status 1```", body["text"])
+
+	assert.NotNil((&JSONWebhook{URL: server.URL + "/fail"}).Send(e))
+
+	// Events of a named cluster
+	e.Cluster = "staging"
+	assert.Nil((&JSONWebhook{URL: server.URL}).Send(e))
+	assert.Equal("staging", body["cluster"])
+	assert.Nil((&SlackWebhook{URL: server.URL}).Send(e))
+	assert.Equal(":x: Namespace *staging/ns1* failed to apply at commit <https://example.com/aaa|aaa>\n```$ cmd\noutput\nexit status 1```", body["text"])
+}
+
+func TestNotifierWebhooks(t *testing.T) {
+	log.InitLogger("info")
+	assert := assert.New(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	kubeClient := kube.NewMockClientInterface(mockCtrl)
+	slack := &SlackWebhook{URL: "https://hooks.slack.com/global"}
+	jsonWebhook := &JSONWebhook{URL: "https://example.com/global"}
+	n := &Notifier{Webhooks: []Webhook{slack, jsonWebhook}, KubeClient: kubeClient}
+
+	gomock.InOrder(
+		kubeClient.EXPECT().NamespaceAnnotations("ns1").Times(1).Return(kube.KAAnnotations{Enabled: "true"}, nil),
+		kubeClient.EXPECT().NamespaceAnnotations("ns2").Times(1).Return(kube.KAAnnotations{}, fmt.Errorf("not found")),
+		kubeClient.EXPECT().NamespaceAnnotations("ns3").Times(1).Return(kube.KAAnnotations{Notify: "#team-a, https://hooks.slack.com/team-b,invalid, @oncall"}, nil),
+		kubeClient.EXPECT().NamespaceAnnotations("ns4").Times(1).Return(kube.KAAnnotations{Notify: "http://169.254.169.254/latest"}, nil),
+	)
+
+	// No annotation and lookup errors use the global webhooks
+	assert.Equal([]Webhook{slack, jsonWebhook}, n.webhooks("ns1"))
+	assert.Equal([]Webhook{slack, jsonWebhook}, n.webhooks("ns2"))
+
+	// The annotation selects the channels of the global Slack webhooks, URLs are rejected
+	assert.Equal([]Webhook{
+		jsonWebhook,
+		&SlackWebhook{URL: "https://hooks.slack.com/global", Channel: "#team-a"},
+		&SlackWebhook{URL: "https://hooks.slack.com/global", Channel: "@oncall"},
+	}, n.webhooks("ns3"))
+
+	// Without a valid channel the global webhooks are used
+	assert.Equal([]Webhook{slack, jsonWebhook}, n.webhooks("ns4"))
+}
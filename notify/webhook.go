@@ -0,0 +1,84 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"time"
+)
+
+// Timeout for the requests sent to webhooks
+const webhookTimeout = 10 * time.Second
+
+// Webhook sends an Event to an external service.
+type Webhook interface {
+	Send(Event) error
+}
+
+// JSONWebhook posts each Event as a JSON object to URL.
+type JSONWebhook struct {
+	URL    string
+	Client *http.Client
+}
+
+// Send posts e to the webhook URL.
+func (w *JSONWebhook) Send(e Event) error {
+	return post(w.Client, w.URL, e)
+}
+
+// SlackWebhook posts each Event as a message to a Slack incoming webhook, or
+// any service that accepts the same payload. Channel overrides the default
+// channel of the webhook, if the webhook allows it.
+type SlackWebhook struct {
+	URL     string
+	Channel string
+	Client  *http.Client
+}
+
+// Send posts a message describing e to the webhook URL.
+func (w *SlackWebhook) Send(e Event) error {
+	return post(w.Client, w.URL, struct {
+		Channel string `json:"channel,omitempty"`
+		Text    string `json:"text"`
+	}{w.Channel, slackText(e)})
+}
+
+func slackText(e Event) string {
+	commit := fmt.Sprintf("`%s`", e.CommitHash)
+	if e.CommitLink != "" {
+		commit = fmt.Sprintf("<%s|%s>", e.CommitLink, e.CommitHash)
+	}
+	namespace := e.Namespace
+	if e.Cluster != "" {
+		namespace = e.Cluster + "/" + e.Namespace
+	}
+	if e.Success {
+		return fmt.Sprintf(":white_check_mark: Namespace *%s* applied successfully again at commit %s", namespace, commit)
+	}
+	return fmt.Sprintf(":x: Namespace *%s* failed to apply at commit %s\n```$ %s\n%s%s```", namespace, commit, e.Command, e.Output, e.ErrorMessage)
+}
+
+func post(client *http.Client, url string, payload interface{}) error {
+	if client == nil {
+		client = &http.Client{Timeout: webhookTimeout}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// Webhook URLs usually embed a secret, keep them out of the logs
+		if e, ok := err.(*neturl.Error); ok {
+			return fmt.Errorf("posting to webhook failed: %v", e.Err)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %s", resp.Status)
+	}
+	return nil
+}
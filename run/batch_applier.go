@@ -1,95 +1,373 @@
 package run
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/utilitywarehouse/kube-applier/kube"
+	"github.com/utilitywarehouse/kube-applier/kubectl"
 	"github.com/utilitywarehouse/kube-applier/log"
 	"github.com/utilitywarehouse/kube-applier/metrics"
 )
 
 // ApplyAttempt stores the data from an attempt at applying a single file.
+// Conflicts lists the fields owned by other managers when a server-side apply fails because of them.
+// Diffs holds the changes to each object computed before the apply, when diffs are enabled.
+// Results holds the outcome for each object, as parsed from Output.
+// TimedOut is set when kubectl was killed for exceeding the apply timeout.
+// Retries counts the times the apply was retried after a transient failure.
+// RenderCommand is the helm command that rendered the manifests applied by Command, for namespaces with a Helm chart.
+// When rendering fails, Command is the helm command instead and the manifests are not applied.
 type ApplyAttempt struct {
-	FilePath     string
-	Command      string
-	Output       string
-	ErrorMessage string
+	FilePath      string                 `json:"filePath"`
+	RenderCommand string                 `json:"renderCommand,omitempty"`
+	Command       string                 `json:"command"`
+	Output        string                 `json:"output"`
+	ErrorMessage  string                 `json:"errorMessage"`
+	Results       []kubectl.ObjectResult `json:"results,omitempty"`
+	Conflicts     []kube.ApplyConflict   `json:"conflicts,omitempty"`
+	Diffs         []kube.ObjectDiff      `json:"diffs,omitempty"`
+	TimedOut      bool                   `json:"timedOut,omitempty"`
+	Retries       int                    `json:"retries,omitempty"`
+}
+
+// Namespace returns the name of the namespace that was applied, which matches
+// the name of the directory.
+func (a ApplyAttempt) Namespace() string {
+	return filepath.Base(a.FilePath)
 }
 
 // BatchApplierInterface allows for mocking out the functionality of BatchApplier when testing the full process of an apply run.
 type BatchApplierInterface interface {
-	Apply([]string) ([]ApplyAttempt, []ApplyAttempt)
+	Apply(context.Context, []string) ([]ApplyAttempt, []ApplyAttempt)
 }
 
 // BatchApplier makes apply calls for a batch of files, and updates metrics based on the results of each call.
+// Workers sets the number of namespaces that are applied concurrently, values lower than 1 are treated as 1.
+// ServerSide enables server-side apply for the namespaces that do not set kube-applier.io/server-side.
+// Diff computes a per-object diff of each namespace before it is applied.
+// Timeout limits the time spent applying each namespace, including the diff, unless it is overridden by
+// kube-applier.io/apply-timeout. Zero means no timeout.
+// Applies that fail with a transient error, eg. the API server being unavailable, are retried up to Retries times,
+// waiting RetryBackoff before the first retry and twice as long before each of the following ones.
+// Once the context of Apply is cancelled no more namespaces are applied, and the ones in progress are given
+// ShutdownTimeout to complete before kubectl is killed.
+// Namespaces with a kube.HelmChartFile are rendered with helm template first, and the rendered manifests are applied.
+// The settings of a running BatchApplier can be changed with Update, from the next call to Apply.
 type BatchApplier struct {
-	KubeClient kube.ClientInterface
-	Metrics    metrics.PrometheusInterface
-	DryRun     bool
+	KubeClient      kube.ClientInterface
+	Metrics         metrics.PrometheusInterface
+	DryRun          bool
+	ServerSide      bool
+	Diff            bool
+	Workers         int
+	Timeout         time.Duration
+	Retries         int
+	RetryBackoff    time.Duration
+	ShutdownTimeout time.Duration
+	mutex           sync.Mutex
+}
+
+// applyResult holds the outcome of applying a single path, as produced by a worker.
+type applyResult struct {
+	attempt ApplyAttempt
+	success bool
+	skipped bool
 }
 
-// Apply takes a list of files and attempts an apply command on each.
+// Apply takes a list of files and attempts an apply command on each, using up to Workers concurrent applies.
 // It returns two lists of ApplyAttempts - one for files that succeeded, and one for files that failed.
-func (a *BatchApplier) Apply(applyList []string) ([]ApplyAttempt, []ApplyAttempt) {
+// Both lists preserve the order of applyList, regardless of the order in which the applies complete.
+// Files that were not applied because ctx was cancelled are in neither list.
+func (a *BatchApplier) Apply(ctx context.Context, applyList []string) ([]ApplyAttempt, []ApplyAttempt) {
+	a = a.settings()
+	workers := a.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(applyList) {
+		workers = len(applyList)
+	}
+
+	kubectlCtx, cancel := withGracePeriod(ctx, a.ShutdownTimeout)
+	defer cancel()
+
+	results := make([]applyResult, len(applyList))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range queue {
+				if ctx.Err() != nil {
+					log.Logger.Info(fmt.Sprintf("Shutting down, skipping dir %v", applyList[j]))
+					results[j] = applyResult{skipped: true}
+					continue
+				}
+				results[j] = a.apply(kubectlCtx, applyList[j])
+			}
+		}()
+	}
+	for i := range applyList {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+
 	successes := []ApplyAttempt{}
 	failures := []ApplyAttempt{}
-	for _, path := range applyList {
-		log.Logger.Info(fmt.Sprintf("Applying dir %v", path))
-		ns := filepath.Base(path)
-		kaa, err := a.KubeClient.NamespaceAnnotations(ns)
-		if err != nil {
-			log.Logger.Error("Error while getting namespace annotations, defaulting to kube-applier.io/enabled=false", "error", err)
+	for _, r := range results {
+		if r.skipped {
 			continue
 		}
+		if r.success {
+			successes = append(successes, r.attempt)
+		} else {
+			failures = append(failures, r.attempt)
+		}
+	}
+	return successes, failures
+}
+
+// Update calls f to change the settings of the BatchApplier.
+func (a *BatchApplier) Update(f func(*BatchApplier)) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	f(a)
+}
+
+// settings returns a copy of the BatchApplier, so that the settings do not
+// change while a batch is being applied.
+func (a *BatchApplier) settings() *BatchApplier {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return &BatchApplier{
+		KubeClient:      a.KubeClient,
+		Metrics:         a.Metrics,
+		DryRun:          a.DryRun,
+		ServerSide:      a.ServerSide,
+		Diff:            a.Diff,
+		Workers:         a.Workers,
+		Timeout:         a.Timeout,
+		Retries:         a.Retries,
+		RetryBackoff:    a.RetryBackoff,
+		ShutdownTimeout: a.ShutdownTimeout,
+	}
+}
+
+// apply attempts an apply command on a single path, taking into account the
+// kube-applier annotations of the matching namespace.
+func (a *BatchApplier) apply(ctx context.Context, path string) applyResult {
+	log.Logger.Info(fmt.Sprintf("Applying dir %v", path))
+	ns := filepath.Base(path)
+	kaa, err := a.KubeClient.NamespaceAnnotations(ns)
+	if err != nil {
+		log.Logger.Error("Error while getting namespace annotations, defaulting to kube-applier.io/enabled=false", "error", err)
+		return applyResult{skipped: true}
+	}
 
-		enabled, err := strconv.ParseBool(kaa.Enabled)
+	enabled, err := strconv.ParseBool(kaa.Enabled)
+	if err != nil {
+		log.Logger.Info("Could not get value for kube-applier.io/enabled", "error", err)
+		return applyResult{skipped: true}
+	} else if !enabled {
+		log.Logger.Info("Skipping namespace", "kube-applier.io/enabled", enabled)
+		return applyResult{skipped: true}
+	}
+
+	dryRun, err := strconv.ParseBool(kaa.DryRun)
+	if err != nil {
+		log.Logger.Info("Could not get value for kube-applier.io/dry-run", "error", err)
+		dryRun = false
+	}
+
+	prune, err := strconv.ParseBool(kaa.Prune)
+	if err != nil {
+		log.Logger.Info("Could not get value for kube-applier.io/prune", "error", err)
+		prune = true
+	}
+
+	serverSide := a.ServerSide
+	if kaa.ServerSide != "" {
+		serverSide, err = strconv.ParseBool(kaa.ServerSide)
 		if err != nil {
-			log.Logger.Info("Could not get value for kube-applier.io/enabled", "error", err)
-			continue
-		} else if !enabled {
-			log.Logger.Info("Skipping namespace", "kube-applier.io/enabled", enabled)
-			continue
+			log.Logger.Info("Could not get value for kube-applier.io/server-side", "error", err)
+			serverSide = a.ServerSide
 		}
+	}
+	// kubectl only prunes the objects with a last-applied-configuration
+	// annotation, which server-side applies do not set
+	if serverSide && prune {
+		log.Logger.Warn("Pruning is not supported with server-side apply, skipping prune", "namespace", ns)
+		prune = false
+	}
 
-		dryRun, err := strconv.ParseBool(kaa.DryRun)
+	pruneWhitelist := kube.ParsePruneWhitelist(kaa.PruneWhitelist)
+
+	timeout := a.Timeout
+	if kaa.ApplyTimeout != "" {
+		timeout, err = time.ParseDuration(kaa.ApplyTimeout)
 		if err != nil {
-			log.Logger.Info("Could not get value for kube-applier.io/dry-run", "error", err)
-			dryRun = false
+			log.Logger.Info("Could not get value for kube-applier.io/apply-timeout", "error", err)
+			timeout = a.Timeout
 		}
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 
-		prune, err := strconv.ParseBool(kaa.Prune)
+	chart, err := kube.LoadHelmChart(path)
+	if err != nil {
+		return a.renderFailure(ctx, timeout, path, "", "", err)
+	}
+	applyPath := path
+	var renderCmd string
+	if chart != nil {
+		dir, err := ioutil.TempDir("", "kube-applier-helm")
+		if err != nil {
+			return a.renderFailure(ctx, timeout, path, "", "", err)
+		}
+		defer os.RemoveAll(dir)
+		// The directory is named after the namespace, which the metrics and kubectl output are labelled with
+		applyPath = filepath.Join(dir, ns)
+		var output string
+		renderCmd, output, err = chart.Render(ctx, path, ns, applyPath)
 		if err != nil {
-			log.Logger.Info("Could not get value for kube-applier.io/prune", "error", err)
-			prune = true
+			return a.renderFailure(ctx, timeout, path, renderCmd, output, err)
 		}
+		log.Logger.Info(fmt.Sprintf("%v\n%v", renderCmd, output))
+	}
+
+	var kustomize bool
+	if _, err := os.Stat(applyPath + "/kustomization.yaml"); err == nil {
+		kustomize = true
+	} else if _, err := os.Stat(applyPath + "/kustomization.yml"); err == nil {
+		kustomize = true
+	} else if _, err := os.Stat(applyPath + "/Kustomization"); err == nil {
+		kustomize = true
+	}
+
+	options := kube.ApplyOptions{
+		DryRun:         a.DryRun || dryRun,
+		Prune:          prune,
+		Kustomize:      kustomize,
+		ServerSide:     serverSide,
+		PruneWhitelist: pruneWhitelist,
+	}
 
-		var kustomize bool
-		if _, err := os.Stat(path + "/kustomization.yaml"); err == nil {
-			kustomize = true
-		} else if _, err := os.Stat(path + "/kustomization.yml"); err == nil {
-			kustomize = true
-		} else if _, err := os.Stat(path + "/Kustomization"); err == nil {
-			kustomize = true
+	var diffs []kube.ObjectDiff
+	if a.Diff {
+		var diffCmd string
+		diffCmd, diffs, err = a.KubeClient.Diff(ctx, applyPath, ns, options)
+		if err != nil {
+			log.Logger.Warn(fmt.Sprintf("%v\n%v", diffCmd, err))
 		}
+	}
 
-		var cmd, output string
-		cmd, output, err = a.KubeClient.Apply(path, ns, a.DryRun || dryRun, prune, kustomize)
-		success := (err == nil)
-		appliedFile := ApplyAttempt{path, cmd, output, ""}
-		if success {
-			successes = append(successes, appliedFile)
-			log.Logger.Info(fmt.Sprintf("%v\n%v", cmd, output))
-		} else {
-			appliedFile.ErrorMessage = err.Error()
-			failures = append(failures, appliedFile)
-			log.Logger.Warn(fmt.Sprintf("%v\n%v\n%v", cmd, output, appliedFile.ErrorMessage))
+	cmd, output, retries, err := a.applyWithRetries(ctx, applyPath, ns, options)
+	success := (err == nil)
+	appliedFile := ApplyAttempt{
+		FilePath:      path,
+		RenderCommand: renderCmd,
+		Command:       cmd,
+		Output:        output,
+		Results:       kubectl.ParseApplyOutput(output, ns),
+		Diffs:         diffs,
+		Retries:       retries,
+	}
+	if success {
+		log.Logger.Info(fmt.Sprintf("%v\n%v", cmd, output))
+	} else {
+		appliedFile.ErrorMessage = err.Error()
+		if ctx.Err() == context.DeadlineExceeded {
+			appliedFile.TimedOut = true
+			appliedFile.ErrorMessage = fmt.Sprintf("apply timed out after %v: %v", timeout, err)
+			a.Metrics.UpdateApplyTimeoutCount(path)
+		}
+		if ce, ok := err.(*kube.ConflictError); ok {
+			appliedFile.Conflicts = ce.Conflicts
 		}
+		log.Logger.Warn(fmt.Sprintf("%v\n%v\n%v", cmd, output, appliedFile.ErrorMessage))
+	}
+
+	a.Metrics.UpdateNamespaceSuccess(path, success)
 
-		a.Metrics.UpdateNamespaceSuccess(path, success)
+	return applyResult{attempt: appliedFile, success: success}
+}
 
+// renderFailure returns the failed ApplyAttempt of a namespace whose Helm
+// chart could not be rendered, which is marked as TimedOut if ctx reached the
+// apply timeout.
+func (a *BatchApplier) renderFailure(ctx context.Context, timeout time.Duration, path, cmd, output string, err error) applyResult {
+	failure := ApplyAttempt{
+		FilePath:     path,
+		Command:      cmd,
+		Output:       output,
+		ErrorMessage: err.Error(),
 	}
-	return successes, failures
+	if ctx.Err() == context.DeadlineExceeded {
+		failure.TimedOut = true
+		failure.ErrorMessage = fmt.Sprintf("render timed out after %v: %v", timeout, err)
+		a.Metrics.UpdateApplyTimeoutCount(path)
+	}
+	log.Logger.Warn(fmt.Sprintf("%v\n%v\n%v", cmd, output, failure.ErrorMessage))
+	a.Metrics.UpdateNamespaceSuccess(path, false)
+	return applyResult{attempt: failure}
+}
+
+// applyWithRetries calls Apply on the KubeClient, retrying transient failures
+// with exponential backoff. It returns the outcome of the last attempt and the
+// number of retries.
+func (a *BatchApplier) applyWithRetries(ctx context.Context, path, namespace string, options kube.ApplyOptions) (string, string, int, error) {
+	retries := 0
+	for {
+		cmd, output, err := a.KubeClient.Apply(ctx, path, namespace, options)
+		if err == nil || retries >= a.Retries || ctx.Err() != nil || !kube.IsTransient(output) {
+			return cmd, output, retries, err
+		}
+		backoff := a.RetryBackoff << uint(retries)
+		log.Logger.Warn(fmt.Sprintf("%v\n%v\n%v", cmd, output, err))
+		log.Logger.Info("Transient apply failure, retrying", "namespace", namespace, "retry", retries+1, "backoff", backoff)
+		a.Metrics.UpdateApplyRetryCount(path)
+		retries++
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return cmd, output, retries, err
+		case <-timer.C:
+		}
+	}
+}
+
+// withGracePeriod returns a context that is cancelled timeout after ctx is, or
+// when the returned cancel function is called, so that work in progress can
+// complete on shutdown.
+func withGracePeriod(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	graceCtx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-graceCtx.Done():
+			return
+		}
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			log.Logger.Warn("Shutdown timeout reached, cancelling applies in progress", "timeout", timeout)
+			cancel()
+		case <-graceCtx.Done():
+		}
+	}()
+	return graceCtx, cancel
 }
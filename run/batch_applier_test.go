@@ -1,8 +1,13 @@
 package run
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/utilitywarehouse/kube-applier/kube"
 	"github.com/utilitywarehouse/kube-applier/log"
@@ -38,7 +43,7 @@ func TestBatchApplierApply(t *testing.T) {
 		[]ApplyAttempt{},
 		[]ApplyAttempt{},
 	}
-	applyAndAssert(t, tc)
+	applyAndAssert(t, &tc)
 }
 
 func TestBatchApplierApplySuccess(t *testing.T) {
@@ -63,9 +68,9 @@ func TestBatchApplierApplySuccess(t *testing.T) {
 		expectSuccessMetric("file3", metrics),
 	)
 	successes := []ApplyAttempt{
-		{"file1", "cmd file1", "output file1", ""},
-		{"file2", "cmd file2", "output file2", ""},
-		{"file3", "cmd file3", "output file3", ""},
+		{FilePath: "file1", Command: "cmd file1", Output: "output file1"},
+		{FilePath: "file2", Command: "cmd file2", Output: "output file2"},
+		{FilePath: "file3", Command: "cmd file3", Output: "output file3"},
 	}
 	tc := batchTestCase{
 		BatchApplier{
@@ -76,7 +81,7 @@ func TestBatchApplierApplySuccess(t *testing.T) {
 		successes,
 		[]ApplyAttempt{},
 	}
-	applyAndAssert(t, tc)
+	applyAndAssert(t, &tc)
 }
 
 func TestBatchApplierApplyFail(t *testing.T) {
@@ -101,9 +106,9 @@ func TestBatchApplierApplyFail(t *testing.T) {
 		expectFailureMetric("file3", metrics),
 	)
 	failures := []ApplyAttempt{
-		{"file1", "cmd file1", "output file1", "error file1"},
-		{"file2", "cmd file2", "output file2", "error file2"},
-		{"file3", "cmd file3", "output file3", "error file3"},
+		{FilePath: "file1", Command: "cmd file1", Output: "output file1", ErrorMessage: "error file1"},
+		{FilePath: "file2", Command: "cmd file2", Output: "output file2", ErrorMessage: "error file2"},
+		{FilePath: "file3", Command: "cmd file3", Output: "output file3", ErrorMessage: "error file3"},
 	}
 	tc := batchTestCase{
 		BatchApplier{
@@ -114,7 +119,7 @@ func TestBatchApplierApplyFail(t *testing.T) {
 		[]ApplyAttempt{},
 		failures,
 	}
-	applyAndAssert(t, tc)
+	applyAndAssert(t, &tc)
 }
 
 func TestBatchApplierApplyPartial(t *testing.T) {
@@ -142,12 +147,12 @@ func TestBatchApplierApplyPartial(t *testing.T) {
 		expectFailureMetric("file4", metrics),
 	)
 	successes := []ApplyAttempt{
-		{"file1", "cmd file1", "output file1", ""},
-		{"file3", "cmd file3", "output file3", ""},
+		{FilePath: "file1", Command: "cmd file1", Output: "output file1"},
+		{FilePath: "file3", Command: "cmd file3", Output: "output file3"},
 	}
 	failures := []ApplyAttempt{
-		{"file2", "cmd file2", "output file2", "error file2"},
-		{"file4", "cmd file4", "output file4", "error file4"},
+		{FilePath: "file2", Command: "cmd file2", Output: "output file2", ErrorMessage: "error file2"},
+		{FilePath: "file4", Command: "cmd file4", Output: "output file4", ErrorMessage: "error file4"},
 	}
 	tc := batchTestCase{
 		BatchApplier{
@@ -158,7 +163,7 @@ func TestBatchApplierApplyPartial(t *testing.T) {
 		successes,
 		failures,
 	}
-	applyAndAssert(t, tc)
+	applyAndAssert(t, &tc)
 }
 
 func TestBatchApplierApplySuccessDryRun(t *testing.T) {
@@ -183,9 +188,9 @@ func TestBatchApplierApplySuccessDryRun(t *testing.T) {
 		expectSuccessMetric("file3", metrics),
 	)
 	successes := []ApplyAttempt{
-		{"file1", "cmd file1", "output file1", ""},
-		{"file2", "cmd file2", "output file2", ""},
-		{"file3", "cmd file3", "output file3", ""},
+		{FilePath: "file1", Command: "cmd file1", Output: "output file1"},
+		{FilePath: "file2", Command: "cmd file2", Output: "output file2"},
+		{FilePath: "file3", Command: "cmd file3", Output: "output file3"},
 	}
 	tc := batchTestCase{
 		BatchApplier{
@@ -197,7 +202,36 @@ func TestBatchApplierApplySuccessDryRun(t *testing.T) {
 		successes,
 		[]ApplyAttempt{},
 	}
-	applyAndAssert(t, tc)
+	applyAndAssert(t, &tc)
+}
+
+func TestBatchApplierUpdate(t *testing.T) {
+	log.InitLogger("info")
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	kubeClient := kube.NewMockClientInterface(mockCtrl)
+	metrics := metrics.NewMockPrometheusInterface(mockCtrl)
+
+	// Dry run enabled after the BatchApplier was created
+	gomock.InOrder(
+		expectNamespaceAnnotationsAndReturn(kube.KAAnnotations{Enabled: "true"}, "file1", kubeClient),
+		expectApplyAndReturnSuccess("file1", "file1", true, true, kubeClient),
+		expectSuccessMetric("file1", metrics),
+	)
+	tc := batchTestCase{
+		BatchApplier{
+			KubeClient: kubeClient,
+			Metrics:    metrics,
+		},
+		[]string{"file1"},
+		[]ApplyAttempt{{FilePath: "file1", Command: "cmd file1", Output: "output file1"}},
+		[]ApplyAttempt{},
+	}
+	tc.ba.Update(func(a *BatchApplier) {
+		a.DryRun = true
+	})
+	applyAndAssert(t, &tc)
 }
 
 func TestBatchApplierApplySuccessDryRunNamespaces(t *testing.T) {
@@ -222,9 +256,9 @@ func TestBatchApplierApplySuccessDryRunNamespaces(t *testing.T) {
 		expectSuccessMetric("repo/file3", metrics),
 	)
 	successes := []ApplyAttempt{
-		{"repo/file1", "cmd repo/file1", "output repo/file1", ""},
-		{"file2", "cmd file2", "output file2", ""},
-		{"repo/file3", "cmd repo/file3", "output repo/file3", ""},
+		{FilePath: "repo/file1", Command: "cmd repo/file1", Output: "output repo/file1"},
+		{FilePath: "file2", Command: "cmd file2", Output: "output file2"},
+		{FilePath: "repo/file3", Command: "cmd repo/file3", Output: "output repo/file3"},
 	}
 	tc := batchTestCase{
 		BatchApplier{
@@ -236,7 +270,7 @@ func TestBatchApplierApplySuccessDryRunNamespaces(t *testing.T) {
 		successes,
 		[]ApplyAttempt{},
 	}
-	applyAndAssert(t, tc)
+	applyAndAssert(t, &tc)
 }
 
 func TestBatchApplierApplySuccessDryRunAndDryRunNamespaces(t *testing.T) {
@@ -261,9 +295,9 @@ func TestBatchApplierApplySuccessDryRunAndDryRunNamespaces(t *testing.T) {
 		expectSuccessMetric("file3", metrics),
 	)
 	successes := []ApplyAttempt{
-		{"file1", "cmd file1", "output file1", ""},
-		{"file2", "cmd file2", "output file2", ""},
-		{"file3", "cmd file3", "output file3", ""},
+		{FilePath: "file1", Command: "cmd file1", Output: "output file1"},
+		{FilePath: "file2", Command: "cmd file2", Output: "output file2"},
+		{FilePath: "file3", Command: "cmd file3", Output: "output file3"},
 	}
 	tc := batchTestCase{
 		BatchApplier{
@@ -275,7 +309,7 @@ func TestBatchApplierApplySuccessDryRunAndDryRunNamespaces(t *testing.T) {
 		successes,
 		[]ApplyAttempt{},
 	}
-	applyAndAssert(t, tc)
+	applyAndAssert(t, &tc)
 }
 
 func TestBatchApplierApplyDisabledNamespaces(t *testing.T) {
@@ -296,7 +330,7 @@ func TestBatchApplierApplyDisabledNamespaces(t *testing.T) {
 		expectNamespaceAnnotationsAndReturn(kube.KAAnnotations{Enabled: "false"}, "file3", kubeClient),
 	)
 	successes := []ApplyAttempt{
-		{"file2", "cmd file2", "output file2", ""},
+		{FilePath: "file2", Command: "cmd file2", Output: "output file2"},
 	}
 	tc := batchTestCase{
 		BatchApplier{
@@ -308,7 +342,7 @@ func TestBatchApplierApplyDisabledNamespaces(t *testing.T) {
 		successes,
 		[]ApplyAttempt{},
 	}
-	applyAndAssert(t, tc)
+	applyAndAssert(t, &tc)
 }
 
 func TestBatchApplierApplyInvalidAnnotation(t *testing.T) {
@@ -329,7 +363,7 @@ func TestBatchApplierApplyInvalidAnnotation(t *testing.T) {
 		expectNamespaceAnnotationsAndReturn(kube.KAAnnotations{Enabled: "unsupportedOption"}, "file3", kubeClient),
 	)
 	successes := []ApplyAttempt{
-		{"file2", "cmd file2", "output file2", ""},
+		{FilePath: "file2", Command: "cmd file2", Output: "output file2"},
 	}
 	tc := batchTestCase{
 		BatchApplier{
@@ -341,15 +375,408 @@ func TestBatchApplierApplyInvalidAnnotation(t *testing.T) {
 		successes,
 		[]ApplyAttempt{},
 	}
-	applyAndAssert(t, tc)
+	applyAndAssert(t, &tc)
+}
+
+func TestBatchApplierApplyServerSide(t *testing.T) {
+	log.InitLogger("info")
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	kubeClient := kube.NewMockClientInterface(mockCtrl)
+	metrics := metrics.NewMockPrometheusInterface(mockCtrl)
+
+	// Server-side apply enabled globally, overridden by annotations, with conflicts reported. Server-side
+	// applies are never pruned.
+	conflicts := []kube.ApplyConflict{{Manager: "helm", APIVersion: "apps/v1", Field: ".spec.replicas"}}
+	conflictErr := &kube.ConflictError{Conflicts: conflicts, Err: fmt.Errorf("exit status 1")}
+	applyList := []string{"file1", "file2", "file3"}
+	gomock.InOrder(
+		expectNamespaceAnnotationsAndReturn(kube.KAAnnotations{Enabled: "true"}, "file1", kubeClient),
+		kubeClient.EXPECT().Apply(gomock.Any(), "file1", "file1", kube.ApplyOptions{ServerSide: true}).Times(1).Return("cmd file1", "output file1", nil),
+		expectSuccessMetric("file1", metrics),
+		expectNamespaceAnnotationsAndReturn(kube.KAAnnotations{Enabled: "true", ServerSide: "false"}, "file2", kubeClient),
+		expectApplyAndReturnSuccess("file2", "file2", false, true, kubeClient),
+		expectSuccessMetric("file2", metrics),
+		expectNamespaceAnnotationsAndReturn(kube.KAAnnotations{Enabled: "true", ServerSide: "true"}, "file3", kubeClient),
+		kubeClient.EXPECT().Apply(gomock.Any(), "file3", "file3", kube.ApplyOptions{ServerSide: true}).Times(1).Return("cmd file3", "output file3", conflictErr),
+		expectFailureMetric("file3", metrics),
+	)
+	successes := []ApplyAttempt{
+		{FilePath: "file1", Command: "cmd file1", Output: "output file1"},
+		{FilePath: "file2", Command: "cmd file2", Output: "output file2"},
+	}
+	failures := []ApplyAttempt{
+		{FilePath: "file3", Command: "cmd file3", Output: "output file3", ErrorMessage: conflictErr.Error(), Conflicts: conflicts},
+	}
+	tc := batchTestCase{
+		BatchApplier{
+			KubeClient: kubeClient,
+			Metrics:    metrics,
+			ServerSide: true,
+		},
+		applyList,
+		successes,
+		failures,
+	}
+	applyAndAssert(t, &tc)
+}
+
+func TestBatchApplierApplyPruneWhitelist(t *testing.T) {
+	log.InitLogger("info")
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	kubeClient := kube.NewMockClientInterface(mockCtrl)
+	metrics := metrics.NewMockPrometheusInterface(mockCtrl)
+
+	// Prune whitelist annotation overrides the default whitelist
+	applyList := []string{"file1", "file2"}
+	gomock.InOrder(
+		expectNamespaceAnnotationsAndReturn(kube.KAAnnotations{Enabled: "true", PruneWhitelist: "apps/v1/Deployment, core/v1/Secret"}, "file1", kubeClient),
+		kubeClient.EXPECT().Apply(gomock.Any(), "file1", "file1", kube.ApplyOptions{Prune: true, PruneWhitelist: []string{"apps/v1/Deployment", "core/v1/Secret"}}).Times(1).Return("cmd file1", "output file1", nil),
+		expectSuccessMetric("file1", metrics),
+		expectNamespaceAnnotationsAndReturn(kube.KAAnnotations{Enabled: "true"}, "file2", kubeClient),
+		expectApplyAndReturnSuccess("file2", "file2", false, true, kubeClient),
+		expectSuccessMetric("file2", metrics),
+	)
+	successes := []ApplyAttempt{
+		{FilePath: "file1", Command: "cmd file1", Output: "output file1"},
+		{FilePath: "file2", Command: "cmd file2", Output: "output file2"},
+	}
+	tc := batchTestCase{
+		BatchApplier{
+			KubeClient: kubeClient,
+			Metrics:    metrics,
+		},
+		applyList,
+		successes,
+		[]ApplyAttempt{},
+	}
+	applyAndAssert(t, &tc)
+}
+
+func TestBatchApplierApplyDiff(t *testing.T) {
+	log.InitLogger("info")
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	kubeClient := kube.NewMockClientInterface(mockCtrl)
+	metrics := metrics.NewMockPrometheusInterface(mockCtrl)
+
+	// Diffs are stored in the attempt, a failed diff does not prevent the apply
+	applyList := []string{"file1", "file2"}
+	diffs := []kube.ObjectDiff{{Object: "apps.v1.Deployment.file1.foo", Diff: "-  replicas: 1\n+  replicas: 2\n"}}
+	gomock.InOrder(
+		expectNamespaceAnnotationsAndReturn(kube.KAAnnotations{Enabled: "true", DryRun: "true"}, "file1", kubeClient),
+		kubeClient.EXPECT().Diff(gomock.Any(), "file1", "file1", kube.ApplyOptions{DryRun: true, Prune: true}).Times(1).Return("diff file1", diffs, nil),
+		expectApplyAndReturnSuccess("file1", "file1", true, true, kubeClient),
+		expectSuccessMetric("file1", metrics),
+		expectNamespaceAnnotationsAndReturn(kube.KAAnnotations{Enabled: "true"}, "file2", kubeClient),
+		kubeClient.EXPECT().Diff(gomock.Any(), "file2", "file2", kube.ApplyOptions{Prune: true}).Times(1).Return("diff file2", nil, fmt.Errorf("diff failed")),
+		expectApplyAndReturnSuccess("file2", "file2", false, true, kubeClient),
+		expectSuccessMetric("file2", metrics),
+	)
+	successes := []ApplyAttempt{
+		{FilePath: "file1", Command: "cmd file1", Output: "output file1", Diffs: diffs},
+		{FilePath: "file2", Command: "cmd file2", Output: "output file2"},
+	}
+	tc := batchTestCase{
+		BatchApplier{
+			KubeClient: kubeClient,
+			Metrics:    metrics,
+			Diff:       true,
+		},
+		applyList,
+		successes,
+		[]ApplyAttempt{},
+	}
+	applyAndAssert(t, &tc)
+}
+
+func TestBatchApplierApplyWorkers(t *testing.T) {
+	log.InitLogger("info")
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	kubeClient := kube.NewMockClientInterface(mockCtrl)
+	metrics := metrics.NewMockPrometheusInterface(mockCtrl)
+
+	// Applies complete in any order, results keep the order of the apply list
+	applyList := []string{"file1", "file2", "file3", "file4", "file5"}
+	expectNamespaceAnnotationsAndReturn(kube.KAAnnotations{Enabled: "true"}, "file1", kubeClient)
+	expectApplyAndReturnSuccess("file1", "file1", false, true, kubeClient)
+	expectSuccessMetric("file1", metrics)
+	expectNamespaceAnnotationsAndReturn(kube.KAAnnotations{Enabled: "true"}, "file2", kubeClient)
+	expectApplyAndReturnFailure("file2", "file2", false, true, kubeClient)
+	expectFailureMetric("file2", metrics)
+	expectNamespaceAnnotationsAndReturn(kube.KAAnnotations{Enabled: "false"}, "file3", kubeClient)
+	expectNamespaceAnnotationsAndReturn(kube.KAAnnotations{Enabled: "true"}, "file4", kubeClient)
+	expectApplyAndReturnSuccess("file4", "file4", false, true, kubeClient)
+	expectSuccessMetric("file4", metrics)
+	expectNamespaceAnnotationsAndReturn(kube.KAAnnotations{Enabled: "true"}, "file5", kubeClient)
+	expectApplyAndReturnFailure("file5", "file5", false, true, kubeClient)
+	expectFailureMetric("file5", metrics)
+
+	successes := []ApplyAttempt{
+		{FilePath: "file1", Command: "cmd file1", Output: "output file1"},
+		{FilePath: "file4", Command: "cmd file4", Output: "output file4"},
+	}
+	failures := []ApplyAttempt{
+		{FilePath: "file2", Command: "cmd file2", Output: "output file2", ErrorMessage: "error file2"},
+		{FilePath: "file5", Command: "cmd file5", Output: "output file5", ErrorMessage: "error file5"},
+	}
+	tc := batchTestCase{
+		BatchApplier{
+			KubeClient: kubeClient,
+			Metrics:    metrics,
+			Workers:    3,
+		},
+		applyList,
+		successes,
+		failures,
+	}
+	applyAndAssert(t, &tc)
+}
+
+func TestBatchApplierApplyTimeout(t *testing.T) {
+	log.InitLogger("info")
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	kubeClient := kube.NewMockClientInterface(mockCtrl)
+	metrics := metrics.NewMockPrometheusInterface(mockCtrl)
+
+	// Applies running past the global timeout, or the annotation, are killed
+	// and recorded as timed out, an invalid annotation uses the global timeout
+	waitAndKill := func(ctx context.Context, path, namespace string, options kube.ApplyOptions) {
+		<-ctx.Done()
+	}
+	applyList := []string{"file1", "file2", "file3"}
+	gomock.InOrder(
+		expectNamespaceAnnotationsAndReturn(kube.KAAnnotations{Enabled: "true"}, "file1", kubeClient),
+		kubeClient.EXPECT().Apply(gomock.Any(), "file1", "file1", kube.ApplyOptions{Prune: true}).Times(1).Do(waitAndKill).Return("cmd file1", "output file1", fmt.Errorf("signal: killed")),
+		metrics.EXPECT().UpdateApplyTimeoutCount("file1").Times(1),
+		expectFailureMetric("file1", metrics),
+		expectNamespaceAnnotationsAndReturn(kube.KAAnnotations{Enabled: "true", ApplyTimeout: "0"}, "file2", kubeClient),
+		expectApplyAndReturnSuccess("file2", "file2", false, true, kubeClient),
+		expectSuccessMetric("file2", metrics),
+		expectNamespaceAnnotationsAndReturn(kube.KAAnnotations{Enabled: "true", ApplyTimeout: "invalid"}, "file3", kubeClient),
+		kubeClient.EXPECT().Apply(gomock.Any(), "file3", "file3", kube.ApplyOptions{Prune: true}).Times(1).Do(waitAndKill).Return("cmd file3", "output file3", fmt.Errorf("signal: killed")),
+		metrics.EXPECT().UpdateApplyTimeoutCount("file3").Times(1),
+		expectFailureMetric("file3", metrics),
+	)
+	successes := []ApplyAttempt{
+		{FilePath: "file2", Command: "cmd file2", Output: "output file2"},
+	}
+	failures := []ApplyAttempt{
+		{FilePath: "file1", Command: "cmd file1", Output: "output file1", ErrorMessage: "apply timed out after 10ms: signal: killed", TimedOut: true},
+		{FilePath: "file3", Command: "cmd file3", Output: "output file3", ErrorMessage: "apply timed out after 10ms: signal: killed", TimedOut: true},
+	}
+	tc := batchTestCase{
+		BatchApplier{
+			KubeClient: kubeClient,
+			Metrics:    metrics,
+			Timeout:    10 * time.Millisecond,
+		},
+		applyList,
+		successes,
+		failures,
+	}
+	applyAndAssert(t, &tc)
+}
+
+func TestBatchApplierApplyRetries(t *testing.T) {
+	log.InitLogger("info")
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	kubeClient := kube.NewMockClientInterface(mockCtrl)
+	metrics := metrics.NewMockPrometheusInterface(mockCtrl)
+
+	// Transient failures are retried until the apply succeeds or the retries
+	// run out, other failures are not retried
+	refused := "The connection to the server 10.0.0.1:443 was refused - did you specify the right host or port?"
+	options := kube.ApplyOptions{Prune: true}
+	applyList := []string{"file1", "file2", "file3"}
+	gomock.InOrder(
+		expectNamespaceAnnotationsAndReturn(kube.KAAnnotations{Enabled: "true"}, "file1", kubeClient),
+		kubeClient.EXPECT().Apply(gomock.Any(), "file1", "file1", options).Times(1).Return("cmd file1", refused, fmt.Errorf("exit status 1")),
+		metrics.EXPECT().UpdateApplyRetryCount("file1").Times(1),
+		expectApplyAndReturnSuccess("file1", "file1", false, true, kubeClient),
+		expectSuccessMetric("file1", metrics),
+		expectNamespaceAnnotationsAndReturn(kube.KAAnnotations{Enabled: "true"}, "file2", kubeClient),
+		kubeClient.EXPECT().Apply(gomock.Any(), "file2", "file2", options).Times(1).Return("cmd file2", refused, fmt.Errorf("exit status 1")),
+		metrics.EXPECT().UpdateApplyRetryCount("file2").Times(1),
+		kubeClient.EXPECT().Apply(gomock.Any(), "file2", "file2", options).Times(1).Return("cmd file2", refused, fmt.Errorf("exit status 1")),
+		metrics.EXPECT().UpdateApplyRetryCount("file2").Times(1),
+		kubeClient.EXPECT().Apply(gomock.Any(), "file2", "file2", options).Times(1).Return("cmd file2", refused, fmt.Errorf("exit status 1")),
+		expectFailureMetric("file2", metrics),
+		expectNamespaceAnnotationsAndReturn(kube.KAAnnotations{Enabled: "true"}, "file3", kubeClient),
+		expectApplyAndReturnFailure("file3", "file3", false, true, kubeClient),
+		expectFailureMetric("file3", metrics),
+	)
+	successes := []ApplyAttempt{
+		{FilePath: "file1", Command: "cmd file1", Output: "output file1", Retries: 1},
+	}
+	failures := []ApplyAttempt{
+		{FilePath: "file2", Command: "cmd file2", Output: refused, ErrorMessage: "exit status 1", Retries: 2},
+		{FilePath: "file3", Command: "cmd file3", Output: "output file3", ErrorMessage: "error file3"},
+	}
+	tc := batchTestCase{
+		BatchApplier{
+			KubeClient:   kubeClient,
+			Metrics:      metrics,
+			Retries:      2,
+			RetryBackoff: time.Millisecond,
+		},
+		applyList,
+		successes,
+		failures,
+	}
+	applyAndAssert(t, &tc)
+}
+
+func TestBatchApplierApplyHelm(t *testing.T) {
+	log.InitLogger("info")
+	assert := assert.New(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	kubeClient := kube.NewMockClientInterface(mockCtrl)
+	metrics := metrics.NewMockPrometheusInterface(mockCtrl)
+
+	// A fake helm binary renders a ConfigMap, fails for the "broken" release or
+	// hangs, along with the process it starts, for the "slow" release
+	dir, err := ioutil.TempDir("", "kube-applier-helm-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"bin/helm":          "#!/bin/sh\nif [ \"$2\" = broken ]; then echo 'Error: broken chart' >&2; exit 1; fi\nif [ \"$2\" = slow ]; then sleep 30 & sleep 30; fi\necho 'kind: ConfigMap'\n",
+		"app/helm.yaml":     "chart: ../charts/app\n",
+		"app/values.yaml":   "replicas: 2\n",
+		"broken/helm.yaml":  "chart: ../charts/app\nreleaseName: broken\n",
+		"invalid/helm.yaml": "releaseName: invalid\n",
+		"slow/helm.yaml":    "chart: ../charts/app\nreleaseName: slow\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", filepath.Join(dir, "bin")+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	app, broken, invalid := filepath.Join(dir, "app"), filepath.Join(dir, "broken"), filepath.Join(dir, "invalid")
+	slow := filepath.Join(dir, "slow")
+	chart := filepath.Join(dir, "charts", "app")
+	gomock.InOrder(
+		expectNamespaceAnnotationsAndReturn(kube.KAAnnotations{Enabled: "true"}, "app", kubeClient),
+		kubeClient.EXPECT().Apply(gomock.Any(), gomock.Any(), "app", kube.ApplyOptions{Prune: true}).Times(1).Do(
+			func(ctx context.Context, path, namespace string, options kube.ApplyOptions) {
+				assert.Equal("app", filepath.Base(path))
+				manifests, err := ioutil.ReadFile(filepath.Join(path, "manifests.yaml"))
+				assert.NoError(err)
+				assert.Equal("kind: ConfigMap\n", string(manifests))
+			}).Return("cmd app", "output app", nil),
+		expectSuccessMetric(app, metrics),
+		expectNamespaceAnnotationsAndReturn(kube.KAAnnotations{Enabled: "true"}, "broken", kubeClient),
+		expectFailureMetric(broken, metrics),
+		expectNamespaceAnnotationsAndReturn(kube.KAAnnotations{Enabled: "true"}, "invalid", kubeClient),
+		expectFailureMetric(invalid, metrics),
+		expectNamespaceAnnotationsAndReturn(kube.KAAnnotations{Enabled: "true", ApplyTimeout: "100ms"}, "slow", kubeClient),
+		metrics.EXPECT().UpdateApplyTimeoutCount(slow).Times(1),
+		expectFailureMetric(slow, metrics),
+	)
+	successes := []ApplyAttempt{
+		{
+			FilePath:      app,
+			RenderCommand: fmt.Sprintf("helm template app %s --namespace app --values %s/values.yaml", chart, app),
+			Command:       "cmd app",
+			Output:        "output app",
+		},
+	}
+	failures := []ApplyAttempt{
+		{
+			FilePath:     broken,
+			Command:      fmt.Sprintf("helm template broken %s --namespace broken", chart),
+			Output:       "Error: broken chart\n",
+			ErrorMessage: "helm template failed: exit status 1",
+		},
+		{FilePath: invalid, ErrorMessage: "helm.yaml: chart is required"},
+		{
+			FilePath:     slow,
+			Command:      fmt.Sprintf("helm template slow %s --namespace slow", chart),
+			ErrorMessage: "render timed out after 100ms: helm template failed: signal: killed",
+			TimedOut:     true,
+		},
+	}
+	tc := batchTestCase{
+		BatchApplier{
+			KubeClient: kubeClient,
+			Metrics:    metrics,
+		},
+		[]string{app, broken, invalid, slow},
+		successes,
+		failures,
+	}
+	applyAndAssert(t, &tc)
+}
+
+func TestBatchApplierApplyShutdown(t *testing.T) {
+	log.InitLogger("info")
+	assert := assert.New(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	kubeClient := kube.NewMockClientInterface(mockCtrl)
+	metrics := metrics.NewMockPrometheusInterface(mockCtrl)
+
+	// The dir being applied on shutdown completes, the remaining dirs are skipped
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	gomock.InOrder(
+		expectNamespaceAnnotationsAndReturn(kube.KAAnnotations{Enabled: "true"}, "file1", kubeClient),
+		kubeClient.EXPECT().Apply(gomock.Any(), "file1", "file1", kube.ApplyOptions{Prune: true}).Times(1).Do(func(kubectlCtx context.Context, path, namespace string, options kube.ApplyOptions) {
+			cancel()
+			assert.NoError(kubectlCtx.Err())
+		}).Return("cmd file1", "output file1", nil),
+		expectSuccessMetric("file1", metrics),
+	)
+	ba := BatchApplier{
+		KubeClient:      kubeClient,
+		Metrics:         metrics,
+		ShutdownTimeout: time.Minute,
+	}
+	successes, failures := ba.Apply(ctx, []string{"file1", "file2", "file3"})
+	assert.Equal([]ApplyAttempt{{FilePath: "file1", Command: "cmd file1", Output: "output file1"}}, successes)
+	assert.Equal([]ApplyAttempt{}, failures)
+
+	// Applies still in progress after the timeout are cancelled
+	ctx, cancel = context.WithCancel(context.Background())
+	graceCtx, graceCancel := withGracePeriod(ctx, 10*time.Millisecond)
+	defer graceCancel()
+	cancel()
+	assert.NoError(graceCtx.Err())
+	select {
+	case <-graceCtx.Done():
+	case <-time.After(time.Second):
+		t.Error("expected the context to be cancelled after the timeout")
+	}
 }
 
 func expectApplyAndReturnSuccess(file, namespace string, dryRun, prune bool, kubeClient *kube.MockClientInterface) *gomock.Call {
-	return kubeClient.EXPECT().Apply(file, namespace, dryRun, prune, false).Times(1).Return("cmd "+file, "output "+file, nil)
+	return kubeClient.EXPECT().Apply(gomock.Any(), file, namespace, kube.ApplyOptions{DryRun: dryRun, Prune: prune}).Times(1).Return("cmd "+file, "output "+file, nil)
 }
 
 func expectApplyAndReturnFailure(file, namespace string, dryRun, prune bool, kubeClient *kube.MockClientInterface) *gomock.Call {
-	return kubeClient.EXPECT().Apply(file, namespace, dryRun, prune, false).Times(1).Return("cmd "+file, "output "+file, fmt.Errorf("error "+file))
+	return kubeClient.EXPECT().Apply(gomock.Any(), file, namespace, kube.ApplyOptions{DryRun: dryRun, Prune: prune}).Times(1).Return("cmd "+file, "output "+file, fmt.Errorf("error "+file))
 }
 
 func expectNamespaceAnnotationsAndReturn(ret kube.KAAnnotations, namespace string, kubeClient *kube.MockClientInterface) *gomock.Call {
@@ -364,9 +791,9 @@ func expectFailureMetric(file string, metrics *metrics.MockPrometheusInterface)
 	return metrics.EXPECT().UpdateNamespaceSuccess(file, false).Times(1)
 }
 
-func applyAndAssert(t *testing.T, tc batchTestCase) {
+func applyAndAssert(t *testing.T, tc *batchTestCase) {
 	assert := assert.New(t)
-	successes, failures := tc.ba.Apply(tc.applyList)
+	successes, failures := tc.ba.Apply(context.Background(), tc.applyList)
 	assert.Equal(tc.expectedSuccesses, successes)
 	assert.Equal(tc.expectedFailures, failures)
 }
@@ -0,0 +1,157 @@
+package run
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/utilitywarehouse/kube-applier/log"
+)
+
+const historyFileExt = ".json"
+
+// History keeps the Results of the last Size runs. If Dir is set, every Result
+// is also written to Dir as a JSON file so that the history survives restarts,
+// otherwise the history is only kept in memory.
+type History struct {
+	Dir     string
+	Size    int
+	mutex   sync.Mutex
+	results []Result
+	lastID  int
+}
+
+// Load reads previously persisted Results from Dir, keeping the most recent
+// Size of them. It creates Dir if it does not exist yet.
+func (h *History) Load() error {
+	if h.Dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(h.Dir, 0755); err != nil {
+		return errors.Wrap(err, "creating run history directory failed")
+	}
+	files, err := ioutil.ReadDir(h.Dir)
+	if err != nil {
+		return errors.Wrap(err, "reading run history directory failed")
+	}
+
+	var results []Result
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), historyFileExt) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(h.Dir, f.Name()))
+		if err != nil {
+			return errors.Wrapf(err, "reading run history file %s failed", f.Name())
+		}
+		var r Result
+		if err := json.Unmarshal(data, &r); err != nil {
+			log.Logger.Warn("Ignoring invalid run history file", "file", f.Name(), "error", err)
+			continue
+		}
+		results = append(results, r)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].ID < results[j].ID })
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.results = results
+	if len(results) > 0 {
+		h.lastID = results[len(results)-1].ID
+	}
+	h.trim()
+	return nil
+}
+
+// Add assigns an ID to the Result and stores it, discarding the oldest
+// Results once there are more than Size of them. It returns the stored Result.
+func (h *History) Add(r Result) (Result, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.lastID++
+	r.ID = h.lastID
+	h.results = append(h.results, r)
+	err := h.write(r)
+	h.trim()
+	return r, err
+}
+
+// List returns the stored Results, most recent first.
+func (h *History) List() []Result {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	results := make([]Result, len(h.results))
+	for i, r := range h.results {
+		results[len(h.results)-1-i] = r
+	}
+	return results
+}
+
+// Get returns the Result with the given ID, if it is still stored.
+func (h *History) Get(id int) (Result, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, r := range h.results {
+		if r.ID == id {
+			return r, true
+		}
+	}
+	return Result{}, false
+}
+
+// Latest returns the most recent Result, if there is one.
+func (h *History) Latest() (Result, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if len(h.results) == 0 {
+		return Result{}, false
+	}
+	return h.results[len(h.results)-1], true
+}
+
+// trim discards the oldest Results, and their files, over the Size limit.
+// It must be called with the mutex held.
+func (h *History) trim() {
+	if h.Size < 1 || len(h.results) <= h.Size {
+		return
+	}
+	for _, r := range h.results[:len(h.results)-h.Size] {
+		if h.Dir == "" {
+			continue
+		}
+		if err := os.Remove(h.path(r.ID)); err != nil && !os.IsNotExist(err) {
+			log.Logger.Warn("Could not remove run history file", "file", h.path(r.ID), "error", err)
+		}
+	}
+	h.results = append([]Result{}, h.results[len(h.results)-h.Size:]...)
+}
+
+// write persists the Result to Dir, going through a temporary file so that
+// a partially written file is never loaded.
+func (h *History) write(r Result) error {
+	if h.Dir == "" {
+		return nil
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return errors.Wrap(err, "encoding run result failed")
+	}
+	tmp := h.path(r.ID) + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Wrap(err, "writing run history file failed")
+	}
+	if err := os.Rename(tmp, h.path(r.ID)); err != nil {
+		return errors.Wrap(err, "writing run history file failed")
+	}
+	return nil
+}
+
+func (h *History) path(id int) string {
+	return filepath.Join(h.Dir, strconv.Itoa(id)+historyFileExt)
+}
@@ -0,0 +1,83 @@
+package run
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/utilitywarehouse/kube-applier/log"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistoryInMemory(t *testing.T) {
+	log.InitLogger("info")
+	assert := assert.New(t)
+
+	h := &History{Size: 2}
+	assert.NoError(h.Load())
+
+	_, ok := h.Latest()
+	assert.False(ok)
+
+	for _, hash := range []string{"a", "b", "c"} {
+		_, err := h.Add(Result{CommitHash: hash})
+		assert.NoError(err)
+	}
+
+	results := h.List()
+	assert.Len(results, 2)
+	assert.Equal(3, results[0].ID)
+	assert.Equal("c", results[0].CommitHash)
+	assert.Equal(2, results[1].ID)
+	assert.Equal("b", results[1].CommitHash)
+
+	latest, ok := h.Latest()
+	assert.True(ok)
+	assert.Equal(3, latest.ID)
+
+	_, ok = h.Get(1)
+	assert.False(ok)
+	r, ok := h.Get(2)
+	assert.True(ok)
+	assert.Equal("b", r.CommitHash)
+}
+
+func TestHistoryPersisted(t *testing.T) {
+	log.InitLogger("info")
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "kube-applier-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := &History{Dir: dir, Size: 2}
+	assert.NoError(h.Load())
+	start := time.Unix(1000, 0).UTC()
+	for _, hash := range []string{"a", "b", "c"} {
+		_, err := h.Add(Result{
+			Start:      start,
+			CommitHash: hash,
+			Successes:  []ApplyAttempt{{FilePath: "file1", Command: "cmd file1", Output: "output file1"}},
+			Failures:   []ApplyAttempt{{FilePath: "file2", Command: "cmd file2", Output: "output file2", ErrorMessage: "error file2"}},
+		})
+		assert.NoError(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	assert.NoError(err)
+	assert.ElementsMatch([]string{filepath.Join(dir, "2.json"), filepath.Join(dir, "3.json")}, files)
+
+	// A new History picks up where the previous one left off
+	reloaded := &History{Dir: dir, Size: 2}
+	assert.NoError(reloaded.Load())
+	assert.Equal(h.List(), reloaded.List())
+
+	r, err := reloaded.Add(Result{CommitHash: "d"})
+	assert.NoError(err)
+	assert.Equal(4, r.ID)
+}
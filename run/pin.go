@@ -0,0 +1,73 @@
+package run
+
+import (
+	"sync"
+)
+
+// Pin holds the commit applied by the last run of a specific commit, eg. a
+// rollback, along with the HEAD commit at the time. Until HEAD moves past it
+// or Unpin is called, the Runner applies the pinned commit instead of the
+// working tree, to all the namespaces or to the single namespace it was
+// applied to. The pin is kept in memory and is lost on restart.
+// A nil Pin is never pinned.
+type Pin struct {
+	mutex     sync.Mutex
+	commit    string
+	namespace string
+	head      string
+}
+
+// Commit returns the pinned commit, or an empty string if there is none.
+func (p *Pin) Commit() string {
+	if p == nil {
+		return ""
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.commit
+}
+
+// Namespace returns the namespace the commit is pinned for, or an empty
+// string if it is pinned for all of them.
+func (p *Pin) Namespace() string {
+	if p == nil {
+		return ""
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.namespace
+}
+
+// Unpin removes the pinned commit, if any, and returns true if there was one.
+func (p *Pin) Unpin() bool {
+	if p == nil {
+		return false
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	pinned := p.commit != ""
+	p.commit, p.namespace, p.head = "", "", ""
+	return pinned
+}
+
+// set pins commit for namespace, or all the namespaces if it is empty, while
+// HEAD is at head.
+func (p *Pin) set(commit, namespace, head string) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.commit, p.namespace, p.head = commit, namespace, head
+}
+
+// get returns the pinned commit and namespace, and the HEAD commit it was
+// pinned at.
+func (p *Pin) get() (string, string, string) {
+	if p == nil {
+		return "", "", ""
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.commit, p.namespace, p.head
+}
@@ -0,0 +1,75 @@
+package run
+
+import (
+	"sync"
+)
+
+// Queue holds the run requests waiting for the Runner. Requests are merged
+// with the pending ones rather than dropped, so that every request is covered
+// by a run: a pending full run absorbs partial and namespace runs, and a
+// partial run or a namespace run is only pending once. Requests for a specific
+// commit are kept apart, as they do not apply the working tree.
+type Queue struct {
+	mutex   sync.Mutex
+	pending []Request
+	ready   chan struct{}
+}
+
+// NewQueue returns an empty Queue.
+func NewQueue() *Queue {
+	return &Queue{ready: make(chan struct{}, 1)}
+}
+
+// Add queues req, unless it is covered by a pending request. It returns false
+// if req was merged into a pending request.
+func (q *Queue) Add(req Request) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for _, p := range q.pending {
+		if p == req || (req.Commit == "" && p.Commit == "" && p.Type == FullRun) {
+			return false
+		}
+	}
+	if req.Type == FullRun && req.Commit == "" {
+		pending := q.pending[:0]
+		for _, p := range q.pending {
+			if p.Commit != "" {
+				pending = append(pending, p)
+			}
+		}
+		q.pending = pending
+	}
+	q.pending = append(q.pending, req)
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Ready returns a channel that receives a value when requests are pending.
+func (q *Queue) Ready() <-chan struct{} {
+	return q.ready
+}
+
+// Next removes the oldest pending request from the queue and returns it,
+// along with false if there is none.
+func (q *Queue) Next() (Request, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.pending) == 0 {
+		return Request{}, false
+	}
+	req := q.pending[0]
+	q.pending = q.pending[1:]
+	return req, true
+}
+
+// Len returns the number of pending requests.
+func (q *Queue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.pending)
+}
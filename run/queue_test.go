@@ -0,0 +1,54 @@
+package run
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// drain returns the pending requests of q, oldest first.
+func drain(q *Queue) []Request {
+	var requests []Request
+	for req, ok := q.Next(); ok; req, ok = q.Next() {
+		requests = append(requests, req)
+	}
+	return requests
+}
+
+func TestQueueAdd(t *testing.T) {
+	assert := assert.New(t)
+	q := NewQueue()
+
+	// Requests are only pending once
+	assert.True(q.Add(Request{Type: PartialRun}))
+	assert.False(q.Add(Request{Type: PartialRun}))
+	assert.True(q.Add(Request{Type: NamespaceRun, Namespace: "foo"}))
+	assert.True(q.Add(Request{Type: NamespaceRun, Namespace: "bar"}))
+	assert.False(q.Add(Request{Type: NamespaceRun, Namespace: "foo"}))
+	assert.True(q.Add(Request{Type: NamespaceRun, Namespace: "foo", Commit: "abc123"}))
+	<-q.Ready()
+	assert.Equal([]Request{
+		{Type: PartialRun},
+		{Type: NamespaceRun, Namespace: "foo"},
+		{Type: NamespaceRun, Namespace: "bar"},
+		{Type: NamespaceRun, Namespace: "foo", Commit: "abc123"},
+	}, drain(q))
+
+	// A full run absorbs the pending and later partial and namespace runs,
+	// but not the runs of a specific commit
+	assert.True(q.Add(Request{Type: PartialRun}))
+	assert.True(q.Add(Request{Type: FullRun, Commit: "abc123"}))
+	assert.True(q.Add(Request{Type: NamespaceRun, Namespace: "foo"}))
+	assert.True(q.Add(Request{Type: FullRun}))
+	assert.False(q.Add(Request{Type: PartialRun}))
+	assert.False(q.Add(Request{Type: NamespaceRun, Namespace: "bar"}))
+	assert.False(q.Add(Request{Type: FullRun}))
+	assert.Equal(2, q.Len())
+	assert.Equal([]Request{
+		{Type: FullRun, Commit: "abc123"},
+		{Type: FullRun},
+	}, drain(q))
+
+	_, ok := q.Next()
+	assert.False(ok)
+}
@@ -0,0 +1,38 @@
+package run
+
+// RequestType describes the scope of an apply run.
+type RequestType int
+
+const (
+	// FullRun applies every namespace directory in the repository.
+	FullRun RequestType = iota
+	// PartialRun applies only the namespace directories that changed since the
+	// last successfully applied commit.
+	PartialRun
+	// NamespaceRun applies a single namespace directory, given by
+	// Request.Namespace.
+	NamespaceRun
+)
+
+// String returns a human readable name for the RequestType.
+func (t RequestType) String() string {
+	switch t {
+	case FullRun:
+		return "full"
+	case PartialRun:
+		return "partial"
+	case NamespaceRun:
+		return "namespace"
+	default:
+		return "unknown"
+	}
+}
+
+// Request is sent to the run queue to ask the Runner for a new run.
+// If Commit is set, that commit is applied instead of the working tree, eg. to
+// roll back a change. Partial runs of a commit apply every namespace.
+type Request struct {
+	Type      RequestType
+	Namespace string
+	Commit    string
+}
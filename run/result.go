@@ -7,15 +7,25 @@ import (
 )
 
 // Result stores the data from a single run of the apply loop.
+// Pinned runs applied a specific commit, rather than the working tree.
 // The functions associated with Result convert raw data into the desired formats for insertion into the status page template.
 type Result struct {
-	Start         time.Time
-	Finish        time.Time
-	CommitHash    string
-	FullCommit    string
-	Successes     []ApplyAttempt
-	Failures      []ApplyAttempt
-	DiffURLFormat string
+	ID            int            `json:"id"`
+	Start         time.Time      `json:"start"`
+	Finish        time.Time      `json:"finish"`
+	CommitHash    string         `json:"commitHash"`
+	FullCommit    string         `json:"fullCommit"`
+	Successes     []ApplyAttempt `json:"successes"`
+	Failures      []ApplyAttempt `json:"failures"`
+	DiffURLFormat string         `json:"diffURLFormat"`
+	ErrorMessage  string         `json:"errorMessage,omitempty"`
+	Pinned        bool           `json:"pinned,omitempty"`
+}
+
+// Success returns true if the run completed and every apply attempt succeeded.
+// Runs that stopped before applying anything, eg. because of unverified commits, report the reason in ErrorMessage.
+func (r *Result) Success() bool {
+	return r.ErrorMessage == "" && len(r.Failures) == 0
 }
 
 // FormattedStart returns the Start time in the format "YYYY-MM-DD hh:mm:ss -0000 GMT"
@@ -1,94 +1,303 @@
 package run
 
 import (
+	"context"
 	"fmt"
 	"path"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/utilitywarehouse/kube-applier/git"
+	"github.com/utilitywarehouse/kube-applier/kube"
+	"github.com/utilitywarehouse/kube-applier/kubectl"
 	"github.com/utilitywarehouse/kube-applier/log"
 	"github.com/utilitywarehouse/kube-applier/metrics"
 	"github.com/utilitywarehouse/kube-applier/sysutil"
 )
 
 // Runner manages the full process of an apply run, including getting the appropriate files, running apply commands on them, and handling the results.
+// Partial runs only apply the namespace directories that changed since the last commit that was applied without failures.
+// With VerifySignatures, nothing is applied unless the HEAD commit is signed, or every commit since VerifiedCommit with
+// VerifyAllCommits. VerifiedCommit is moved to HEAD by each run of the working tree that passes the verification, and
+// can be set on startup to the commit of the latest run in the History.
+// With leader election, Leader is set and requests are dropped unless this replica is the leader.
+// Runs of a specific commit pin it, see Pin, when Pin is set.
+// RepoLock, if set, is held for the duration of each run so that the repository is not updated while it is read, see
+// git.Syncer.ReadLocker.
+// The filters of a running Runner can be changed with Update, from the next run.
 type Runner struct {
-	RepoPath        string
-	RepoPathFilters []string
-	BatchApplier    BatchApplierInterface
-	GitUtil         git.UtilInterface
-	Clock           sysutil.ClockInterface
-	Metrics         metrics.PrometheusInterface
-	DiffURLFormat   string
-	RunQueue        <-chan bool
-	RunResults      chan<- Result
-	Errors          chan<- error
+	RepoPath         string
+	RepoPathFilters  []string
+	BatchApplier     BatchApplierInterface
+	GitUtil          git.UtilInterface
+	Clock            sysutil.ClockInterface
+	Metrics          metrics.PrometheusInterface
+	DiffURLFormat    string
+	VerifySignatures bool
+	VerifyAllCommits bool
+	VerifiedCommit   string
+	Leader           kube.LeaderElectorInterface
+	RepoLock         sync.Locker
+	Pin              *Pin
+	RunQueue         *Queue
+	RunResults       chan<- Result
+	Errors           chan<- error
+	lastAppliedHash  string
+	mutex            sync.Mutex
 }
 
-// Start runs a continuous loop that starts a new run when a request comes into the queue channel.
-func (r *Runner) Start() {
-	for range r.RunQueue {
-		newRun, err := r.run()
-		if err != nil {
-			r.Errors <- err
+// Start runs a continuous loop that starts a new run for each request in the queue, until ctx is cancelled. A run in
+// progress when ctx is cancelled stops after the namespaces being applied, and its Result is sent before RunResults
+// is closed.
+func (r *Runner) Start(ctx context.Context) {
+	defer close(r.RunResults)
+	for {
+		select {
+		case <-ctx.Done():
 			return
+		case <-r.RunQueue.Ready():
+		}
+		for req, ok := r.RunQueue.Next(); ok; req, ok = r.RunQueue.Next() {
+			// Do not start a run after ctx was cancelled
+			if ctx.Err() != nil {
+				return
+			}
+			if r.Leader != nil && !r.Leader.IsLeader() {
+				log.Logger.Debug("Not the leader, skipping run", "type", req.Type, "namespace", req.Namespace)
+				continue
+			}
+			newRun, err := r.run(ctx, req)
+			if err != nil {
+				r.Errors <- err
+				return
+			}
+			if newRun != nil {
+				r.RunResults <- *newRun
+			}
 		}
-		r.RunResults <- *newRun
 	}
 }
 
-// Run performs a full apply run, and returns a Result with data about the completed run (or nil if the run failed to complete).
-func (r *Runner) run() (*Result, error) {
+// Update calls f to change the settings of the Runner.
+func (r *Runner) Update(f func(*Runner)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	f(r)
+}
 
-	start := r.Clock.Now()
-	log.Logger.Info("Started apply run", "start-time", start)
+// repoPathFilters returns the current RepoPathFilters.
+func (r *Runner) repoPathFilters() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.RepoPathFilters
+}
 
-	dirs, err := sysutil.ListDirs(r.RepoPath)
-	if err != nil {
-		return nil, err
+// Run performs an apply run, and returns a Result with data about the completed run (or nil if the run failed to complete or there was nothing to apply).
+// Requests for a specific commit, or covered by the Pin, apply it from a temporary worktree instead of the working tree.
+func (r *Runner) run(ctx context.Context, req Request) (*Result, error) {
+
+	if r.RepoLock != nil {
+		r.RepoLock.Lock()
+		defer r.RepoLock.Unlock()
 	}
 
-	dirs = r.pruneDirs(dirs)
+	start := r.Clock.Now()
+	log.Logger.Info("Started apply run", "start-time", start, "type", req.Type, "commit", req.Commit)
 
-	hash, err := r.GitUtil.HeadHashForPaths(r.RepoPathFilters...)
+	repoPath := r.RepoPath
+	repoPathFilters := r.repoPathFilters()
+	commit, pinnedNamespace, err := r.pinnedCommit(req)
 	if err != nil {
 		return nil, err
 	}
-	commitLog, err := r.GitUtil.HeadCommitLogForPaths(r.RepoPathFilters...)
+	var hash, commitLog string
+	if commit != "" {
+		wt, err := r.GitUtil.AddWorktree(commit)
+		if err != nil {
+			log.Logger.Error("Could not check out commit", "commit", commit, "error", err)
+			return r.failedRun(start, commit, "", fmt.Sprintf("Could not check out commit %s: %v", commit, err)), nil
+		}
+		defer func() {
+			if err := r.GitUtil.RemoveWorktree(wt); err != nil {
+				log.Logger.Warn("Could not remove worktree", "dir", wt.Dir, "error", err)
+			}
+		}()
+		repoPath = wt.RepoPath
+		hash = wt.Commit
+		commitLog, err = r.GitUtil.CommitLogForPaths(hash, repoPathFilters...)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		hash, err = r.GitUtil.HeadHashForPaths(repoPathFilters...)
+		if err != nil {
+			return nil, err
+		}
+		commitLog, err = r.GitUtil.HeadCommitLogForPaths(repoPathFilters...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dirs, err := sysutil.ListDirs(repoPath)
 	if err != nil {
 		return nil, err
 	}
 
+	dirs = r.pruneDirs(repoPath, dirs)
+	if pinnedNamespace != "" {
+		dirs = r.withoutNamespace(dirs, pinnedNamespace)
+	}
+
+	if r.VerifySignatures {
+		since, until := "", "HEAD"
+		if commit != "" {
+			until = hash
+		} else if r.VerifyAllCommits {
+			since = r.VerifiedCommit
+		}
+		if err := r.GitUtil.VerifyCommits(since, until); err != nil {
+			log.Logger.Error("Refusing to apply unverified commits", "commit", hash, "error", err)
+			return r.failedRun(start, hash, commitLog, fmt.Sprintf("Refusing to apply, commit signature verification failed: %v", err)), nil
+		}
+		if commit == "" {
+			r.VerifiedCommit = hash
+		}
+	}
+
+	if req.Commit != "" && r.Pin != nil {
+		head, err := r.GitUtil.HeadHashForPaths()
+		if err != nil {
+			return nil, err
+		}
+		log.Logger.Info("Pinning commit", "commit", hash, "namespace", req.Namespace, "head", head)
+		r.Pin.set(hash, req.Namespace, head)
+	}
+
+	switch req.Type {
+	case PartialRun:
+		if commit != "" {
+			break
+		}
+		dirs = r.changedDirs(dirs)
+		if len(dirs) == 0 {
+			log.Logger.Info("No changed dirs since last applied commit, skipping run", "commit", r.lastAppliedHash)
+			r.lastAppliedHash = hash
+			return nil, nil
+		}
+	case NamespaceRun:
+		dirs = r.namespaceDirs(dirs, req.Namespace)
+		if len(dirs) == 0 {
+			log.Logger.Warn("No dir found for namespace, skipping run", "namespace", req.Namespace)
+			return nil, nil
+		}
+	}
+
 	log.Logger.Debug(fmt.Sprintf("applying dirs: %v", dirs))
-	successes, failures := r.BatchApplier.Apply(dirs)
+	successes, failures := r.BatchApplier.Apply(ctx, dirs)
 
 	finish := r.Clock.Now()
 
 	log.Logger.Info("Finished apply run", "stop-time", finish)
 
-	success := len(failures) == 0
+	var errorMessage string
+	if ctx.Err() != nil {
+		errorMessage = "Run interrupted by shutdown, some dirs may not have been applied"
+	}
+
+	success := len(failures) == 0 && errorMessage == ""
 
-	results := make(map[string]string)
+	results := make(map[string][]kubectl.ObjectResult)
 	for _, s := range successes {
-		results[s.FilePath] = s.Output
+		results[s.FilePath] = s.Results
+	}
+	for _, f := range failures {
+		results[f.FilePath] = f.Results
 	}
 	r.Metrics.UpdateResultSummary(results)
 
 	r.Metrics.UpdateRunLatency(r.Clock.Since(start).Seconds(), success)
 
-	newRun := Result{start, finish, hash, commitLog, successes, failures, r.DiffURLFormat}
+	switch {
+	case commit != "":
+		// The cluster does not match the working tree anymore, so the next
+		// partial run applies every dir.
+		r.lastAppliedHash = ""
+	case success && req.Type != NamespaceRun:
+		// A single namespace says nothing about the state of the others, so it
+		// does not move the last applied commit forward.
+		r.lastAppliedHash = hash
+	}
+
+	newRun := Result{
+		Start:         start,
+		Finish:        finish,
+		CommitHash:    hash,
+		FullCommit:    commitLog,
+		Successes:     successes,
+		Failures:      failures,
+		DiffURLFormat: r.DiffURLFormat,
+		ErrorMessage:  errorMessage,
+		Pinned:        commit != "",
+	}
 	return &newRun, nil
 }
 
-func (r *Runner) pruneDirs(dirs []string) []string {
-	if len(r.RepoPathFilters) == 0 {
+// pinnedCommit returns the commit to apply for req: its own, or the pinned commit if req is a run of the working tree
+// covered by the Pin. The runs of the working tree not covered by a Pin for a single namespace skip it, and it is
+// returned as well. The Pin is removed once HEAD moves past the commit it was set at.
+func (r *Runner) pinnedCommit(req Request) (string, string, error) {
+	commit, namespace, head := r.Pin.get()
+	if req.Commit != "" || commit == "" {
+		return req.Commit, "", nil
+	}
+	current, err := r.GitUtil.HeadHashForPaths()
+	if err != nil {
+		return "", "", err
+	}
+	if current != head {
+		log.Logger.Info("HEAD moved past the pinned commit, unpinning", "commit", commit, "namespace", namespace, "head", current)
+		r.Pin.Unpin()
+		// The pinned namespaces do not match the last applied commit, so
+		// the next partial run applies every dir.
+		r.lastAppliedHash = ""
+		return "", "", nil
+	}
+	if namespace == "" || (req.Type == NamespaceRun && req.Namespace == namespace) {
+		return commit, "", nil
+	}
+	return "", namespace, nil
+}
+
+// failedRun returns the Result of a run that stopped before applying anything.
+func (r *Runner) failedRun(start time.Time, hash, commitLog, message string) *Result {
+	r.Metrics.UpdateRunLatency(r.Clock.Since(start).Seconds(), false)
+	return &Result{
+		Start:         start,
+		Finish:        r.Clock.Now(),
+		CommitHash:    hash,
+		FullCommit:    commitLog,
+		Successes:     []ApplyAttempt{},
+		Failures:      []ApplyAttempt{},
+		DiffURLFormat: r.DiffURLFormat,
+		ErrorMessage:  message,
+	}
+}
+
+// pruneDirs filters dirs, listed from repoPath, down to the ones matching
+// RepoPathFilters relative to repoPath.
+func (r *Runner) pruneDirs(repoPath string, dirs []string) []string {
+	repoPathFilters := r.repoPathFilters()
+	if len(repoPathFilters) == 0 {
 		return dirs
 	}
 
 	var prunedDirs []string
 	for _, dir := range dirs {
-		for _, repoPathFilter := range r.RepoPathFilters {
-			matched, err := filepath.Match(path.Join(r.RepoPath, repoPathFilter), dir)
+		for _, repoPathFilter := range repoPathFilters {
+			matched, err := filepath.Match(path.Join(repoPath, repoPathFilter), dir)
 			if err != nil {
 				log.Logger.Error(err.Error())
 			} else if matched {
@@ -99,3 +308,54 @@ func (r *Runner) pruneDirs(dirs []string) []string {
 
 	return prunedDirs
 }
+
+// changedDirs filters dirs down to the ones containing changes between the
+// last applied commit and HEAD. All dirs are returned if there is no
+// previously applied commit or the changes cannot be determined.
+func (r *Runner) changedDirs(dirs []string) []string {
+	if r.lastAppliedHash == "" {
+		log.Logger.Info("No previously applied commit, applying all dirs")
+		return dirs
+	}
+
+	files, err := r.GitUtil.ChangedFilesForPaths(r.lastAppliedHash)
+	if err != nil {
+		log.Logger.Warn("Could not get changes since last applied commit, applying all dirs", "commit", r.lastAppliedHash, "error", err)
+		return dirs
+	}
+
+	changed := make(map[string]bool)
+	for _, f := range files {
+		changed[filepath.Join(r.RepoPath, strings.SplitN(f, "/", 2)[0])] = true
+	}
+
+	var changedDirs []string
+	for _, dir := range dirs {
+		if changed[filepath.Clean(dir)] {
+			changedDirs = append(changedDirs, dir)
+		}
+	}
+
+	return changedDirs
+}
+
+// namespaceDirs filters dirs down to the one matching the given namespace.
+// withoutNamespace returns dirs without the dir of namespace.
+func (r *Runner) withoutNamespace(dirs []string, namespace string) []string {
+	var filtered []string
+	for _, dir := range dirs {
+		if filepath.Base(dir) != namespace {
+			filtered = append(filtered, dir)
+		}
+	}
+	return filtered
+}
+
+func (r *Runner) namespaceDirs(dirs []string, namespace string) []string {
+	for _, dir := range dirs {
+		if filepath.Base(dir) == namespace {
+			return []string{dir}
+		}
+	}
+	return nil
+}
@@ -1,9 +1,22 @@
 package run
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/utilitywarehouse/kube-applier/git"
+	"github.com/utilitywarehouse/kube-applier/kube"
+	"github.com/utilitywarehouse/kube-applier/log"
+	"github.com/utilitywarehouse/kube-applier/metrics"
+	"github.com/utilitywarehouse/kube-applier/sysutil"
+
+	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -28,8 +41,16 @@ func TestPruneDirsWithFilter(t *testing.T) {
 /repo/webserver
 `, "\n")
 
-	prunedDirs := runner.pruneDirs(dirs)
+	prunedDirs := runner.pruneDirs(runner.RepoPath, dirs)
 	assert.Len(t, prunedDirs, 5)
+
+	// Dirs listed from a worktree are matched relative to it
+	var worktreeDirs []string
+	for _, dir := range dirs {
+		worktreeDirs = append(worktreeDirs, strings.Replace(dir, "/repo/", "/tmp/worktree/repo/", 1))
+	}
+	prunedDirs = runner.pruneDirs("/tmp/worktree/repo", worktreeDirs)
+	assert.Equal(t, []string{"/tmp/worktree/repo/manifests", "/tmp/worktree/repo/run", "/tmp/worktree/repo/sysutil", "/tmp/worktree/repo/sys-log", "/tmp/worktree/repo/webserver"}, prunedDirs)
 }
 
 func TestPruneDirsWithoutFilter(t *testing.T) {
@@ -53,6 +74,339 @@ func TestPruneDirsWithoutFilter(t *testing.T) {
 /repo/webserver
 `, "\n")
 
-	prunedDirs := runner.pruneDirs(dirs)
+	prunedDirs := runner.pruneDirs(runner.RepoPath, dirs)
 	assert.Len(t, prunedDirs, 14)
 }
+
+func TestChangedDirs(t *testing.T) {
+	log.InitLogger("info")
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	gitUtil := git.NewMockUtilInterface(mockCtrl)
+	runner := Runner{
+		RepoPath:        "/repo/",
+		GitUtil:         gitUtil,
+		lastAppliedHash: "abc123",
+	}
+
+	dirs := []string{"/repo/ns-a", "/repo/ns-b", "/repo/ns-c"}
+
+	gitUtil.EXPECT().ChangedFilesForPaths("abc123").Times(1).Return([]string{
+		"ns-a/deployment.yaml",
+		"ns-c/kustomization.yaml",
+		"ns-c/service.yaml",
+		"ns-deleted/service.yaml",
+		"README.md",
+	}, nil)
+	assert.Equal(t, []string{"/repo/ns-a", "/repo/ns-c"}, runner.changedDirs(dirs))
+
+	// No changes
+	gitUtil.EXPECT().ChangedFilesForPaths("abc123").Times(1).Return(nil, nil)
+	assert.Len(t, runner.changedDirs(dirs), 0)
+
+	// Changes cannot be determined, apply everything
+	gitUtil.EXPECT().ChangedFilesForPaths("abc123").Times(1).Return(nil, fmt.Errorf("unknown revision"))
+	assert.Equal(t, dirs, runner.changedDirs(dirs))
+
+	// No previously applied commit, apply everything
+	runner.lastAppliedHash = ""
+	assert.Equal(t, dirs, runner.changedDirs(dirs))
+}
+
+func TestNamespaceDirs(t *testing.T) {
+	runner := Runner{
+		RepoPath: "/repo/",
+	}
+
+	dirs := []string{"/repo/ns-a", "/repo/ns-b", "/repo/ns-c"}
+
+	assert.Equal(t, []string{"/repo/ns-b"}, runner.namespaceDirs(dirs, "ns-b"))
+	assert.Len(t, runner.namespaceDirs(dirs, "ns-d"), 0)
+	assert.Len(t, runner.namespaceDirs(dirs, ""), 0)
+}
+
+func TestRunnerRunUnverifiedCommits(t *testing.T) {
+	log.InitLogger("info")
+	assert := assert.New(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	gitUtil := git.NewMockUtilInterface(mockCtrl)
+	clock := sysutil.NewMockClockInterface(mockCtrl)
+	metrics := metrics.NewMockPrometheusInterface(mockCtrl)
+
+	repoLock := &fakeLocker{}
+	runner := Runner{
+		RepoPath:         os.TempDir(),
+		GitUtil:          gitUtil,
+		Clock:            clock,
+		Metrics:          metrics,
+		VerifySignatures: true,
+		VerifyAllCommits: true,
+		VerifiedCommit:   "a",
+		RepoLock:         repoLock,
+		lastAppliedHash:  "a",
+	}
+
+	clock.EXPECT().Now().AnyTimes().Return(time.Time{})
+	clock.EXPECT().Since(gomock.Any()).AnyTimes().Return(time.Duration(0))
+	gomock.InOrder(
+		gitUtil.EXPECT().HeadHashForPaths().Times(1).DoAndReturn(func(args ...string) (string, error) {
+			// The repository is read with the lock held
+			assert.True(repoLock.locked)
+			return "b", nil
+		}),
+		gitUtil.EXPECT().HeadCommitLogForPaths().Times(1).Return("log b", nil),
+		gitUtil.EXPECT().VerifyCommits("a", "HEAD").Times(1).Return(fmt.Errorf("no signature")),
+		metrics.EXPECT().UpdateRunLatency(float64(0), false).Times(1),
+	)
+
+	result, err := runner.run(context.Background(), Request{Type: FullRun})
+	assert.Nil(err)
+	assert.False(result.Success())
+	assert.Equal("b", result.CommitHash)
+	assert.Equal("Refusing to apply, commit signature verification failed: no signature", result.ErrorMessage)
+	assert.Equal("a", runner.lastAppliedHash)
+	assert.Equal("a", runner.VerifiedCommit)
+	assert.False(repoLock.locked)
+}
+
+type fakeLocker struct {
+	locked bool
+}
+
+func (l *fakeLocker) Lock()   { l.locked = true }
+func (l *fakeLocker) Unlock() { l.locked = false }
+
+type fakeBatchApplier struct {
+	applied []string
+}
+
+func (b *fakeBatchApplier) Apply(ctx context.Context, dirs []string) ([]ApplyAttempt, []ApplyAttempt) {
+	b.applied = dirs
+	successes := []ApplyAttempt{}
+	for _, d := range dirs {
+		successes = append(successes, ApplyAttempt{FilePath: d})
+	}
+	return successes, []ApplyAttempt{}
+}
+
+func TestRunnerRunCommit(t *testing.T) {
+	log.InitLogger("info")
+	assert := assert.New(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	worktree, err := ioutil.TempDir("", "kube-applier-runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(worktree)
+	for _, d := range []string{"ns-a", "ns-b", "other"} {
+		if err := os.Mkdir(filepath.Join(worktree, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gitUtil := git.NewMockUtilInterface(mockCtrl)
+	batchApplier := &fakeBatchApplier{}
+	clock := sysutil.NewMockClockInterface(mockCtrl)
+	metrics := metrics.NewMockPrometheusInterface(mockCtrl)
+
+	runner := Runner{
+		RepoPath:         "/repo",
+		RepoPathFilters:  []string{"ns-*"},
+		BatchApplier:     batchApplier,
+		GitUtil:          gitUtil,
+		Clock:            clock,
+		Metrics:          metrics,
+		VerifySignatures: true,
+		lastAppliedHash:  "b",
+	}
+
+	wt := git.Worktree{Dir: worktree, RepoPath: worktree, Commit: "aaaa"}
+	clock.EXPECT().Now().AnyTimes().Return(time.Time{})
+	clock.EXPECT().Since(gomock.Any()).AnyTimes().Return(time.Duration(0))
+	gomock.InOrder(
+		gitUtil.EXPECT().AddWorktree("aa").Times(1).Return(wt, nil),
+		gitUtil.EXPECT().CommitLogForPaths("aaaa", "ns-*").Times(1).Return("log aaaa", nil),
+		gitUtil.EXPECT().VerifyCommits("", "aaaa").Times(1).Return(nil),
+		metrics.EXPECT().UpdateResultSummary(gomock.Any()).Times(1),
+		metrics.EXPECT().UpdateRunLatency(float64(0), true).Times(1),
+		gitUtil.EXPECT().RemoveWorktree(wt).Times(1).Return(nil),
+	)
+
+	result, err := runner.run(context.Background(), Request{Type: FullRun, Commit: "aa"})
+	assert.Nil(err)
+	assert.True(result.Success())
+	assert.True(result.Pinned)
+	assert.Equal("aaaa", result.CommitHash)
+	assert.Equal([]string{filepath.Join(worktree, "ns-a"), filepath.Join(worktree, "ns-b")}, batchApplier.applied)
+	// The next partial run applies everything, to undo the pinned commit
+	assert.Equal("", runner.lastAppliedHash)
+
+	// Commits that cannot be checked out are reported in the result
+	gomock.InOrder(
+		gitUtil.EXPECT().AddWorktree("bad").Times(1).Return(git.Worktree{}, fmt.Errorf("commit not found")),
+		metrics.EXPECT().UpdateRunLatency(float64(0), false).Times(1),
+	)
+	result, err = runner.run(context.Background(), Request{Type: FullRun, Commit: "bad"})
+	assert.Nil(err)
+	assert.False(result.Success())
+	assert.Equal("Could not check out commit bad: commit not found", result.ErrorMessage)
+}
+
+func TestRunnerRunPin(t *testing.T) {
+	log.InitLogger("info")
+	assert := assert.New(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	repo, err := ioutil.TempDir("", "kube-applier-runner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repo)
+	for _, d := range []string{"ns-a", "ns-b"} {
+		if err := os.Mkdir(filepath.Join(repo, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gitUtil := git.NewMockUtilInterface(mockCtrl)
+	batchApplier := &fakeBatchApplier{}
+	clock := sysutil.NewMockClockInterface(mockCtrl)
+	metrics := metrics.NewMockPrometheusInterface(mockCtrl)
+	pin := &Pin{}
+
+	runner := Runner{
+		RepoPath:        repo,
+		RepoPathFilters: []string{"ns-*"},
+		BatchApplier:    batchApplier,
+		GitUtil:         gitUtil,
+		Clock:           clock,
+		Metrics:         metrics,
+		Pin:             pin,
+		lastAppliedHash: "b",
+	}
+
+	wt := git.Worktree{Dir: repo, RepoPath: repo, Commit: "aaaa"}
+	clock.EXPECT().Now().AnyTimes().Return(time.Time{})
+	clock.EXPECT().Since(gomock.Any()).AnyTimes().Return(time.Duration(0))
+	metrics.EXPECT().UpdateResultSummary(gomock.Any()).AnyTimes()
+	metrics.EXPECT().UpdateRunLatency(float64(0), true).AnyTimes()
+
+	// A run of a commit pins it
+	gomock.InOrder(
+		gitUtil.EXPECT().AddWorktree("aa").Times(1).Return(wt, nil),
+		gitUtil.EXPECT().CommitLogForPaths("aaaa", "ns-*").Times(1).Return("log aaaa", nil),
+		gitUtil.EXPECT().HeadHashForPaths().Times(1).Return("c", nil),
+		gitUtil.EXPECT().RemoveWorktree(wt).Times(1).Return(nil),
+	)
+	result, err := runner.run(context.Background(), Request{Type: FullRun, Commit: "aa"})
+	assert.Nil(err)
+	assert.True(result.Pinned)
+	assert.Equal("aaaa", pin.Commit())
+	assert.Equal("", pin.Namespace())
+
+	// Runs of the working tree apply the pinned commit while HEAD does not move
+	gomock.InOrder(
+		gitUtil.EXPECT().HeadHashForPaths().Times(1).Return("c", nil),
+		gitUtil.EXPECT().AddWorktree("aaaa").Times(1).Return(wt, nil),
+		gitUtil.EXPECT().CommitLogForPaths("aaaa", "ns-*").Times(1).Return("log aaaa", nil),
+		gitUtil.EXPECT().RemoveWorktree(wt).Times(1).Return(nil),
+	)
+	result, err = runner.run(context.Background(), Request{Type: FullRun})
+	assert.Nil(err)
+	assert.True(result.Pinned)
+	assert.Equal("aaaa", result.CommitHash)
+	assert.Equal("aaaa", pin.Commit())
+
+	// The pin is removed once HEAD moves, and every dir is applied
+	gomock.InOrder(
+		gitUtil.EXPECT().HeadHashForPaths().Times(1).Return("d", nil),
+		gitUtil.EXPECT().HeadHashForPaths("ns-*").Times(1).Return("d", nil),
+		gitUtil.EXPECT().HeadCommitLogForPaths("ns-*").Times(1).Return("log d", nil),
+	)
+	result, err = runner.run(context.Background(), Request{Type: PartialRun})
+	assert.Nil(err)
+	assert.False(result.Pinned)
+	assert.Equal("d", result.CommitHash)
+	assert.Equal("", pin.Commit())
+	assert.Equal([]string{filepath.Join(repo, "ns-a"), filepath.Join(repo, "ns-b")}, batchApplier.applied)
+
+	// A commit applied to a namespace is only pinned for it
+	gomock.InOrder(
+		gitUtil.EXPECT().AddWorktree("aa").Times(1).Return(wt, nil),
+		gitUtil.EXPECT().CommitLogForPaths("aaaa", "ns-*").Times(1).Return("log aaaa", nil),
+		gitUtil.EXPECT().HeadHashForPaths().Times(1).Return("d", nil),
+		gitUtil.EXPECT().RemoveWorktree(wt).Times(1).Return(nil),
+	)
+	_, err = runner.run(context.Background(), Request{Type: NamespaceRun, Namespace: "ns-a", Commit: "aa"})
+	assert.Nil(err)
+	assert.Equal("aaaa", pin.Commit())
+	assert.Equal("ns-a", pin.Namespace())
+
+	gomock.InOrder(
+		gitUtil.EXPECT().HeadHashForPaths().Times(1).Return("d", nil),
+		gitUtil.EXPECT().HeadHashForPaths("ns-*").Times(1).Return("d", nil),
+		gitUtil.EXPECT().HeadCommitLogForPaths("ns-*").Times(1).Return("log d", nil),
+	)
+	result, err = runner.run(context.Background(), Request{Type: FullRun})
+	assert.Nil(err)
+	assert.False(result.Pinned)
+	assert.Equal([]string{filepath.Join(repo, "ns-b")}, batchApplier.applied)
+
+	gomock.InOrder(
+		gitUtil.EXPECT().HeadHashForPaths().Times(1).Return("d", nil),
+		gitUtil.EXPECT().AddWorktree("aaaa").Times(1).Return(wt, nil),
+		gitUtil.EXPECT().CommitLogForPaths("aaaa", "ns-*").Times(1).Return("log aaaa", nil),
+		gitUtil.EXPECT().RemoveWorktree(wt).Times(1).Return(nil),
+	)
+	result, err = runner.run(context.Background(), Request{Type: NamespaceRun, Namespace: "ns-a"})
+	assert.Nil(err)
+	assert.True(result.Pinned)
+	assert.Equal([]string{filepath.Join(repo, "ns-a")}, batchApplier.applied)
+
+	// Unpin removes the pin
+	assert.True(pin.Unpin())
+	assert.Equal("", pin.Commit())
+	assert.False(pin.Unpin())
+}
+
+func TestRunnerStartFollower(t *testing.T) {
+	log.InitLogger("info")
+	assert := assert.New(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	// Followers drop run requests, RunResults is closed once ctx is cancelled
+	leader := kube.NewMockLeaderElectorInterface(mockCtrl)
+	leader.EXPECT().IsLeader().MinTimes(1).MaxTimes(2).Return(false)
+	batchApplier := &fakeBatchApplier{}
+	runQueue := NewQueue()
+	runResults := make(chan Result, 1)
+	runner := Runner{
+		BatchApplier: batchApplier,
+		Leader:       leader,
+		RunQueue:     runQueue,
+		RunResults:   runResults,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runner.Start(ctx)
+		close(done)
+	}()
+	runQueue.Add(Request{Type: FullRun})
+	runQueue.Add(Request{Type: NamespaceRun, Namespace: "foo"})
+	for runQueue.Len() > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+	_, ok := <-runResults
+	assert.False(ok)
+	assert.Nil(batchApplier.applied)
+}
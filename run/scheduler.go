@@ -1,6 +1,8 @@
 package run
 
 import (
+	"context"
+	"sync"
 	"time"
 
 	"github.com/utilitywarehouse/kube-applier/git"
@@ -8,61 +10,96 @@ import (
 )
 
 // Scheduler handles queueing apply runs at a given time interval and upon every new Git commit.
+// The intervals and filters of a running Scheduler can be changed with Update.
 type Scheduler struct {
 	GitUtil         git.UtilInterface
 	PollInterval    time.Duration
 	FullRunInterval time.Duration
 	RepoPathFilters []string
-	RunQueue        chan<- bool
+	RunQueue        *Queue
 	Errors          chan<- error
+	mutex           sync.Mutex
+	updated         chan struct{}
 }
 
 // Start runs a continuous loop with two tickers for queueing runs.
-// One ticker queues a new run every X seconds, where X is the value from $FULL_RUN_INTERVAL_SECONDS.
-// The other ticker queues a new run upon every new Git commit, checking the repo every Y seconds where Y is the value from $POLL_INTERVAL_SECONDS.
-func (s *Scheduler) Start() {
-	if s.FullRunInterval != 0 {
-		fullRunTicker := time.NewTicker(s.FullRunInterval)
+// One ticker queues a new full run every X seconds, where X is the value from $FULL_RUN_INTERVAL_SECONDS.
+// The other ticker queues a new partial run upon every new Git commit, checking the repo every Y seconds where Y is the value from $POLL_INTERVAL_SECONDS.
+// Both stop when ctx is cancelled, and are restarted with the new intervals after an Update.
+func (s *Scheduler) Start(ctx context.Context) {
+	lastCommitHash := ""
+	for s.schedule(ctx, &lastCommitHash) {
+	}
+}
+
+// Update calls f to change the settings of the Scheduler, and restarts the tickers.
+func (s *Scheduler) Update(f func(*Scheduler)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	f(s)
+	select {
+	case s.updatedChan() <- struct{}{}:
+	default:
+	}
+}
+
+// schedule queues runs with the current settings until ctx is cancelled, or
+// the Scheduler is updated, in which case it returns true.
+func (s *Scheduler) schedule(ctx context.Context, lastCommitHash *string) bool {
+	s.mutex.Lock()
+	pollInterval, fullRunInterval, repoPathFilters := s.PollInterval, s.FullRunInterval, s.RepoPathFilters
+	updated := s.updatedChan()
+	s.mutex.Unlock()
+
+	var fullRunTickerChan <-chan time.Time
+	if fullRunInterval != 0 {
+		fullRunTicker := time.NewTicker(fullRunInterval)
 		defer fullRunTicker.Stop()
-		fullRunTickerChan := fullRunTicker.C
-		go func() {
-			for {
-				select {
-				case <-fullRunTickerChan:
-					log.Logger.Info("Full run interval reached, queueing run", "interval", s.FullRunInterval)
-					s.enqueue(s.RunQueue)
-				}
-			}
-		}()
+		fullRunTickerChan = fullRunTicker.C
 	}
 
-	pollTicker := time.NewTicker(s.PollInterval)
+	pollTicker := time.NewTicker(pollInterval)
 	defer pollTicker.Stop()
 	pollTickerChan := pollTicker.C
-	lastCommitHash := ""
 	for {
 		select {
+		case <-ctx.Done():
+			return false
+		case <-updated:
+			log.Logger.Info("Scheduler updated, restarting tickers")
+			return true
+		case <-fullRunTickerChan:
+			log.Logger.Info("Full run interval reached, queueing run", "interval", fullRunInterval)
+			s.enqueue(Request{Type: FullRun})
 		case <-pollTickerChan:
-			newCommitHash, err := s.GitUtil.HeadHashForPaths(s.RepoPathFilters...)
+			newCommitHash, err := s.GitUtil.HeadHashForPaths(repoPathFilters...)
 			if err != nil {
 				s.Errors <- err
-				return
+				return false
 			}
-			if newCommitHash != lastCommitHash {
-				log.Logger.Info("Queueing run", "newest-commit", newCommitHash, "last-commit", lastCommitHash)
-				s.enqueue(s.RunQueue)
-				lastCommitHash = newCommitHash
+			if newCommitHash != *lastCommitHash {
+				log.Logger.Info("Queueing run", "newest-commit", newCommitHash, "last-commit", *lastCommitHash)
+				s.enqueue(Request{Type: PartialRun})
+				*lastCommitHash = newCommitHash
 			}
 		}
 	}
 }
 
-// enqueue attempts to add a run to the queue, logging the result of the request.
-func (s *Scheduler) enqueue(runQueue chan<- bool) {
-	select {
-	case runQueue <- true:
-		log.Logger.Info("Run queued")
-	default:
-		log.Logger.Info("Run queue is already full")
+// updatedChan returns the channel signalling updates, which must be called
+// with the mutex held.
+func (s *Scheduler) updatedChan() chan struct{} {
+	if s.updated == nil {
+		s.updated = make(chan struct{}, 1)
+	}
+	return s.updated
+}
+
+// enqueue adds a run to the queue, logging whether it was merged into a pending run.
+func (s *Scheduler) enqueue(req Request) {
+	if s.RunQueue.Add(req) {
+		log.Logger.Info("Run queued", "type", req.Type)
+	} else {
+		log.Logger.Info("Run already pending", "type", req.Type)
 	}
 }
@@ -0,0 +1,63 @@
+package run
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/utilitywarehouse/kube-applier/git"
+	"github.com/utilitywarehouse/kube-applier/log"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchedulerUpdate(t *testing.T) {
+	log.InitLogger("info")
+	assert := assert.New(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	gitUtil := git.NewMockUtilInterface(mockCtrl)
+	q := NewQueue()
+	s := &Scheduler{
+		GitUtil:      gitUtil,
+		PollInterval: time.Hour,
+		RunQueue:     q,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		s.Start(ctx)
+		close(done)
+	}()
+
+	// The new poll interval and filters are used straight away
+	gitUtil.EXPECT().HeadHashForPaths("ns-*").MinTimes(1).Return("a", nil)
+	s.Update(func(s *Scheduler) {
+		s.PollInterval = 10 * time.Millisecond
+		s.RepoPathFilters = []string{"ns-*"}
+	})
+	select {
+	case <-q.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a partial run to be queued")
+	}
+	assert.Equal([]Request{{Type: PartialRun}}, drain(q))
+
+	// The full run ticker is started once the interval is set, the last
+	// commit is kept so that no partial run is queued
+	s.Update(func(s *Scheduler) {
+		s.FullRunInterval = 10 * time.Millisecond
+	})
+	select {
+	case <-q.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a full run to be queued")
+	}
+	assert.Equal([]Request{{Type: FullRun}}, drain(q))
+
+	cancel()
+	<-done
+}
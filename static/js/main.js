@@ -1,27 +1,79 @@
-// On button click, sends empty POST request to API endpoint for forcing a run and shows a relevant alert when a response is received.
+// On button click, sends POST request to API endpoint for forcing a run and shows a relevant alert when a response is received.
+// The per-namespace buttons only force a run for their namespace, and the commit buttons apply the commit of a past run
+// instead of the working tree, after asking for confirmation and for the webhook secret, which is also required to unpin
+// the commit.
+// Failures of the built-in Git sync are shown on page load.
 $(document).ready(function() {
+    showGitSyncStatus();
     $('#force-button').bind('click', function(){
-        // Disable the button and close existing alert
-        $('#force-button').prop('disabled', true);
-        $('#force-alert').alert('close')
+        forceRun($(this), {});
+    });
+    $('.force-namespace-button').bind('click', function(){
+        data = {namespace: $(this).data('namespace')};
+        secret = null;
+        if ($(this).attr('data-commit')) {
+            if (!confirm('Apply commit ' + $(this).attr('data-commit') + ' to namespace ' + data.namespace + '?')) {
+                return;
+            }
+            data.commit = $(this).attr('data-commit');
+            secret = prompt('Webhook secret:');
+            if (secret === null) {
+                return;
+            }
+        }
+        forceRun($(this), data, secret);
+    });
+    $('.force-commit-button').bind('click', function(){
+        if (!confirm('Apply commit ' + $(this).attr('data-commit') + ' to every namespace?')) {
+            return;
+        }
+        secret = prompt('Webhook secret:');
+        if (secret === null) {
+            return;
+        }
+        forceRun($(this), {commit: $(this).attr('data-commit')}, secret);
+    });
+    $('#unpin-button').bind('click', function(){
+        secret = prompt('Webhook secret:');
+        if (secret === null) {
+            return;
+        }
+        forceRun($(this), {}, secret, '/unpin');
+    });
+});
 
-        url =  window.location.href + 'api/v1/forceRun';
-        $.ajax({
-            type: 'POST',
-            url: url,
-            data: {},
-            dataType: "json",
-            success:function(data) {
-                showForceAlert(true, data.message)
-                $('#force-button').prop('disabled', false);
-            },
-            error:function() {
+// Disable the button while the request is in flight and show the outcome in an alert. The secret, if any, is sent as
+// a bearer token. The request is sent to the forceRun endpoint unless another path is given.
+function forceRun(button, data, secret, path) {
+    // Disable the button and close existing alert
+    button.prop('disabled', true);
+    $('#force-alert').alert('close')
+
+    url = $('body').data('api-path') + (path || '/forceRun');
+    headers = {};
+    if (secret) {
+        headers['Authorization'] = 'Bearer ' + secret;
+    }
+    $.ajax({
+        type: 'POST',
+        url: url,
+        data: data,
+        headers: headers,
+        dataType: "json",
+        success:function(data) {
+            showForceAlert(true, data.message)
+            button.prop('disabled', false);
+        },
+        error:function(xhr) {
+            if (xhr.responseJSON && xhr.responseJSON.message) {
+                showForceAlert(false, xhr.responseJSON.message)
+            } else {
                 showForceAlert(false, 'Server error attempting to force a run. See container logs for more info.')
-                $('#force-button').prop('disabled', false);
             }
-        });
+            button.prop('disabled', false);
+        }
     });
-});
+}
 
 // Show a relevant alert message, styled based on the "success" of the associated response.
 function showForceAlert(success, message) {
@@ -34,3 +86,21 @@ function showForceAlert(success, message) {
             '</button>' + message +
         '</div>');
 }
+
+// Show an alert if the last attempt of the built-in Git sync failed. The API returns a 404 when it is not enabled.
+function showGitSyncStatus() {
+    $.ajax({
+        type: 'GET',
+        url: '/api/v1/gitSync',
+        dataType: "json",
+        success:function(data) {
+            if (!data.error) {
+                return;
+            }
+            $('#git-sync-alert-container').append(
+                '<div class="alert alert-danger" role="alert"><strong>Git sync failed at ' + data.lastAttempt +
+                    ', last successful sync at ' + data.lastSuccess + ':</strong><pre></pre></div>');
+            $('#git-sync-alert-container pre').text(data.error);
+        }
+    });
+}
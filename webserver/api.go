@@ -0,0 +1,155 @@
+package webserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/utilitywarehouse/kube-applier/config"
+	"github.com/utilitywarehouse/kube-applier/git"
+	"github.com/utilitywarehouse/kube-applier/log"
+	"github.com/utilitywarehouse/kube-applier/run"
+)
+
+// runResponse is the JSON representation of a run.Result served by the API.
+type runResponse struct {
+	run.Result
+	Success        bool   `json:"success"`
+	LastCommitLink string `json:"lastCommitLink"`
+}
+
+// namespaceResponse is the JSON representation of the most recent apply
+// attempt for a namespace served by the API.
+type namespaceResponse struct {
+	Namespace  string           `json:"namespace"`
+	RunID      int              `json:"runId"`
+	CommitHash string           `json:"commitHash"`
+	Success    bool             `json:"success"`
+	Attempt    run.ApplyAttempt `json:"attempt"`
+}
+
+// errorResponse matches the format of the ForceRunHandler responses.
+type errorResponse struct {
+	Result  string `json:"result"`
+	Message string `json:"message"`
+}
+
+func newRunResponse(r run.Result) runResponse {
+	return runResponse{r, r.Success(), r.LastCommitLink()}
+}
+
+// RunsAPIHandler implements the http.Handler interface and serves the runs kept in the History as JSON, most recent first.
+type RunsAPIHandler struct {
+	History *run.History
+}
+
+// ServeHTTP writes the list of stored runs.
+func (h *RunsAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	runs := []runResponse{}
+	for _, result := range h.History.List() {
+		runs = append(runs, newRunResponse(result))
+	}
+	writeJSON(w, http.StatusOK, runs)
+}
+
+// RunAPIHandler implements the http.Handler interface and serves a single run from the History as JSON.
+type RunAPIHandler struct {
+	History *run.History
+}
+
+// ServeHTTP writes the run matching the id in the request path.
+func (h *RunAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{"error", "Error: invalid run id."})
+		return
+	}
+	result, ok := h.History.Get(id)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, errorResponse{"error", "Error: run not found."})
+		return
+	}
+	writeJSON(w, http.StatusOK, newRunResponse(result))
+}
+
+// NamespaceAPIHandler implements the http.Handler interface and serves the most recent apply attempt for a namespace as JSON.
+type NamespaceAPIHandler struct {
+	History *run.History
+}
+
+// ServeHTTP looks up the most recent run that attempted to apply the namespace in the request path and writes the matching attempt.
+func (h *NamespaceAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ns := mux.Vars(r)["namespace"]
+	for _, result := range h.History.List() {
+		if a, ok := findAttempt(result.Successes, ns); ok {
+			writeJSON(w, http.StatusOK, namespaceResponse{ns, result.ID, result.CommitHash, true, a})
+			return
+		}
+		if a, ok := findAttempt(result.Failures, ns); ok {
+			writeJSON(w, http.StatusOK, namespaceResponse{ns, result.ID, result.CommitHash, false, a})
+			return
+		}
+	}
+	writeJSON(w, http.StatusNotFound, errorResponse{"error", "Error: no apply attempts found for namespace."})
+}
+
+// GitSyncAPIHandler implements the http.Handler interface and serves the status of the built-in Git sync as JSON.
+type GitSyncAPIHandler struct {
+	Syncer *git.Syncer
+}
+
+// ServeHTTP writes the status of the most recent syncs, or a 404 if the built-in Git sync is not enabled.
+func (h *GitSyncAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.Syncer == nil {
+		writeJSON(w, http.StatusNotFound, errorResponse{"error", "Error: built-in git sync is not enabled."})
+		return
+	}
+	writeJSON(w, http.StatusOK, h.Syncer.Status())
+}
+
+// ClustersAPIHandler implements the http.Handler interface and serves the names of the clusters as JSON. The list is
+// empty when kube-applier applies to a single, unnamed, cluster.
+type ClustersAPIHandler struct {
+	Clusters []string
+}
+
+// ServeHTTP writes the list of cluster names.
+func (h *ClustersAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	clusters := []string{}
+	writeJSON(w, http.StatusOK, append(clusters, h.Clusters...))
+}
+
+// ConfigAPIHandler implements the http.Handler interface and serves the effective configuration, as returned by
+// Config, as JSON.
+type ConfigAPIHandler struct {
+	Config func() *config.Config
+}
+
+// ServeHTTP writes the configuration, with its secrets redacted.
+func (h *ConfigAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.Config == nil {
+		writeJSON(w, http.StatusNotFound, errorResponse{"error", "Error: configuration is not available."})
+		return
+	}
+	writeJSON(w, http.StatusOK, h.Config().Redacted())
+}
+
+// findAttempt returns the attempt in the list that applied the given namespace.
+func findAttempt(attempts []run.ApplyAttempt, namespace string) (run.ApplyAttempt, bool) {
+	for _, a := range attempts {
+		if a.Namespace() == namespace {
+			return a, true
+		}
+	}
+	return run.ApplyAttempt{}, false
+}
+
+// writeJSON encodes data as the JSON body of the response, with the given status code.
+func writeJSON(w http.ResponseWriter, code int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		log.Logger.Error("Could not encode API response", "error", err)
+	}
+}
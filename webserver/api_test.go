@@ -0,0 +1,117 @@
+package webserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/utilitywarehouse/kube-applier/config"
+	"github.com/utilitywarehouse/kube-applier/run"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func mockHistory() *run.History {
+	history := &run.History{Size: 5}
+	history.Add(run.Result{
+		CommitHash:    "a",
+		DiffURLFormat: "https://github.com/org/repo/commit/%s",
+		Successes:     []run.ApplyAttempt{{FilePath: "/repo/ns-a", Command: "cmd ns-a", Output: "output ns-a"}},
+		Failures:      []run.ApplyAttempt{{FilePath: "/repo/ns-b", Command: "cmd ns-b", Output: "output ns-b", ErrorMessage: "error ns-b"}},
+	})
+	history.Add(run.Result{
+		CommitHash: "b",
+		Successes:  []run.ApplyAttempt{{FilePath: "/repo/ns-b", Command: "cmd ns-b", Output: "output ns-b"}},
+	})
+	return history
+}
+
+func serveAPI(handler http.Handler, vars map[string]string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "", nil)
+	req = mux.SetURLVars(req, vars)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestRunsAPIHandlerServeHTTP(t *testing.T) {
+	assert := assert.New(t)
+
+	w := serveAPI(&RunsAPIHandler{&run.History{}}, nil)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("[]\n", w.Body.String())
+
+	w = serveAPI(&RunsAPIHandler{mockHistory()}, nil)
+	assert.Equal(http.StatusOK, w.Code)
+	var runs []struct {
+		ID             int    `json:"id"`
+		CommitHash     string `json:"commitHash"`
+		Success        bool   `json:"success"`
+		LastCommitLink string `json:"lastCommitLink"`
+	}
+	assert.NoError(json.Unmarshal(w.Body.Bytes(), &runs))
+	assert.Len(runs, 2)
+	assert.Equal(2, runs[0].ID)
+	assert.True(runs[0].Success)
+	assert.Equal(1, runs[1].ID)
+	assert.False(runs[1].Success)
+	assert.Equal("https://github.com/org/repo/commit/a", runs[1].LastCommitLink)
+}
+
+func TestRunAPIHandlerServeHTTP(t *testing.T) {
+	assert := assert.New(t)
+	handler := &RunAPIHandler{mockHistory()}
+
+	w := serveAPI(handler, map[string]string{"id": "1"})
+	assert.Equal(http.StatusOK, w.Code)
+	var result run.Result
+	assert.NoError(json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(1, result.ID)
+	assert.Equal([]run.ApplyAttempt{{FilePath: "/repo/ns-b", Command: "cmd ns-b", Output: "output ns-b", ErrorMessage: "error ns-b"}}, result.Failures)
+
+	w = serveAPI(handler, map[string]string{"id": "3"})
+	assert.Equal(http.StatusNotFound, w.Code)
+	assert.Equal("{\"result\":\"error\",\"message\":\"Error: run not found.\"}\n", w.Body.String())
+}
+
+func TestNamespaceAPIHandlerServeHTTP(t *testing.T) {
+	assert := assert.New(t)
+	handler := &NamespaceAPIHandler{mockHistory()}
+
+	for _, test := range []struct {
+		namespace string
+		expected  namespaceResponse
+	}{
+		{"ns-a", namespaceResponse{"ns-a", 1, "a", true, run.ApplyAttempt{FilePath: "/repo/ns-a", Command: "cmd ns-a", Output: "output ns-a"}}},
+		{"ns-b", namespaceResponse{"ns-b", 2, "b", true, run.ApplyAttempt{FilePath: "/repo/ns-b", Command: "cmd ns-b", Output: "output ns-b"}}},
+	} {
+		w := serveAPI(handler, map[string]string{"namespace": test.namespace})
+		assert.Equal(http.StatusOK, w.Code)
+		var got namespaceResponse
+		assert.NoError(json.Unmarshal(w.Body.Bytes(), &got))
+		assert.Equal(test.expected, got)
+	}
+
+	w := serveAPI(handler, map[string]string{"namespace": "ns-c"})
+	assert.Equal(http.StatusNotFound, w.Code)
+}
+
+func TestConfigAPIHandlerServeHTTP(t *testing.T) {
+	assert := assert.New(t)
+	cfg := config.Default()
+	cfg.RepoPath = "/src/manifests"
+	cfg.Webhook.Secret = "secret"
+
+	w := serveAPI(&ConfigAPIHandler{func() *config.Config { return cfg }}, nil)
+	assert.Equal(http.StatusOK, w.Code)
+	var got config.Config
+	assert.NoError(json.Unmarshal(w.Body.Bytes(), &got))
+	assert.Equal("/src/manifests", got.RepoPath)
+	assert.Equal("<redacted>", got.Webhook.Secret)
+	assert.Equal("secret", cfg.Webhook.Secret)
+
+	w = serveAPI(&ConfigAPIHandler{}, nil)
+	assert.Equal(http.StatusNotFound, w.Code)
+}
@@ -3,19 +3,179 @@ package webserver
 import (
 	"fmt"
 	"net/http/pprof"
+	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/utilitywarehouse/go-operational/op"
+	"github.com/utilitywarehouse/kube-applier/git"
+	"github.com/utilitywarehouse/kube-applier/kube"
+	"github.com/utilitywarehouse/kube-applier/run"
+	"github.com/utilitywarehouse/kube-applier/sysutil"
 )
 
 const appName = "kube-applier"
 const appDescription = "enables continuous deployment of Kubernetes objects by applying declarative configuration files from a Git repository to a Kubernetes cluster"
 
-func addStatusEndpoints(m *mux.Router) *mux.Router {
-	m.PathPrefix("/__/").Handler(op.NewHandler(op.NewStatus(appName, appDescription).
+// healthState is the outcome of a health check, in increasing order of severity.
+type healthState int
+
+const (
+	healthy healthState = iota
+	degraded
+	unhealthy
+)
+
+// checkResult is the outcome of a health check, kept apart from op.CheckResponse so that it can be inspected.
+type checkResult struct {
+	state  healthState
+	output string
+	action string
+	impact string
+}
+
+// report writes the result to the operational check response.
+func (c checkResult) report(cr *op.CheckResponse) {
+	switch c.state {
+	case healthy:
+		cr.Healthy(c.output)
+	case degraded:
+		cr.Degraded(c.output, c.action)
+	default:
+		cr.Unhealthy(c.output, c.action, c.impact)
+	}
+}
+
+// healthChecks reports whether runs are completing and succeeding, and whether the Git repository can be read and,
+// with the built-in Git sync, is kept up to date. Runs and syncs are expected at least once every runInterval and
+// sync Interval respectively, and are considered overdue once maxMissedIntervals have passed without one.
+// Followers, with leader election, do not apply so their runs are not checked, and the age of the runs of a new
+// leader is counted from when it was last seen as a follower.
+// There is one healthChecks per cluster, named after it unless it is the single unnamed cluster.
+// runInterval can be changed with setRunInterval while the checks are served.
+type healthChecks struct {
+	cluster            string
+	clock              sysutil.ClockInterface
+	history            *run.History
+	gitUtil            git.UtilInterface
+	gitSyncer          *git.Syncer
+	leader             kube.LeaderElectorInterface
+	runInterval        time.Duration
+	maxMissedIntervals int
+	started            time.Time
+	mutex              sync.Mutex
+}
+
+// lastRun checks the outcome of the most recent run.
+func (h *healthChecks) lastRun() checkResult {
+	if h.leader != nil && !h.leader.IsLeader() {
+		return checkResult{state: healthy, output: "not the leader"}
+	}
+	latest, ok := h.history.Latest()
+	if !ok {
+		return checkResult{state: healthy, output: "no run completed yet"}
+	}
+	if !latest.Success() {
+		output := fmt.Sprintf("run %d at commit %s had %d failures", latest.ID, latest.CommitHash, len(latest.Failures))
+		if latest.ErrorMessage != "" {
+			output = fmt.Sprintf("run %d at commit %s failed: %s", latest.ID, latest.CommitHash, latest.ErrorMessage)
+		}
+		return checkResult{
+			state:  degraded,
+			output: output,
+			action: "check the failed apply attempts on the status page and fix the configuration in the repository",
+		}
+	}
+	return checkResult{state: healthy, output: fmt.Sprintf("run %d at commit %s succeeded", latest.ID, latest.CommitHash)}
+}
+
+// runAge checks that a run has completed recently, counting from startup until the first run.
+func (h *healthChecks) runAge() checkResult {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.runInterval == 0 || h.maxMissedIntervals == 0 {
+		return checkResult{state: healthy, output: "check disabled"}
+	}
+	if h.leader != nil && !h.leader.IsLeader() {
+		h.started = h.clock.Now()
+		return checkResult{state: healthy, output: "not the leader"}
+	}
+	last := h.started
+	if latest, ok := h.history.Latest(); ok && latest.Finish.After(last) {
+		last = latest.Finish
+	}
+	age := h.clock.Since(last)
+	if age > time.Duration(h.maxMissedIntervals)*h.runInterval {
+		return checkResult{
+			state:  unhealthy,
+			output: fmt.Sprintf("no run completed in the last %v", age.Truncate(time.Second)),
+			action: "check the logs for apply runs that are stuck or not being queued",
+			impact: "changes in the repository are not applied to the cluster",
+		}
+	}
+	return checkResult{state: healthy, output: fmt.Sprintf("last run completed %v ago", age.Truncate(time.Second))}
+}
+
+// setRunInterval changes the interval runs are expected at.
+func (h *healthChecks) setRunInterval(d time.Duration) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.runInterval = d
+}
+
+// git checks that the HEAD commit can be read and, with the built-in Git sync, that it is being updated.
+func (h *healthChecks) git() checkResult {
+	hash, err := h.gitUtil.HeadHashForPaths()
+	if err != nil {
+		return checkResult{
+			state:  unhealthy,
+			output: fmt.Sprintf("could not read the HEAD commit: %v", err),
+			action: "check the repository at REPO_PATH and the git-sync logs",
+			impact: "no runs can be applied",
+		}
+	}
+	if h.gitSyncer == nil {
+		return checkResult{state: healthy, output: fmt.Sprintf("HEAD is at %s", hash)}
+	}
+	status := h.gitSyncer.Status()
+	if h.maxMissedIntervals != 0 && h.clock.Since(status.LastSuccess) > time.Duration(h.maxMissedIntervals)*h.gitSyncer.Interval {
+		return checkResult{
+			state:  unhealthy,
+			output: fmt.Sprintf("HEAD has not been synced since %v: %s", status.LastSuccess.Truncate(time.Second), status.Error),
+			action: "check that the remote repository is reachable and the credentials are valid",
+			impact: "new commits are not applied to the cluster",
+		}
+	}
+	if status.Error != "" {
+		return checkResult{
+			state:  degraded,
+			output: fmt.Sprintf("last sync failed: %s", status.Error),
+			action: "check that the remote repository is reachable and the credentials are valid",
+		}
+	}
+	return checkResult{state: healthy, output: fmt.Sprintf("HEAD is at %s, synced at %v", hash, status.LastSuccess.Truncate(time.Second))}
+}
+
+// addStatusEndpoints sets up the operational endpoint, with the health checks, and the pprof endpoints.
+// The runs of each cluster are checked separately, the Git repository is shared and only checked once.
+// The instance is always reported as ready, so that it keeps serving the status pages and webhooks while unhealthy.
+func addStatusEndpoints(m *mux.Router, checks ...*healthChecks) *mux.Router {
+	status := op.NewStatus(appName, appDescription).
 		AddOwner("Billing team", "#finance_billing").
-		AddLink("readme", fmt.Sprintf("https://github.com/utilitywarehouse/%s/blob/master/README.md", appName)).
-		ReadyAlways()))
+		AddLink("readme", fmt.Sprintf("https://github.com/utilitywarehouse/%s/blob/master/README.md", appName))
+	for _, h := range checks {
+		h := h
+		suffix := ""
+		if h.cluster != "" {
+			suffix = fmt.Sprintf(" (%s)", h.cluster)
+		}
+		status.AddChecker("last run"+suffix, func(cr *op.CheckResponse) { h.lastRun().report(cr) }).
+			AddChecker("run age"+suffix, func(cr *op.CheckResponse) { h.runAge().report(cr) })
+	}
+	if len(checks) > 0 {
+		status.AddChecker("git", func(cr *op.CheckResponse) { checks[0].git().report(cr) })
+	}
+	m.PathPrefix("/__/").Handler(op.NewHandler(status.ReadyAlways()))
 	m.PathPrefix("/debug/pprof/cmdline").HandlerFunc(pprof.Cmdline)
 	m.PathPrefix("/debug/pprof/profile").HandlerFunc(pprof.Profile)
 	m.PathPrefix("/debug/pprof/symbol").HandlerFunc(pprof.Symbol)
@@ -0,0 +1,108 @@
+package webserver
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/utilitywarehouse/kube-applier/git"
+	"github.com/utilitywarehouse/kube-applier/run"
+	"github.com/utilitywarehouse/kube-applier/sysutil"
+)
+
+func TestHealthChecksLastRun(t *testing.T) {
+	assert := assert.New(t)
+
+	h := &healthChecks{history: &run.History{}}
+	assert.Equal(healthy, h.lastRun().state)
+
+	h.history.Add(run.Result{CommitHash: "a"})
+	assert.Equal(healthy, h.lastRun().state)
+
+	h.history.Add(run.Result{CommitHash: "b", Failures: []run.ApplyAttempt{{FilePath: "/repo/ns-a"}}})
+	result := h.lastRun()
+	assert.Equal(degraded, result.state)
+	assert.Equal("run 2 at commit b had 1 failures", result.output)
+
+	h.history.Add(run.Result{CommitHash: "c", ErrorMessage: "unverified commit"})
+	result = h.lastRun()
+	assert.Equal(degraded, result.state)
+	assert.Equal("run 3 at commit c failed: unverified commit", result.output)
+}
+
+func TestHealthChecksRunAge(t *testing.T) {
+	assert := assert.New(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	clock := sysutil.NewMockClockInterface(mockCtrl)
+	started := time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)
+	h := &healthChecks{
+		clock:              clock,
+		history:            &run.History{},
+		runInterval:        time.Minute,
+		maxMissedIntervals: 3,
+		started:            started,
+	}
+
+	// Until the first run completes, the age is counted from startup
+	clock.EXPECT().Since(started).Return(2 * time.Minute)
+	assert.Equal(healthy, h.runAge().state)
+	clock.EXPECT().Since(started).Return(4 * time.Minute)
+	assert.Equal(unhealthy, h.runAge().state)
+
+	finish := started.Add(5 * time.Minute)
+	h.history.Add(run.Result{Finish: finish})
+	clock.EXPECT().Since(finish).Return(time.Minute)
+	assert.Equal(healthy, h.runAge().state)
+
+	// Runs from before startup, loaded from the run history, do not count
+	h.history = &run.History{}
+	h.history.Add(run.Result{Finish: started.Add(-time.Hour)})
+	clock.EXPECT().Since(started).Return(time.Minute)
+	assert.Equal(healthy, h.runAge().state)
+
+	// A reloaded run interval is picked up by the next check
+	clock.EXPECT().Since(started).Return(4 * time.Minute)
+	assert.Equal(unhealthy, h.runAge().state)
+	h.setRunInterval(time.Hour)
+	clock.EXPECT().Since(started).Return(4 * time.Minute)
+	assert.Equal(healthy, h.runAge().state)
+
+	h.maxMissedIntervals = 0
+	assert.Equal(healthy, h.runAge().state)
+}
+
+func TestHealthChecksGit(t *testing.T) {
+	assert := assert.New(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	clock := sysutil.NewMockClockInterface(mockCtrl)
+	gitUtil := git.NewMockUtilInterface(mockCtrl)
+	h := &healthChecks{
+		clock:              clock,
+		gitUtil:            gitUtil,
+		maxMissedIntervals: 3,
+	}
+
+	gitUtil.EXPECT().HeadHashForPaths().Return("abc", nil)
+	assert.Equal(checkResult{state: healthy, output: "HEAD is at abc"}, h.git())
+
+	gitUtil.EXPECT().HeadHashForPaths().Return("", fmt.Errorf("not a git repository"))
+	result := h.git()
+	assert.Equal(unhealthy, result.state)
+	assert.Equal("could not read the HEAD commit: not a git repository", result.output)
+
+	// A syncer that has never synced successfully
+	h.gitSyncer = &git.Syncer{Interval: time.Minute}
+	gitUtil.EXPECT().HeadHashForPaths().Return("abc", nil)
+	clock.EXPECT().Since(time.Time{}).Return(4 * time.Minute)
+	assert.Equal(unhealthy, h.git().state)
+
+	gitUtil.EXPECT().HeadHashForPaths().Return("abc", nil)
+	clock.EXPECT().Since(time.Time{}).Return(time.Minute)
+	assert.Equal(healthy, h.git().state)
+}
@@ -0,0 +1,67 @@
+package webserver
+
+import (
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/utilitywarehouse/kube-applier/kube"
+	"github.com/utilitywarehouse/kube-applier/log"
+)
+
+// Header set on the requests forwarded to the leader, so that they are never
+// forwarded again if the leader changed in the meantime. Anyone can set it, so
+// it never makes a follower serve a request itself.
+const proxiedHeader = "X-Kube-Applier-Proxied"
+
+// Path prefixes always served by the replica that receives the request, as
+// they report on the replica itself or do not depend on its runs.
+var localPathPrefixes = []string{"/__/", "/debug/", "/static/"}
+
+// LeaderProxyHandler implements the http.Handler interface and forwards requests to the leader, on port Port,
+// when leader election is enabled and this replica is a follower, so that the status pages, the API and the
+// webhooks can be served by any replica. Other requests, and requests for which the leader cannot be found, are
+// served by Handler. Requests already forwarded by another replica are rejected by followers, as the leader changed
+// since, and the client can retry them.
+type LeaderProxyHandler struct {
+	Leader  kube.LeaderElectorInterface
+	Port    int
+	Handler http.Handler
+}
+
+// ServeHTTP forwards the request to the leader, or serves it locally.
+func (p *LeaderProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.Leader == nil || isLocalPath(r.URL.Path) || p.Leader.IsLeader() {
+		p.Handler.ServeHTTP(w, r)
+		return
+	}
+	if r.Header.Get(proxiedHeader) != "" {
+		log.Logger.Warn("Forwarded request received by a follower, rejecting it", "path", r.URL.Path)
+		writeJSON(w, http.StatusServiceUnavailable, errorResponse{"error", "Error: the leader changed, retry the request."})
+		return
+	}
+	ip, err := p.Leader.LeaderIP()
+	if err != nil {
+		log.Logger.Warn("Could not find the leader, serving request locally", "path", r.URL.Path, "error", err)
+		p.Handler.ServeHTTP(w, r)
+		return
+	}
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(ip, strconv.Itoa(p.Port)),
+	})
+	r.Header.Set(proxiedHeader, "true")
+	proxy.ServeHTTP(w, r)
+}
+
+func isLocalPath(path string) bool {
+	for _, prefix := range localPathPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package webserver
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/utilitywarehouse/kube-applier/kube"
+	"github.com/utilitywarehouse/kube-applier/log"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLeaderProxyHandlerServeHTTP(t *testing.T) {
+	log.InitLogger("info")
+	assert := assert.New(t)
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	leaderServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "leader %s %s", r.URL.Path, r.Header.Get(proxiedHeader))
+	}))
+	defer leaderServer.Close()
+	_, port, _ := net.SplitHostPort(leaderServer.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+
+	local := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "local %s", r.URL.Path)
+	})
+	leader := kube.NewMockLeaderElectorInterface(mockCtrl)
+	handler := &LeaderProxyHandler{leader, p, local}
+	serve := func(path string, header http.Header) string {
+		req, _ := http.NewRequest("GET", path, nil)
+		if header != nil {
+			req.Header = header
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	// The leader serves every request
+	leader.EXPECT().IsLeader().Times(2).Return(true)
+	assert.Equal("local /api/v1/runs", serve("/api/v1/runs", nil))
+	assert.Equal("local /api/v1/runs", serve("/api/v1/runs", http.Header{proxiedHeader: []string{"true"}}))
+
+	// Followers forward requests to the leader, except for the ones about the
+	// replica itself
+	leader.EXPECT().IsLeader().Return(false)
+	leader.EXPECT().LeaderIP().Return("127.0.0.1", nil)
+	assert.Equal("leader /api/v1/runs true", serve("/api/v1/runs", nil))
+	assert.Equal("local /__/health", serve("/__/health", nil))
+
+	// Requests already forwarded, or claiming to be, are not served by followers
+	leader.EXPECT().IsLeader().Return(false)
+	assert.Equal("{\"result\":\"error\",\"message\":\"Error: the leader changed, retry the request.\"}\n", serve("/api/v1/forceRun", http.Header{proxiedHeader: []string{"true"}}))
+
+	// Requests are served locally if the leader cannot be found
+	leader.EXPECT().IsLeader().Return(false)
+	leader.EXPECT().LeaderIP().Return("", fmt.Errorf("no leader elected"))
+	assert.Equal("local /history", serve("/history", nil))
+
+	// Without leader election, every request is served locally
+	handler.Leader = nil
+	assert.Equal("local /api/v1/runs", serve("/api/v1/runs", nil))
+}
@@ -0,0 +1,176 @@
+package webserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/utilitywarehouse/kube-applier/git"
+	"github.com/utilitywarehouse/kube-applier/log"
+	"github.com/utilitywarehouse/kube-applier/run"
+)
+
+// Maximum size of a webhook payload
+const maxWebhookPayloadSize = 5 << 20
+
+// pushPayload holds the fields of the push event payloads of GitHub, GitLab
+// and Bitbucket Cloud and Server that identify the branches that were pushed.
+type pushPayload struct {
+	// GitHub and GitLab
+	Ref string `json:"ref"`
+	// Bitbucket Cloud
+	Push struct {
+		Changes []struct {
+			New struct {
+				Type string `json:"type"`
+				Name string `json:"name"`
+			} `json:"new"`
+		} `json:"changes"`
+	} `json:"push"`
+	// Bitbucket Server
+	Changes []struct {
+		RefID string `json:"refId"`
+	} `json:"changes"`
+}
+
+// branches returns the names of the branches updated by the push.
+func (p pushPayload) branches() []string {
+	var branches []string
+	if strings.HasPrefix(p.Ref, "refs/heads/") {
+		branches = append(branches, strings.TrimPrefix(p.Ref, "refs/heads/"))
+	}
+	for _, c := range p.Push.Changes {
+		if c.New.Type == "branch" {
+			branches = append(branches, c.New.Name)
+		}
+	}
+	for _, c := range p.Changes {
+		if strings.HasPrefix(c.RefID, "refs/heads/") {
+			branches = append(branches, strings.TrimPrefix(c.RefID, "refs/heads/"))
+		}
+	}
+	return branches
+}
+
+// WebhookHandler implements the http.Handler interface and serves an endpoint for the push webhooks of GitHub, GitLab
+// and Bitbucket, selected by the provider in the request path. Requests are authenticated with Secret, and a push to
+// Branch, or any branch if it is empty, queues a partial run on each of RunQueues, one per cluster. If GitSyncer is
+// set, a sync is triggered instead and the Scheduler queues the run once the new commit is fetched.
+type WebhookHandler struct {
+	Secret    string
+	Branch    string
+	GitSyncer *git.Syncer
+	RunQueues []*run.Queue
+}
+
+// ServeHTTP verifies the webhook request and queues a run for push events.
+func (h *WebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.Secret == "" {
+		writeJSON(w, http.StatusNotFound, errorResponse{"error", "Error: webhooks are not enabled."})
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookPayloadSize))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{"error", "Error: could not read request body."})
+		return
+	}
+
+	provider := mux.Vars(r)["provider"]
+	var verified, push bool
+	switch provider {
+	case "github":
+		verified = verifySignature(h.Secret, body, r.Header.Get("X-Hub-Signature-256"), r.Header.Get("X-Hub-Signature"))
+		push = r.Header.Get("X-GitHub-Event") == "push"
+	case "gitlab":
+		verified = subtle.ConstantTimeCompare([]byte(h.Secret), []byte(r.Header.Get("X-Gitlab-Token"))) == 1
+		push = r.Header.Get("X-Gitlab-Event") == "Push Hook"
+	case "bitbucket":
+		verified = verifySignature(h.Secret, body, r.Header.Get("X-Hub-Signature"))
+		event := r.Header.Get("X-Event-Key")
+		push = event == "repo:push" || event == "repo:refs_changed"
+	default:
+		writeJSON(w, http.StatusNotFound, errorResponse{"error", fmt.Sprintf("Error: unknown webhook provider %q.", provider)})
+		return
+	}
+	if !verified {
+		log.Logger.Warn("Rejected webhook with an invalid signature", "provider", provider)
+		writeJSON(w, http.StatusUnauthorized, errorResponse{"error", "Error: invalid webhook signature."})
+		return
+	}
+	if !push {
+		writeJSON(w, http.StatusOK, errorResponse{"success", "Ignored, not a push event."})
+		return
+	}
+
+	var payload pushPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		writeJSON(w, http.StatusBadRequest, errorResponse{"error", "Error: invalid push event payload."})
+		return
+	}
+	if h.Branch != "" && !contains(payload.branches(), h.Branch) {
+		writeJSON(w, http.StatusOK, errorResponse{"success", fmt.Sprintf("Ignored, branch %s was not pushed.", h.Branch)})
+		return
+	}
+
+	if h.GitSyncer != nil {
+		log.Logger.Info("Push webhook received, triggering git sync", "provider", provider)
+		h.GitSyncer.Trigger()
+		writeJSON(w, http.StatusAccepted, errorResponse{"success", "Sync triggered, the pushed commit is applied once it is fetched."})
+		return
+	}
+	log.Logger.Info("Push webhook received, queueing run", "provider", provider)
+	for _, runQueue := range h.RunQueues {
+		if runQueue.Add(run.Request{Type: run.PartialRun}) {
+			log.Logger.Info("Run queued")
+		} else {
+			log.Logger.Info("Run already pending")
+		}
+	}
+	writeJSON(w, http.StatusAccepted, errorResponse{"success", "Run queued."})
+}
+
+// verifySignature checks that one of the signature headers, in the
+// "sha256=<hex>" or "sha1=<hex>" format, is the HMAC of body with secret.
+func verifySignature(secret string, body []byte, headers ...string) bool {
+	for _, header := range headers {
+		parts := strings.SplitN(header, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		var h func() hash.Hash
+		switch parts[0] {
+		case "sha256":
+			h = sha256.New
+		case "sha1":
+			h = sha1.New
+		default:
+			continue
+		}
+		signature, err := hex.DecodeString(parts[1])
+		if err != nil {
+			continue
+		}
+		mac := hmac.New(h, []byte(secret))
+		mac.Write(body)
+		return hmac.Equal(signature, mac.Sum(nil))
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
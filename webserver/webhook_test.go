@@ -0,0 +1,102 @@
+package webserver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/utilitywarehouse/kube-applier/git"
+	"github.com/utilitywarehouse/kube-applier/log"
+	"github.com/utilitywarehouse/kube-applier/run"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func signature(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+type webhookTestCase struct {
+	provider     string
+	headers      map[string]string
+	body         string
+	expectedCode int
+	expectRun    bool
+}
+
+func TestWebhookHandlerServeHTTP(t *testing.T) {
+	log.InitLogger("info")
+	assert := assert.New(t)
+
+	githubPush := `{"ref": "refs/heads/master"}`
+	bitbucketPush := `{"push": {"changes": [{"new": {"type": "branch", "name": "master"}}]}}`
+	bitbucketServerPush := `{"changes": [{"refId": "refs/heads/master"}]}`
+	otherBranchPush := `{"ref": "refs/heads/feature"}`
+
+	tests := []webhookTestCase{
+		{"github", map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": signature("secret", githubPush)}, githubPush, http.StatusAccepted, true},
+		{"github", map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": signature("wrong", githubPush)}, githubPush, http.StatusUnauthorized, false},
+		{"github", map[string]string{"X-GitHub-Event": "push"}, githubPush, http.StatusUnauthorized, false},
+		{"github", map[string]string{"X-GitHub-Event": "ping", "X-Hub-Signature-256": signature("secret", "{}")}, "{}", http.StatusOK, false},
+		{"github", map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": signature("secret", otherBranchPush)}, otherBranchPush, http.StatusOK, false},
+		{"gitlab", map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "secret"}, githubPush, http.StatusAccepted, true},
+		{"gitlab", map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "wrong"}, githubPush, http.StatusUnauthorized, false},
+		{"bitbucket", map[string]string{"X-Event-Key": "repo:push", "X-Hub-Signature": signature("secret", bitbucketPush)}, bitbucketPush, http.StatusAccepted, true},
+		{"bitbucket", map[string]string{"X-Event-Key": "repo:refs_changed", "X-Hub-Signature": signature("secret", bitbucketServerPush)}, bitbucketServerPush, http.StatusAccepted, true},
+		{"unknown", map[string]string{}, githubPush, http.StatusNotFound, false},
+	}
+
+	for _, test := range tests {
+		runQueue := run.NewQueue()
+		handler := &WebhookHandler{Secret: "secret", Branch: "master", RunQueues: []*run.Queue{runQueue}}
+		req, _ := http.NewRequest("POST", "", bytes.NewBufferString(test.body))
+		for k, v := range test.headers {
+			req.Header.Set(k, v)
+		}
+		req = mux.SetURLVars(req, map[string]string{"provider": test.provider})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		assert.Equal(test.expectedCode, w.Code, "%s %v", test.provider, test.headers)
+
+		r, ok := runQueue.Next()
+		assert.Equal(test.expectRun, ok, "%s %v: queued %v", test.provider, test.headers, r)
+		if ok {
+			assert.Equal(run.Request{Type: run.PartialRun}, r)
+		}
+	}
+}
+
+func TestWebhookHandlerServeHTTPGitSync(t *testing.T) {
+	assert := assert.New(t)
+	log.InitLogger("info")
+
+	// With the built-in Git sync, the run is queued by the Scheduler once the
+	// pushed commit is fetched
+	body := `{"ref": "refs/heads/master"}`
+	runQueue := run.NewQueue()
+	handler := &WebhookHandler{Secret: "secret", GitSyncer: &git.Syncer{}, RunQueues: []*run.Queue{runQueue}}
+	req, _ := http.NewRequest("POST", "", bytes.NewBufferString(body))
+	req.Header.Set("X-Gitlab-Event", "Push Hook")
+	req.Header.Set("X-Gitlab-Token", "secret")
+	req = mux.SetURLVars(req, map[string]string{"provider": "gitlab"})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(http.StatusAccepted, w.Code)
+	assert.Equal(0, runQueue.Len())
+}
+
+func TestWebhookHandlerServeHTTPDisabled(t *testing.T) {
+	handler := &WebhookHandler{RunQueues: []*run.Queue{run.NewQueue()}}
+	req, _ := http.NewRequest("POST", "", bytes.NewBufferString("{}"))
+	req = mux.SetURLVars(req, map[string]string{"provider": "gitlab"})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
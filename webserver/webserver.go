@@ -1,11 +1,21 @@
 package webserver
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/utilitywarehouse/kube-applier/config"
+	"github.com/utilitywarehouse/kube-applier/git"
+	"github.com/utilitywarehouse/kube-applier/kube"
 	"github.com/utilitywarehouse/kube-applier/log"
 	"github.com/utilitywarehouse/kube-applier/run"
 	"github.com/utilitywarehouse/kube-applier/sysutil"
@@ -13,15 +23,70 @@ import (
 	"github.com/gorilla/mux"
 )
 
-const serverTemplatePath = "/templates/status.html"
+const (
+	serverTemplatePath  = "/templates/status.html"
+	historyTemplatePath = "/templates/history.html"
+	// Time allowed for the requests in progress to complete on shutdown
+	shutdownTimeout = 5 * time.Second
+)
 
 // WebServer struct
+// Clusters lists the clusters whose runs are shown and can be forced, see Cluster.
+// GitSyncer is only set when the built-in Git sync is enabled.
+// Push webhooks are only accepted when WebhookSecret is set, pushes to branches other than WebhookBranch are ignored.
+// The health checks report runs and syncs as overdue after MaxMissedIntervals of RunInterval and the sync interval,
+// a zero value disables them. RunInterval can be changed with UpdateRunInterval once the WebServer is started.
+// With leader election, Leader is set and followers forward requests to the leader, see LeaderProxyHandler.
+// Config returns the current configuration, which is served by the API with its secrets redacted.
 type WebServer struct {
-	ListenPort int
-	Clock      sysutil.ClockInterface
-	RunQueue   chan<- bool
+	ListenPort         int
+	Clock              sysutil.ClockInterface
+	Clusters           []Cluster
+	GitUtil            git.UtilInterface
+	GitSyncer          *git.Syncer
+	WebhookSecret      string
+	WebhookBranch      string
+	RunInterval        time.Duration
+	MaxMissedIntervals int
+	Leader             kube.LeaderElectorInterface
+	Config             func() *config.Config
+	Errors             chan<- error
+	checks             []*healthChecks
+	mutex              sync.Mutex
+}
+
+// Cluster holds the run history, the queue and the pinned commit of one of the clusters kube-applier applies to.
+// Results received from RunResults are stored in History.
+// The pages and API of a cluster with a Name are served under /clusters/{name} and /api/v1/clusters/{name}, those of
+// the unnamed cluster used when there is a single one are served at the root.
+type Cluster struct {
+	Name       string
+	History    *run.History
+	RunQueue   *run.Queue
+	Pin        *run.Pin
 	RunResults <-chan run.Result
-	Errors     chan<- error
+}
+
+// nav holds the data needed by the pages of a cluster to link to each other and to the API.
+// Clusters lists the names of all the clusters, when they are named.
+type nav struct {
+	Cluster  string
+	Clusters []string
+	BasePath string
+	APIPath  string
+}
+
+// statusPage is the data of the status page of a run. Pin is only set on the page of the latest run.
+type statusPage struct {
+	*run.Result
+	nav
+	Pin *run.Pin
+}
+
+// historyPage is the data of the page listing the runs of a cluster.
+type historyPage struct {
+	Runs []run.Result
+	nav
 }
 
 // StatusPageHandler implements the http.Handler interface and serves a status page with info about the most recent applier run.
@@ -47,12 +112,73 @@ func (s *StatusPageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Logger.Info("Request completed successfully", "time", s.Clock.Now().String())
 }
 
+// HistoryPageHandler implements the http.Handler interface and serves a page listing the runs kept in the History.
+type HistoryPageHandler struct {
+	Template *template.Template
+	History  *run.History
+	Clock    sysutil.ClockInterface
+	Nav      nav
+}
+
+// ServeHTTP populates the history page template with the stored runs and serves it when there is a request.
+func (h *HistoryPageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Logger.Info("Applier history request", "time", h.Clock.Now().String())
+	if h.Template == nil {
+		http.Error(w, "Error: Unable to load HTML template", http.StatusInternalServerError)
+		log.Logger.Error("Request failed", "error", "No template found", "time", h.Clock.Now().String())
+		return
+	}
+	if err := h.Template.Execute(w, historyPage{h.History.List(), h.Nav}); err != nil {
+		http.Error(w, "Error: Unable to load HTML template", http.StatusInternalServerError)
+		log.Logger.Error("Request failed", "error", http.StatusInternalServerError, "time", h.Clock.Now().String())
+		return
+	}
+	log.Logger.Info("Request completed successfully", "time", h.Clock.Now().String())
+}
+
+// RunPageHandler implements the http.Handler interface and serves the status page for a single run from the History.
+type RunPageHandler struct {
+	Template *template.Template
+	History  *run.History
+	Clock    sysutil.ClockInterface
+	Nav      nav
+}
+
+// ServeHTTP looks up the run matching the id in the request path and serves the status page populated with its data.
+func (p *RunPageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Logger.Info("Applier run request", "time", p.Clock.Now().String())
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Error: Invalid run id", http.StatusBadRequest)
+		return
+	}
+	result, ok := p.History.Get(id)
+	if !ok {
+		http.Error(w, "Error: Run not found", http.StatusNotFound)
+		return
+	}
+	handler := &StatusPageHandler{p.Template, statusPage{&result, p.Nav, nil}, p.Clock}
+	handler.ServeHTTP(w, r)
+}
+
 // ForceRunHandler implements the http.Handle interface and serves an API endpoint for forcing a new run.
+// A full run is queued, unless the request specifies a namespace parameter, in which case only that namespace is applied.
+// A commit parameter applies that commit instead of the working tree, eg. to roll back a change, and pins it, see
+// run.Pin. These requests must carry Secret as a bearer token, and are rejected if it is empty.
 type ForceRunHandler struct {
-	RunQueue chan<- bool
+	RunQueue *run.Queue
+	Secret   string
 }
 
-// ServeHTTP handles requests for forcing a run by attempting to add to the runQueue, and writes a response including the result and a relevant message.
+var (
+	// namespaceRegex matches valid Kubernetes namespace names (RFC 1123 labels).
+	namespaceRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+	// commitRegex matches full and abbreviated commit hashes.
+	commitRegex = regexp.MustCompile(`^[0-9a-f]{4,40}$`)
+)
+
+// ServeHTTP handles requests for forcing a run by adding it to the RunQueue, and writes a response including the result and a relevant message.
+// A run that is covered by a pending run, eg. a namespace run while a full run is pending, is merged into it.
 func (f *ForceRunHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Logger.Info("Force run requested")
 	var data struct {
@@ -62,15 +188,45 @@ func (f *ForceRunHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	switch r.Method {
 	case "POST":
-		select {
-		case f.RunQueue <- true:
-			log.Logger.Info("Run queued")
+		ns := r.FormValue("namespace")
+		commit := r.FormValue("commit")
+		switch {
+		case ns == "" && commit == "":
+			f.enqueue(run.Request{Type: run.FullRun})
+			data.Result = "success"
+			data.Message = "Run queued, will begin upon completion of current run."
+			w.WriteHeader(http.StatusOK)
+		case ns != "" && (len(ns) > 63 || !namespaceRegex.MatchString(ns)):
+			data.Result = "error"
+			data.Message = fmt.Sprintf("Error: force rejected, invalid namespace %q.", ns)
+			w.WriteHeader(http.StatusBadRequest)
+			log.Logger.Info(data.Message)
+		case commit != "" && !commitRegex.MatchString(commit):
+			data.Result = "error"
+			data.Message = fmt.Sprintf("Error: force rejected, invalid commit %q.", commit)
+			w.WriteHeader(http.StatusBadRequest)
+			log.Logger.Info(data.Message)
+		case commit != "" && !authorized(r, f.Secret):
+			data.Result = "error"
+			data.Message = "Error: force rejected, applying a commit requires the webhook secret."
+			w.WriteHeader(http.StatusUnauthorized)
+			log.Logger.Info(data.Message)
 		default:
-			log.Logger.Info("Run queue is already full")
+			req := run.Request{Type: run.FullRun, Commit: commit}
+			var target []string
+			if ns != "" {
+				req.Type = run.NamespaceRun
+				req.Namespace = ns
+				target = append(target, "namespace "+ns)
+			}
+			if commit != "" {
+				target = append(target, "commit "+commit)
+			}
+			f.enqueue(req)
+			data.Result = "success"
+			data.Message = fmt.Sprintf("Run for %s queued, will begin upon completion of current run.", strings.Join(target, " at "))
+			w.WriteHeader(http.StatusOK)
 		}
-		data.Result = "success"
-		data.Message = "Run queued, will begin upon completion of current run."
-		w.WriteHeader(http.StatusOK)
 	default:
 		data.Result = "error"
 		data.Message = "Error: force rejected, must be a POST request."
@@ -82,42 +238,197 @@ func (f *ForceRunHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(data)
 }
 
+// enqueue adds req to the RunQueue, logging whether it was merged into a pending run.
+func (f *ForceRunHandler) enqueue(req run.Request) {
+	if f.RunQueue.Add(req) {
+		log.Logger.Info("Run queued", "type", req.Type, "namespace", req.Namespace, "commit", req.Commit)
+	} else {
+		log.Logger.Info("Run already pending", "type", req.Type, "namespace", req.Namespace, "commit", req.Commit)
+	}
+}
+
+// UnpinHandler implements the http.Handler interface and serves an API endpoint that removes the pinned commit, see
+// run.Pin, and queues a full run to apply the working tree again. Requests are authenticated like those of the
+// ForceRunHandler for a commit.
+type UnpinHandler struct {
+	Pin      *run.Pin
+	RunQueue *run.Queue
+	Secret   string
+}
+
+// ServeHTTP removes the pinned commit, and writes a response including the result and a relevant message.
+func (h *UnpinHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Logger.Info("Unpin requested")
+	var data struct {
+		Result  string `json:"result"`
+		Message string `json:"message"`
+	}
+
+	code := http.StatusOK
+	switch {
+	case !authorized(r, h.Secret):
+		data.Result = "error"
+		data.Message = "Error: unpin rejected, unpinning requires the webhook secret."
+		code = http.StatusUnauthorized
+		log.Logger.Info(data.Message)
+	case !h.Pin.Unpin():
+		data.Result = "success"
+		data.Message = "No commit is pinned."
+	default:
+		h.RunQueue.Add(run.Request{Type: run.FullRun})
+		data.Result = "success"
+		data.Message = "Commit unpinned, run queued to apply the working tree."
+	}
+	writeJSON(w, code, data)
+}
+
+// authorized reports whether r carries secret as a bearer token. No request is authorized when secret is empty.
+func authorized(r *http.Request, secret string) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return secret != "" && subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+}
+
+// UpdateRunInterval changes the RunInterval the health checks expect runs at.
+func (ws *WebServer) UpdateRunInterval(d time.Duration) {
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	ws.RunInterval = d
+	for _, h := range ws.checks {
+		h.setRunInterval(d)
+	}
+}
+
 // Start starts the webserver using the given port, and sets up handlers for:
 // 1. Status page
 // 2. Metrics
 // 3. Static content
-// 4. Endpoint for forcing a run
-func (ws *WebServer) Start() {
+// 4. Endpoints for forcing a run and unpinning a commit
+// 5. Run history pages
+// 6. JSON API for runs, namespaces, the built-in Git sync and the configuration
+// 7. Git push webhooks
+// 8. Operational endpoint with health checks, and pprof
+// Followers forward the requests for all but the last of these to the leader.
+// Once ctx is cancelled, the results sent to RunResults are still stored until it is closed, and then the server is
+// shut down.
+func (ws *WebServer) Start(ctx context.Context) {
 	log.Logger.Info("Launching webserver")
-	lastRun := &run.Result{}
 
 	template, err := sysutil.CreateTemplate(serverTemplatePath)
 	if err != nil {
 		ws.Errors <- err
 		return
 	}
+	historyTemplate, err := sysutil.CreateTemplate(historyTemplatePath)
+	if err != nil {
+		ws.Errors <- err
+		return
+	}
 
-	m := mux.NewRouter()
-	addStatusEndpoints(m)
-	statusPageHandler := &StatusPageHandler{
-		template,
-		lastRun,
-		ws.Clock,
+	var names []string
+	for _, c := range ws.Clusters {
+		if c.Name != "" {
+			names = append(names, c.Name)
+		}
 	}
-	http.Handle("/", statusPageHandler)
+
+	m := mux.NewRouter()
 	m.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("/static"))))
-	forceRunHandler := &ForceRunHandler{
-		ws.RunQueue,
+	m.Handle("/api/v1/clusters", &ClustersAPIHandler{names}).Methods("GET")
+	m.Handle("/api/v1/gitSync", &GitSyncAPIHandler{ws.GitSyncer}).Methods("GET")
+	m.Handle("/api/v1/config", &ConfigAPIHandler{ws.Config}).Methods("GET")
+
+	var (
+		checks    []*healthChecks
+		runQueues []*run.Queue
+		drained   sync.WaitGroup
+	)
+	var rootHandler http.Handler
+	for _, c := range ws.Clusters {
+		c := c
+		n := nav{Cluster: c.Name, Clusters: names, APIPath: "/api/v1"}
+		if c.Name != "" {
+			n.BasePath = "/clusters/" + c.Name
+			n.APIPath = "/api/v1/clusters/" + c.Name
+		}
+
+		lastRun := &run.Result{}
+		if latest, ok := c.History.Latest(); ok {
+			*lastRun = latest
+		}
+		statusPageHandler := &StatusPageHandler{
+			template,
+			statusPage{lastRun, n, c.Pin},
+			ws.Clock,
+		}
+		m.PathPrefix(n.APIPath + "/forceRun").Handler(&ForceRunHandler{c.RunQueue, ws.WebhookSecret})
+		m.Handle(n.APIPath+"/unpin", &UnpinHandler{c.Pin, c.RunQueue, ws.WebhookSecret}).Methods("POST")
+		m.Handle(n.APIPath+"/runs", &RunsAPIHandler{c.History}).Methods("GET")
+		m.Handle(n.APIPath+"/runs/{id:[0-9]+}", &RunAPIHandler{c.History}).Methods("GET")
+		m.Handle(n.APIPath+"/namespaces/{namespace}", &NamespaceAPIHandler{c.History}).Methods("GET")
+		m.Handle(n.BasePath+"/history", &HistoryPageHandler{historyTemplate, c.History, ws.Clock, n})
+		m.Handle(n.BasePath+"/history/{id:[0-9]+}", &RunPageHandler{template, c.History, ws.Clock, n})
+		if n.BasePath != "" {
+			m.Handle(n.BasePath, statusPageHandler)
+		}
+		if rootHandler == nil {
+			rootHandler = statusPageHandler
+			if n.BasePath != "" {
+				rootHandler = http.RedirectHandler(n.BasePath, http.StatusFound)
+			}
+		}
+
+		checks = append(checks, &healthChecks{
+			cluster:            c.Name,
+			clock:              ws.Clock,
+			history:            c.History,
+			gitUtil:            ws.GitUtil,
+			gitSyncer:          ws.GitSyncer,
+			leader:             ws.Leader,
+			maxMissedIntervals: ws.MaxMissedIntervals,
+			started:            ws.Clock.Now(),
+		})
+		runQueues = append(runQueues, c.RunQueue)
+
+		drained.Add(1)
+		go func() {
+			defer drained.Done()
+			for result := range c.RunResults {
+				stored, err := c.History.Add(result)
+				if err != nil {
+					log.Logger.Error("Could not persist run result", "cluster", c.Name, "error", err)
+				}
+				*lastRun = stored
+			}
+		}()
+	}
+	ws.mutex.Lock()
+	for _, h := range checks {
+		h.setRunInterval(ws.RunInterval)
+	}
+	ws.checks = checks
+	ws.mutex.Unlock()
+	addStatusEndpoints(m, checks...)
+	m.Handle("/api/v1/webhook/{provider}", &WebhookHandler{ws.WebhookSecret, ws.WebhookBranch, ws.GitSyncer, runQueues}).Methods("POST")
+	if rootHandler != nil {
+		m.PathPrefix("/").Handler(rootHandler)
 	}
-	m.PathPrefix("/api/v1/forceRun").Handler(forceRunHandler)
-	m.PathPrefix("/").Handler(statusPageHandler)
 
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%v", ws.ListenPort),
+		Handler: &LeaderProxyHandler{ws.Leader, ws.ListenPort, m},
+	}
 	go func() {
-		for result := range ws.RunResults {
-			*lastRun = result
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			ws.Errors <- err
 		}
 	}()
 
-	err = http.ListenAndServe(fmt.Sprintf(":%v", ws.ListenPort), m)
-	ws.Errors <- err
+	<-ctx.Done()
+	drained.Wait()
+	log.Logger.Info("Shutting down webserver")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Logger.Warn("Could not shut down webserver gracefully", "error", err)
+	}
 }
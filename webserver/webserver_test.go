@@ -4,19 +4,25 @@ import (
 	"html/template"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/utilitywarehouse/kube-applier/log"
+	"github.com/utilitywarehouse/kube-applier/run"
 	"github.com/utilitywarehouse/kube-applier/sysutil"
 
 	"github.com/golang/mock/gomock"
+	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
 )
 
 const (
 	successBody = "{\"result\":\"success\",\"message\":\"Run queued, will begin upon completion of current run.\"}\n"
 	errorBody   = "{\"result\":\"error\",\"message\":\"Error: force rejected, must be a POST request.\"}\n"
+
+	namespaceSuccessBody = "{\"result\":\"success\",\"message\":\"Run for namespace foo queued, will begin upon completion of current run.\"}\n"
+	namespaceInvalidBody = "{\"result\":\"error\",\"message\":\"Error: force rejected, invalid namespace \\\"../foo\\\".\"}\n"
 )
 
 //**** Tests for Status Page Handler ****
@@ -119,11 +125,47 @@ func TestStatusPageHandlerServeHTTP(t *testing.T) {
 	}
 }
 
+//**** Tests for Run Page Handler ****
+func TestRunPageHandlerServeHTTP(t *testing.T) {
+	log.InitLogger("info")
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	clock := sysutil.NewMockClockInterface(mockCtrl)
+	clock.EXPECT().Now().AnyTimes().Return(time.Time{})
+
+	history := &run.History{Size: 5}
+	history.Add(run.Result{CommitHash: "a"})
+	history.Add(run.Result{CommitHash: "b"})
+
+	handler := &RunPageHandler{mockTemplate("{{.BasePath}} {{.ID}} {{.CommitHash}}"), history, clock, nav{Cluster: "staging", BasePath: "/clusters/staging"}}
+
+	for _, test := range []struct {
+		id           string
+		expectedCode int
+		expectedBody string
+	}{
+		{"1", http.StatusOK, "/clusters/staging 1 a"},
+		{"2", http.StatusOK, "/clusters/staging 2 b"},
+		{"3", http.StatusNotFound, "Error: Run not found\n"},
+	} {
+		req, _ := http.NewRequest("GET", "/history/"+test.id, nil)
+		req = mux.SetURLVars(req, map[string]string{"id": test.id})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, test.expectedCode, w.Code)
+		assert.Equal(t, test.expectedBody, w.Body.String())
+	}
+}
+
 //**** Tests for Force Run Handler ****
 func TestForceRunHandlerServeHTTP(t *testing.T) {
-	runQueue := make(chan bool, 1)
+	log.InitLogger("info")
+	assert := assert.New(t)
+	runQueue := run.NewQueue()
 	handler := ForceRunHandler{
 		runQueue,
+		"secret",
 	}
 
 	// GET request gives an error.
@@ -132,19 +174,122 @@ func TestForceRunHandlerServeHTTP(t *testing.T) {
 	// Force run request succeeds (empty queue).
 	RequestAndExpect(t, handler, successBody, "POST")
 
-	// Force run request succeeds (queue full).
+	// Force run request succeeds (full run already pending).
+	RequestAndExpect(t, handler, successBody, "POST")
+	assert.Equal([]run.Request{{Type: run.FullRun}}, drain(runQueue))
+
+	// A forced full run absorbs a pending partial run.
+	runQueue.Add(run.Request{Type: run.PartialRun})
 	RequestAndExpect(t, handler, successBody, "POST")
+	assert.Equal([]run.Request{{Type: run.FullRun}}, drain(runQueue))
+}
+
+func TestForceRunHandlerServeHTTPNamespace(t *testing.T) {
+	log.InitLogger("info")
+	assert := assert.New(t)
+	runQueue := run.NewQueue()
+	handler := ForceRunHandler{
+		runQueue,
+		"secret",
+	}
+
+	// Invalid namespace is rejected.
+	RequestAndExpect(t, handler, namespaceInvalidBody, "POST", "namespace=../foo")
+
+	// A forced namespace run is queued after a pending partial run.
+	runQueue.Add(run.Request{Type: run.PartialRun})
+	RequestAndExpect(t, handler, namespaceSuccessBody, "POST", "namespace=foo")
+
+	// Force run request succeeds (namespace run already pending).
+	RequestAndExpect(t, handler, namespaceSuccessBody, "POST", "namespace=foo")
+
+	assert.Equal([]run.Request{{Type: run.PartialRun}, {Type: run.NamespaceRun, Namespace: "foo"}}, drain(runQueue))
+}
+
+func TestForceRunHandlerServeHTTPCommit(t *testing.T) {
+	log.InitLogger("info")
+	assert := assert.New(t)
+	runQueue := run.NewQueue()
+	handler := ForceRunHandler{
+		runQueue,
+		"secret",
+	}
+	unauthorizedBody := "{\"result\":\"error\",\"message\":\"Error: force rejected, applying a commit requires the webhook secret.\"}\n"
+
+	// Invalid commit is rejected.
+	RequestAndExpect(t, handler, "{\"result\":\"error\",\"message\":\"Error: force rejected, invalid commit \\\"--foo\\\".\"}\n", "POST", "commit=--foo")
 
-	// Empty the queue channel.
-	<-runQueue
+	// Requests without the secret are rejected.
+	RequestAndExpect(t, handler, unauthorizedBody, "POST", "commit=abc123")
+	assert.Equal(http.StatusUnauthorized, authorizedRequest(handler, "wrong", "commit=abc123").Code)
 
 	// Force run request succeeds (empty queue).
-	RequestAndExpect(t, handler, successBody, "POST")
+	w := authorizedRequest(handler, "secret", "commit=abc123")
+	assert.Equal("{\"result\":\"success\",\"message\":\"Run for commit abc123 queued, will begin upon completion of current run.\"}\n", w.Body.String())
+
+	// Namespace and commit can be combined.
+	w = authorizedRequest(handler, "secret", "namespace=foo", "commit=abc123")
+	assert.Equal("{\"result\":\"success\",\"message\":\"Run for namespace foo at commit abc123 queued, will begin upon completion of current run.\"}\n", w.Body.String())
+
+	assert.Equal([]run.Request{
+		{Type: run.FullRun, Commit: "abc123"},
+		{Type: run.NamespaceRun, Namespace: "foo", Commit: "abc123"},
+	}, drain(runQueue))
+
+	// Commits cannot be applied without a secret.
+	handler.Secret = ""
+	w = authorizedRequest(handler, "", "commit=abc123")
+	assert.Equal(http.StatusUnauthorized, w.Code)
+	assert.Equal(unauthorizedBody, w.Body.String())
+	assert.Equal(0, runQueue.Len())
+}
+
+func TestUnpinHandlerServeHTTP(t *testing.T) {
+	log.InitLogger("info")
+	assert := assert.New(t)
+	runQueue := run.NewQueue()
+	handler := &UnpinHandler{&run.Pin{}, runQueue, "secret"}
+
+	unpin := func(secret string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/api/v1/unpin", nil)
+		req.Header.Set("Authorization", "Bearer "+secret)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := unpin("wrong")
+	assert.Equal(http.StatusUnauthorized, w.Code)
+	assert.Equal("{\"result\":\"error\",\"message\":\"Error: unpin rejected, unpinning requires the webhook secret.\"}\n", w.Body.String())
+
+	// Nothing is queued when no commit is pinned
+	w = unpin("secret")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("{\"result\":\"success\",\"message\":\"No commit is pinned.\"}\n", w.Body.String())
+	assert.Equal(0, runQueue.Len())
+}
+
+// drain returns the pending requests of q, oldest first.
+func drain(q *run.Queue) []run.Request {
+	var requests []run.Request
+	for req, ok := q.Next(); ok; req, ok = q.Next() {
+		requests = append(requests, req)
+	}
+	return requests
+}
+
+// authorizedRequest sends a POST request to handler with secret as a bearer token.
+func authorizedRequest(handler ForceRunHandler, secret string, query ...string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "?"+strings.Join(query, "&"), nil)
+	req.Header.Set("Authorization", "Bearer "+secret)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
 }
 
-func RequestAndExpect(t *testing.T, handler ForceRunHandler, expectedBody, requestType string) {
+func RequestAndExpect(t *testing.T, handler ForceRunHandler, expectedBody, requestType string, query ...string) {
 	assert := assert.New(t)
-	req, _ := http.NewRequest(requestType, "", nil)
+	req, _ := http.NewRequest(requestType, "?"+strings.Join(query, "&"), nil)
 	w := httptest.NewRecorder()
 	handler.ServeHTTP(w, req)
 	assert.Equal(expectedBody, w.Body.String())